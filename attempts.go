@@ -0,0 +1,63 @@
+package httpcontrol
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Attempts describes how a response was obtained.
+type Attempts struct {
+	// The number of attempts made, including those of hedges.
+	Tries int
+
+	// The total time spent waiting between attempts.
+	RetryDelay time.Duration
+}
+
+// AttemptsFromResponse returns how the response was obtained, if it was
+// returned by a Transport. The Attempts are carried by the context of the
+// Request of the response, which is then a copy of the request made.
+func AttemptsFromResponse(res *http.Response) (Attempts, bool) {
+	if res == nil || res.Request == nil {
+		return Attempts{}, false
+	}
+	v, ok := res.Request.Context().Value(attemptsKey).(*attemptsValue)
+	if !ok {
+		return Attempts{}, false
+	}
+	return v.attempts, true
+}
+
+// attemptsValue is the context value set by withAttempts.
+type attemptsValue struct {
+	attempts Attempts
+	req      *http.Request // the request made
+	copy     *http.Request // the copy of req carrying the value
+}
+
+// withAttempts returns a copy of req carrying a.
+func withAttempts(req *http.Request, a Attempts) *http.Request {
+	v := &attemptsValue{attempts: a, req: req}
+	v.copy = req.WithContext(context.WithValue(req.Context(), attemptsKey, v))
+	return v.copy
+}
+
+// madeRequest returns the request made for the Request of a response, which
+// may be a copy of it made by withAttempts.
+func madeRequest(req *http.Request) *http.Request {
+	if v, ok := req.Context().Value(attemptsKey).(*attemptsValue); ok && v.copy == req {
+		return v.req
+	}
+	return req
+}
+
+// attempts returns the Attempts of the RoundTrip so far.
+func (rt *roundTrip) attempts() Attempts {
+	rt = rt.root()
+	return Attempts{
+		Tries:      int(atomic.LoadInt32(&rt.tries)),
+		RetryDelay: time.Duration(atomic.LoadInt64(&rt.delayed)),
+	}
+}
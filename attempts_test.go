@@ -0,0 +1,56 @@
+package httpcontrol_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"github.com/facebookgo/httpcontrol"
+)
+
+func TestAttemptsFromResponse(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(statusThenAnswerHandler(http.StatusBadGateway, 2))
+	defer server.Close()
+	transport := &httpcontrol.Transport{
+		MaxTries:      2,
+		RetryStatuses: []int{http.StatusBadGateway},
+		RetryBackoff:  httpcontrol.ConstantBackoff(10 * time.Millisecond),
+	}
+	client := &http.Client{Transport: transport}
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	attempts, ok := httpcontrol.AttemptsFromResponse(res)
+	ensure.True(t, ok)
+	ensure.DeepEqual(t, attempts.Tries, 3)
+	ensure.True(t, attempts.RetryDelay >= 20*time.Millisecond, attempts.RetryDelay)
+}
+
+func TestAttemptsFromResponseSingle(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(sleepHandler(0))
+	defer server.Close()
+	client := &http.Client{Transport: &httpcontrol.Transport{}}
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	attempts, ok := httpcontrol.AttemptsFromResponse(res)
+	ensure.True(t, ok)
+	ensure.DeepEqual(t, attempts, httpcontrol.Attempts{Tries: 1})
+}
+
+func TestAttemptsFromResponseOther(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(sleepHandler(0))
+	defer server.Close()
+	res, err := http.Get(server.URL)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	_, ok := httpcontrol.AttemptsFromResponse(res)
+	ensure.False(t, ok)
+	_, ok = httpcontrol.AttemptsFromResponse(nil)
+	ensure.False(t, ok)
+}
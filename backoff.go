@@ -0,0 +1,132 @@
+package httpcontrol
+
+import (
+	"math"
+	"math/rand"
+	"time"
+)
+
+// A BackoffStrategy computes the delays between the retries of a request, for
+// strategies that depend on the previous delay and so do not fit
+// Transport.RetryBackoff.
+type BackoffStrategy interface {
+	// Backoff returns the delay before the retry following the attempt try,
+	// starting at 0, given the delay it returned before the previous retry of
+	// the same request, or zero before the first one.
+	Backoff(try int, prev time.Duration) time.Duration
+}
+
+// ExponentialBackoff returns a function suitable for Transport.RetryBackoff.
+// The delay grows exponentially from base and is capped at max, with full
+// jitter applied so concurrent clients do not retry in lockstep. It spreads
+// retries best, at the price of sometimes retrying almost immediately.
+func ExponentialBackoff(base, max time.Duration) func(try int) time.Duration {
+	return ExponentialBackoffRand(base, max, nil)
+}
+
+// ExponentialBackoffRand is like ExponentialBackoff, drawing the jitter from
+// random instead of math/rand. Like rand.Float64 it returns numbers in
+// [0, 1), and it must be safe for concurrent use. A seeded source makes the
+// delays reproducible.
+func ExponentialBackoffRand(base, max time.Duration, random func() float64) func(try int) time.Duration {
+	return func(try int) time.Duration {
+		if base <= 0 || max <= 0 {
+			return 0
+		}
+		ceil := base
+		for i := 0; i < try && ceil < max; i++ {
+			ceil *= 2
+		}
+		if ceil > max || ceil <= 0 {
+			ceil = max
+		}
+		if ceil >= math.MaxInt64 {
+			ceil = math.MaxInt64 - 1
+		}
+		return time.Duration(randInt63n(random, int64(ceil)+1))
+	}
+}
+
+// ConstantBackoff returns a function suitable for Transport.RetryBackoff that
+// always waits d. It is predictable, but clients failing together also retry
+// together, so it suits a few clients or short outages.
+func ConstantBackoff(d time.Duration) func(try int) time.Duration {
+	return func(int) time.Duration {
+		if d < 0 {
+			return 0
+		}
+		return d
+	}
+}
+
+// LinearBackoff returns a function suitable for Transport.RetryBackoff. The
+// delay grows by base for every try and is capped at max, without jitter. It
+// backs off more gently than ExponentialBackoff, which suits transient
+// failures, but also retries in lockstep.
+func LinearBackoff(base, max time.Duration) func(try int) time.Duration {
+	return func(try int) time.Duration {
+		if base <= 0 || max <= 0 {
+			return 0
+		}
+		if try < 0 {
+			try = 0
+		}
+		if int64(try) >= int64(max/base) {
+			return max
+		}
+		return base * time.Duration(try+1)
+	}
+}
+
+// DecorrelatedJitter returns a BackoffStrategy, for Transport.Backoff, picking
+// each delay at random between base and three times the previous one, capped
+// at max. Like ExponentialBackoff it avoids retrying in lockstep, but it
+// never waits less than base and grows less erratically, as every delay
+// builds on the previous one.
+func DecorrelatedJitter(base, max time.Duration) BackoffStrategy {
+	return decorrelatedJitter{base: base, max: max}
+}
+
+// DecorrelatedJitterRand is like DecorrelatedJitter, drawing the delays from
+// random as described for ExponentialBackoffRand.
+func DecorrelatedJitterRand(base, max time.Duration, random func() float64) BackoffStrategy {
+	return decorrelatedJitter{base: base, max: max, random: random}
+}
+
+type decorrelatedJitter struct {
+	base, max time.Duration
+	random    func() float64
+}
+
+func (j decorrelatedJitter) Backoff(_ int, prev time.Duration) time.Duration {
+	if j.base <= 0 || j.max <= 0 {
+		return 0
+	}
+	if j.base >= j.max {
+		return j.max
+	}
+	if prev < j.base {
+		prev = j.base
+	}
+	ceil := prev * 3
+	if ceil > j.max || ceil < prev {
+		ceil = j.max
+	}
+	return j.base + time.Duration(randInt63n(j.random, int64(ceil-j.base)+1))
+}
+
+// randInt63n returns a number in [0, n) drawn from random, or from math/rand
+// if random is nil.
+func randInt63n(random func() float64, n int64) int64 {
+	if random == nil {
+		return rand.Int63n(n)
+	}
+	v := int64(random() * float64(n))
+	if v < 0 {
+		return 0
+	}
+	if v >= n {
+		return n - 1
+	}
+	return v
+}
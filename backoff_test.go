@@ -0,0 +1,178 @@
+package httpcontrol_test
+
+import (
+	"math"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"github.com/facebookgo/httpcontrol"
+)
+
+func TestExponentialBackoffBounds(t *testing.T) {
+	const (
+		base = 10 * time.Millisecond
+		max  = time.Second
+	)
+	backoff := httpcontrol.ExponentialBackoff(base, max)
+	for try := 0; try < 100; try++ {
+		ceil := max
+		if try < 7 {
+			ceil = base << uint(try)
+		}
+		for i := 0; i < 10; i++ {
+			d := backoff(try)
+			ensure.True(t, d >= 0 && d <= ceil, d, try)
+		}
+	}
+}
+
+func TestExponentialBackoffZero(t *testing.T) {
+	ensure.DeepEqual(t, httpcontrol.ExponentialBackoff(0, time.Second)(3), time.Duration(0))
+	ensure.DeepEqual(t, httpcontrol.ExponentialBackoff(time.Second, 0)(3), time.Duration(0))
+}
+
+func TestExponentialBackoffMaxDuration(t *testing.T) {
+	const max = time.Duration(math.MaxInt64)
+	high := func() float64 { return math.Nextafter(1, 0) }
+	for _, random := range []func() float64{nil, high} {
+		backoff := httpcontrol.ExponentialBackoffRand(time.Second, max, random)
+		for _, try := range []int{0, 10, 40, 100} {
+			d := backoff(try)
+			ensure.True(t, d >= 0 && d <= max, d, try)
+		}
+	}
+}
+
+func TestConstantBackoff(t *testing.T) {
+	backoff := httpcontrol.ConstantBackoff(time.Second)
+	for try := 0; try < 10; try++ {
+		ensure.DeepEqual(t, backoff(try), time.Second)
+	}
+	ensure.DeepEqual(t, httpcontrol.ConstantBackoff(-time.Second)(0), time.Duration(0))
+}
+
+func TestLinearBackoff(t *testing.T) {
+	backoff := httpcontrol.LinearBackoff(100*time.Millisecond, time.Second)
+	ensure.DeepEqual(t, backoff(0), 100*time.Millisecond)
+	ensure.DeepEqual(t, backoff(1), 200*time.Millisecond)
+	ensure.DeepEqual(t, backoff(8), 900*time.Millisecond)
+	ensure.DeepEqual(t, backoff(9), time.Second)
+	ensure.DeepEqual(t, backoff(math.MaxInt32), time.Second)
+	ensure.DeepEqual(t, httpcontrol.LinearBackoff(0, time.Second)(3), time.Duration(0))
+}
+
+func TestBackoffBoundsProperty(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		base := time.Duration(r.Int63n(int64(time.Second)))
+		max := time.Duration(r.Int63n(int64(time.Minute)))
+		exponential := httpcontrol.ExponentialBackoff(base, max)
+		linear := httpcontrol.LinearBackoff(base, max)
+		jitter := httpcontrol.DecorrelatedJitter(base, max)
+		var prev time.Duration
+		for try := 0; try < 70; try++ {
+			for _, d := range []time.Duration{exponential(try), linear(try)} {
+				ensure.True(t, d >= 0 && d <= max, d, base, max, try)
+			}
+			d := jitter.Backoff(try, prev)
+			ensure.True(t, d >= 0 && d <= max, d, base, max, try)
+			if base > 0 && max > 0 {
+				ensure.True(t, d >= base || d == max, d, base, max, try)
+				if prev > 0 {
+					ensure.True(t, d <= 3*prev || d <= base, d, prev, try)
+				}
+			}
+			prev = d
+		}
+	}
+}
+
+func TestBackoffRandReproducible(t *testing.T) {
+	const (
+		base = 10 * time.Millisecond
+		max  = time.Second
+	)
+	sequence := func(seed int64) []time.Duration {
+		exponential := httpcontrol.ExponentialBackoffRand(base, max, rand.New(rand.NewSource(seed)).Float64)
+		jitter := httpcontrol.DecorrelatedJitterRand(base, max, rand.New(rand.NewSource(seed)).Float64)
+		var delays []time.Duration
+		var prev time.Duration
+		for try := 0; try < 20; try++ {
+			d := exponential(try)
+			ensure.True(t, d >= 0 && d <= max, d, try)
+			prev = jitter.Backoff(try, prev)
+			ensure.True(t, prev >= base && prev <= max, prev, try)
+			delays = append(delays, d, prev)
+		}
+		return delays
+	}
+	ensure.DeepEqual(t, sequence(1), sequence(1))
+	ensure.NotDeepEqual(t, sequence(1), sequence(2))
+}
+
+func TestBackoffRandEdges(t *testing.T) {
+	low := func() float64 { return 0 }
+	high := func() float64 { return math.Nextafter(1, 0) }
+	ensure.DeepEqual(t, httpcontrol.ExponentialBackoffRand(time.Second, time.Minute, low)(2), time.Duration(0))
+	ensure.DeepEqual(t, httpcontrol.ExponentialBackoffRand(time.Second, time.Minute, high)(2), 4*time.Second)
+	ensure.DeepEqual(t, httpcontrol.DecorrelatedJitterRand(time.Second, time.Minute, low).Backoff(0, 0), time.Second)
+	ensure.DeepEqual(t, httpcontrol.DecorrelatedJitterRand(time.Second, time.Minute, high).Backoff(0, 0), 3*time.Second)
+}
+
+func TestDecorrelatedJitterTransport(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(sleepHandler(0))
+	server.Close()
+	const (
+		base = time.Second
+		max  = time.Minute
+	)
+	transport := &httpcontrol.Transport{
+		MaxTries: 20,
+		Backoff:  httpcontrol.DecorrelatedJitter(base, max),
+	}
+	httpcontrol.SetClock(transport, httpcontrol.NewFakeClock())
+	var delays []time.Duration
+	transport.Stats = func(stats *httpcontrol.Stats) {
+		if stats.Retry.Pending {
+			delays = append(delays, stats.Retry.Delay)
+		}
+	}
+	client := &http.Client{Transport: transport}
+	_, err := client.Get(server.URL)
+	ensure.NotNil(t, err)
+	ensure.DeepEqual(t, len(delays), 20)
+	prev := base
+	for _, d := range delays {
+		ensure.True(t, d >= base && d <= max && d <= 3*prev, d, prev)
+		prev = d
+	}
+}
+
+func TestMaxTotalBackoff(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(sleepHandler(0))
+	server.Close()
+	var summary *httpcontrol.Summary
+	var skipped bool
+	transport := &httpcontrol.Transport{
+		MaxTries:        10,
+		RetryBackoff:    httpcontrol.ConstantBackoff(30 * time.Millisecond),
+		MaxTotalBackoff: 100 * time.Millisecond,
+		Stats: func(stats *httpcontrol.Stats) {
+			skipped = stats.Retry.Skipped
+		},
+		Done: func(s *httpcontrol.Summary) { summary = s },
+	}
+	httpcontrol.SetClock(transport, httpcontrol.NewFakeClock())
+	client := &http.Client{Transport: transport}
+	_, err := client.Get(server.URL)
+	ensure.NotNil(t, err)
+	ensure.DeepEqual(t, summary.Tries, 4)
+	ensure.DeepEqual(t, summary.RetryDelay, 90*time.Millisecond)
+	ensure.True(t, skipped)
+}
@@ -0,0 +1,53 @@
+package httpcontrol
+
+// retryBudgetMax caps the retries banked in the budget, so a long run of
+// successes does not allow an unbounded burst of retries during an outage.
+// The budget starts full.
+const retryBudgetMax = 10
+
+// retryBudget is a token bucket of retries. Successful attempts deposit
+// RetryBudgetRatio tokens and each retry withdraws one. It tracks the tokens
+// spent so the zero value is a full budget.
+type retryBudget struct {
+	spent float64
+}
+
+// retryBudgetDeposit credits the budget for a successful attempt.
+func (t *Transport) retryBudgetDeposit() {
+	if t.RetryBudgetRatio <= 0 {
+		return
+	}
+	t.budgetMu.Lock()
+	t.budget.spent -= t.RetryBudgetRatio
+	if t.budget.spent < 0 {
+		t.budget.spent = 0
+	}
+	t.budgetMu.Unlock()
+}
+
+// retryBudgetWithdraw takes a token for a retry, reporting whether one was
+// available.
+func (t *Transport) retryBudgetWithdraw() bool {
+	if t.RetryBudgetRatio <= 0 {
+		return true
+	}
+	t.budgetMu.Lock()
+	defer t.budgetMu.Unlock()
+	if t.budget.spent+1 > retryBudgetMax {
+		return false
+	}
+	t.budget.spent++
+	return true
+}
+
+// retryBudgetRefund returns a token taken for a retry that was not made.
+func (t *Transport) retryBudgetRefund() {
+	if t.RetryBudgetRatio <= 0 {
+		return
+	}
+	t.budgetMu.Lock()
+	if t.budget.spent--; t.budget.spent < 0 {
+		t.budget.spent = 0
+	}
+	t.budgetMu.Unlock()
+}
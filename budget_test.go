@@ -0,0 +1,43 @@
+package httpcontrol_test
+
+import (
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+	"github.com/facebookgo/freeport"
+	"github.com/facebookgo/httpcontrol"
+)
+
+func TestRetryBudget(t *testing.T) {
+	t.Parallel()
+	port, err := freeport.Get()
+	ensure.Nil(t, err)
+	var attempts int
+	var last *httpcontrol.Stats
+	transport := &httpcontrol.Transport{
+		MaxTries:         100,
+		RetryBudgetRatio: 0.5,
+		Stats: func(stats *httpcontrol.Stats) {
+			attempts++
+			last = stats
+		},
+	}
+	client := &http.Client{Transport: transport}
+	url := fmt.Sprintf("http://127.0.0.1:%d/", port)
+
+	// The initial reserve allows 10 retries.
+	_, err = client.Get(url)
+	ensure.NotNil(t, err)
+	ensure.DeepEqual(t, attempts, 11)
+	ensure.True(t, last.Retry.BudgetExhausted)
+	ensure.False(t, last.Retry.Pending)
+
+	// The budget is shared, and is now exhausted.
+	attempts = 0
+	_, err = client.Get(url)
+	ensure.NotNil(t, err)
+	ensure.DeepEqual(t, attempts, 1)
+	ensure.True(t, last.Retry.BudgetExhausted)
+}
@@ -0,0 +1,37 @@
+package httpcontrol
+
+import (
+	"errors"
+	"log"
+	"runtime/debug"
+)
+
+// ErrCallbackPanic fails an attempt whose ValidateResponse or SignRequest
+// panicked.
+var ErrCallbackPanic = errors.New("httpcontrol: panic in callback")
+
+// callback calls the user callback f, recovering from a panic in it so that a
+// broken hook does not fail the request. The recovered value goes to the
+// OnCallbackPanic, or the standard logger along with the stack by default.
+func (t *Transport) callback(f func()) {
+	defer func() {
+		v := recover()
+		if v == nil {
+			return
+		}
+		if t.OnCallbackPanic != nil {
+			t.OnCallbackPanic(v)
+			return
+		}
+		log.Printf("httpcontrol: panic in callback: %v\n%s", v, debug.Stack())
+	}()
+	f()
+}
+
+// callbackErr calls the user callback f like callback, returning its error,
+// or ErrCallbackPanic if it panicked.
+func (t *Transport) callbackErr(f func() error) error {
+	err := ErrCallbackPanic
+	t.callback(func() { err = f() })
+	return err
+}
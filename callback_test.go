@@ -0,0 +1,124 @@
+package httpcontrol_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"github.com/facebookgo/httpcontrol"
+)
+
+func TestCallbackPanicRecovered(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(sleepHandler(0))
+	defer server.Close()
+	var (
+		mu        sync.Mutex
+		recovered []interface{}
+		observed  int
+	)
+	transport := &httpcontrol.Transport{
+		Stats: func(*httpcontrol.Stats) { panic("stats") },
+		Done:  func(*httpcontrol.Summary) { panic("done") },
+		Tap:   func(*http.Request, []byte, []byte) { panic("tap") },
+		OnCallbackPanic: func(v interface{}) {
+			mu.Lock()
+			recovered = append(recovered, v)
+			mu.Unlock()
+		},
+	}
+	transport.AddStatsObserver(func(*httpcontrol.Stats) { observed++ })
+	client := &http.Client{Transport: transport}
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	mu.Lock()
+	defer mu.Unlock()
+	ensure.SameElements(t, recovered, []interface{}{"stats", "done", "tap"})
+	ensure.DeepEqual(t, observed, 1)
+}
+
+func TestCallbackPanicOnError(t *testing.T) {
+	t.Parallel()
+	var recovered interface{}
+	transport := &httpcontrol.Transport{
+		Stats:           func(*httpcontrol.Stats) { panic("stats") },
+		OnCallbackPanic: func(v interface{}) { recovered = v },
+	}
+	client := &http.Client{Transport: transport}
+	_, err := client.Get("http://127.0.0.1:1/")
+	ensure.NotNil(t, err)
+	ensure.DeepEqual(t, recovered, "stats")
+}
+
+func TestCallbackPanicInHooks(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(sleepHandler(0))
+	defer server.Close()
+	var (
+		mu        sync.Mutex
+		recovered []interface{}
+	)
+	transport := &httpcontrol.Transport{
+		MaxTries:     1,
+		Coalesce:     true,
+		CoalesceKey:  func(*http.Request) string { panic("coalesce key") },
+		Failover:     func(*http.Request, int) *url.URL { panic("failover") },
+		RetryBackoff: func(int) time.Duration { panic("retry backoff") },
+		ShouldRetry: func(*http.Request, *http.Response, error, int) bool {
+			panic("should retry")
+		},
+		ValidateResponse: func(*http.Response) error { panic("validate") },
+		OnCallbackPanic: func(v interface{}) {
+			mu.Lock()
+			recovered = append(recovered, v)
+			mu.Unlock()
+		},
+	}
+	defer transport.Close()
+
+	// The attempt fails validation, and is not retried.
+	res, err := (&http.Client{Transport: transport}).Get(server.URL)
+	ensure.True(t, errors.Is(err, httpcontrol.ErrCallbackPanic), err)
+	ensure.True(t, res == nil)
+	mu.Lock()
+	ensure.SameElements(t, recovered, []interface{}{"coalesce key", "validate", "should retry"})
+	recovered = nil
+	mu.Unlock()
+
+	// A retry goes to the original host without a delay.
+	retried := httptest.NewServer(statusThenAnswerHandler(http.StatusServiceUnavailable, 1))
+	defer retried.Close()
+	transport = &httpcontrol.Transport{
+		MaxTries:        1,
+		RetryStatuses:   []int{http.StatusServiceUnavailable},
+		Failover:        transport.Failover,
+		RetryBackoff:    transport.RetryBackoff,
+		OnCallbackPanic: transport.OnCallbackPanic,
+	}
+	defer transport.Close()
+	res, err = (&http.Client{Transport: transport}).Get(retried.URL)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	mu.Lock()
+	ensure.SameElements(t, recovered, []interface{}{"retry backoff", "failover"})
+	recovered = nil
+	mu.Unlock()
+
+	// A panicking SignRequest fails the attempt.
+	transport = &httpcontrol.Transport{
+		SignRequest:     func(*http.Request) error { panic("sign") },
+		OnCallbackPanic: transport.OnCallbackPanic,
+	}
+	defer transport.Close()
+	_, err = (&http.Client{Transport: transport}).Get(server.URL)
+	ensure.True(t, errors.Is(err, httpcontrol.ErrCallbackPanic), err)
+	mu.Lock()
+	ensure.SameElements(t, recovered, []interface{}{"sign"})
+	mu.Unlock()
+}
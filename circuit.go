@@ -0,0 +1,92 @@
+package httpcontrol
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrCircuitOpen is returned by RoundTrip when the circuit breaker for the
+// host of the request is open.
+var ErrCircuitOpen = errors.New("httpcontrol: circuit open")
+
+// circuitResult is the outcome of an attempt as seen by the circuit breaker.
+type circuitResult int
+
+const (
+	circuitSuccess circuitResult = iota
+	circuitFailure
+	circuitIgnore
+)
+
+// circuit is the circuit breaker state for a single host.
+type circuit struct {
+	failures  int       // consecutive failures
+	first     time.Time // time of the first of the consecutive failures
+	openUntil time.Time // the circuit is open until this time
+	probing   bool      // a probe request is in flight
+}
+
+// circuitAllow reports whether an attempt to host may proceed. Once the
+// cooldown of an open circuit has passed a single probe attempt is allowed,
+// and the circuit closes again if it succeeds.
+func (t *Transport) circuitAllow(host string) bool {
+	if t.CircuitThreshold <= 0 {
+		return true
+	}
+	t.circuitMu.Lock()
+	defer t.circuitMu.Unlock()
+	c := t.circuits[host]
+	if c == nil || c.failures < t.CircuitThreshold {
+		return true
+	}
+	if c.probing || time.Now().Before(c.openUntil) {
+		return false
+	}
+	c.probing = true
+	return true
+}
+
+// circuitRecord records the result of an attempt to host and reports whether
+// the circuit is now open.
+func (t *Transport) circuitRecord(host string, result circuitResult) bool {
+	if t.CircuitThreshold <= 0 {
+		return false
+	}
+	t.circuitMu.Lock()
+	defer t.circuitMu.Unlock()
+	c := t.circuits[host]
+	switch result {
+	case circuitSuccess:
+		delete(t.circuits, host)
+		return false
+	case circuitIgnore:
+		if c == nil {
+			return false
+		}
+		c.probing = false
+		return c.failures >= t.CircuitThreshold
+	}
+
+	now := time.Now()
+	if c == nil {
+		if t.circuits == nil {
+			t.circuits = make(map[string]*circuit)
+		}
+		c = &circuit{}
+		t.circuits[host] = c
+	}
+	if c.failures < t.CircuitThreshold && t.CircuitWindow != 0 &&
+		now.Sub(c.first) > t.CircuitWindow {
+		c.failures = 0
+	}
+	if c.failures == 0 {
+		c.first = now
+	}
+	c.failures++
+	c.probing = false
+	if c.failures >= t.CircuitThreshold {
+		c.openUntil = now.Add(t.CircuitCooldown)
+		return true
+	}
+	return false
+}
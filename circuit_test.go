@@ -0,0 +1,77 @@
+package httpcontrol
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+)
+
+func TestCircuitOpensAfterThreshold(t *testing.T) {
+	tr := Transport{CircuitThreshold: 2, CircuitCooldown: time.Hour}
+	ensure.True(t, tr.circuitAllow("a"))
+	ensure.False(t, tr.circuitRecord("a", circuitFailure))
+	ensure.True(t, tr.circuitAllow("a"))
+	ensure.True(t, tr.circuitRecord("a", circuitFailure))
+	ensure.False(t, tr.circuitAllow("a"))
+	ensure.True(t, tr.circuitAllow("b"))
+}
+
+func TestCircuitSuccessResets(t *testing.T) {
+	tr := Transport{CircuitThreshold: 2, CircuitCooldown: time.Hour}
+	tr.circuitRecord("a", circuitFailure)
+	tr.circuitRecord("a", circuitSuccess)
+	ensure.False(t, tr.circuitRecord("a", circuitFailure))
+	ensure.True(t, tr.circuitAllow("a"))
+}
+
+func TestCircuitWindow(t *testing.T) {
+	tr := Transport{
+		CircuitThreshold: 2,
+		CircuitWindow:    time.Millisecond,
+		CircuitCooldown:  time.Hour,
+	}
+	tr.circuitRecord("a", circuitFailure)
+	time.Sleep(5 * time.Millisecond)
+	ensure.False(t, tr.circuitRecord("a", circuitFailure))
+	ensure.True(t, tr.circuitRecord("a", circuitFailure))
+}
+
+func TestCircuitSingleProbe(t *testing.T) {
+	tr := Transport{CircuitThreshold: 1}
+	ensure.True(t, tr.circuitRecord("a", circuitFailure))
+	ensure.True(t, tr.circuitAllow("a"))
+	ensure.False(t, tr.circuitAllow("a"))
+
+	// a failed probe opens the circuit again
+	ensure.True(t, tr.circuitRecord("a", circuitFailure))
+	ensure.True(t, tr.circuitAllow("a"))
+	ensure.False(t, tr.circuitRecord("a", circuitSuccess))
+	ensure.True(t, tr.circuitAllow("a"))
+	ensure.True(t, tr.circuitAllow("a"))
+}
+
+func TestCircuitIgnoredProbe(t *testing.T) {
+	tr := Transport{CircuitThreshold: 1}
+	tr.circuitRecord("a", circuitFailure)
+	ensure.True(t, tr.circuitAllow("a"))
+	ensure.True(t, tr.circuitRecord("a", circuitIgnore))
+	ensure.True(t, tr.circuitAllow("a"))
+}
+
+func TestCircuitConcurrent(t *testing.T) {
+	tr := Transport{CircuitThreshold: 10, CircuitCooldown: time.Hour}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if tr.circuitAllow("a") {
+				tr.circuitRecord("a", circuitFailure)
+			}
+		}()
+	}
+	wg.Wait()
+	ensure.False(t, tr.circuitAllow("a"))
+}
@@ -0,0 +1,39 @@
+package httpcontrol
+
+import (
+	"time"
+)
+
+// clock is the source of time for timeouts and backoff, which tests replace
+// to run deterministically.
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	Sleep(d time.Duration)
+	AfterFunc(d time.Duration, f func()) clockTimer
+}
+
+// clockTimer is a timer created by a clock, like a *time.Timer.
+type clockTimer interface {
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// realClock is the clock backed by the time package.
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (realClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+
+func (realClock) AfterFunc(d time.Duration, f func()) clockTimer {
+	return time.AfterFunc(d, f)
+}
+
+// clock returns the clock used by the Transport.
+func (t *Transport) clock() clock {
+	if t.clk != nil {
+		return t.clk
+	}
+	return realClock{}
+}
@@ -0,0 +1,115 @@
+package httpcontrol
+
+import (
+	"maps"
+	"slices"
+)
+
+// Clone returns a copy of the Transport configuration, which may then be
+// changed without affecting t. Slices, maps, the Header and the
+// TLSClientConfig are copied, while functions, the Logger and the Limiter are
+// shared. The clone builds its own underlying transport when first used, so it
+// does not share connections, circuits, stats or the retry budget with t,
+// unless it was made by Wrap, whose RoundTripper is shared.
+func (t *Transport) Clone() *Transport {
+	c := &Transport{
+		Proxy:                       t.Proxy,
+		ProxyConnect:                t.ProxyConnect,
+		DynamicProxyEnv:             t.DynamicProxyEnv,
+		TLSConfigForHost:            t.TLSConfigForHost,
+		MinTLSVersion:               t.MinTLSVersion,
+		CipherSuites:                slices.Clone(t.CipherSuites),
+		TLSSessionCache:             t.TLSSessionCache,
+		DisableKeepAlives:           t.DisableKeepAlives,
+		DisableCompression:          t.DisableCompression,
+		ManualDecompression:         t.ManualDecompression,
+		ExtraEncodings:              slices.Clone(t.ExtraEncodings),
+		Header:                      t.Header.Clone(),
+		RequestIDHeader:             t.RequestIDHeader,
+		HostOverride:                maps.Clone(t.HostOverride),
+		ServerNameOverride:          maps.Clone(t.ServerNameOverride),
+		SignRequest:                 t.SignRequest,
+		EnableHTTP2:                 t.EnableHTTP2,
+		MaxIdleConnsPerHost:         t.MaxIdleConnsPerHost,
+		IdleConnTimeout:             t.IdleConnTimeout,
+		MaxConnsPerHost:             t.MaxConnsPerHost,
+		MaxConcurrentDials:          t.MaxConcurrentDials,
+		Dial:                        t.Dial,
+		DialContext:                 t.DialContext,
+		DialTimeout:                 t.DialTimeout,
+		DialTimeoutJitter:           t.DialTimeoutJitter,
+		ConnectJitter:               t.ConnectJitter,
+		RandFloat:                   t.RandFloat,
+		TLSHandshakeTimeout:         t.TLSHandshakeTimeout,
+		DialKeepAlive:               t.DialKeepAlive,
+		DialKeepAliveConfig:         t.DialKeepAliveConfig,
+		LocalAddr:                   t.LocalAddr,
+		DialControl:                 t.DialControl,
+		TCPNoDelay:                  t.TCPNoDelay,
+		HappyEyeballs:               t.HappyEyeballs,
+		HappyEyeballsDelay:          t.HappyEyeballsDelay,
+		DNSCacheTTL:                 t.DNSCacheTTL,
+		ResponseHeaderTimeout:       t.ResponseHeaderTimeout,
+		StrictResponseHeaderTimeout: t.StrictResponseHeaderTimeout,
+		ResponseBodyTimeout:         t.ResponseBodyTimeout,
+		MaxResponseHeaderBytes:      t.MaxResponseHeaderBytes,
+		MaxResponseBodyBytes:        t.MaxResponseBodyBytes,
+		ForceContentLength:          t.ForceContentLength,
+		MaxBufferedRequestBody:      t.MaxBufferedRequestBody,
+		CompressRequestBody:         t.CompressRequestBody,
+		CompressMinBytes:            t.CompressMinBytes,
+		RequestTimeout:              t.RequestTimeout,
+		RequestTimeoutCoversBody:    t.RequestTimeoutCoversBody,
+		TotalTimeout:                t.TotalTimeout,
+		RetryAfterTimeout:           t.RetryAfterTimeout,
+		RetryableError:              t.RetryableError,
+		ShouldRetry:                 t.ShouldRetry,
+		MaxTries:                    t.MaxTries,
+		RetryFreshConn:              t.RetryFreshConn,
+		NoRetryHosts:                slices.Clone(t.NoRetryHosts),
+		Failover:                    t.Failover,
+		RetryBackoff:                t.RetryBackoff,
+		Backoff:                     t.Backoff,
+		ValidateResponse:            t.ValidateResponse,
+		ValidateBodyBytes:           t.ValidateBodyBytes,
+		RetryStatuses:               slices.Clone(t.RetryStatuses),
+		RetryNonIdempotent:          t.RetryNonIdempotent,
+		RetryOnlyBeforeWrite:        t.RetryOnlyBeforeWrite,
+		StrictRetry:                 t.StrictRetry,
+		MaxRetryAfter:               t.MaxRetryAfter,
+		MaxTotalBackoff:             t.MaxTotalBackoff,
+		HedgeDelay:                  t.HedgeDelay,
+		Coalesce:                    t.Coalesce,
+		CoalesceKey:                 t.CoalesceKey,
+		RetryBudgetRatio:            t.RetryBudgetRatio,
+		RateLimit:                   t.RateLimit,
+		RateBurst:                   t.RateBurst,
+		Limiter:                     t.Limiter,
+		CircuitThreshold:            t.CircuitThreshold,
+		CircuitWindow:               t.CircuitWindow,
+		CircuitCooldown:             t.CircuitCooldown,
+		Stats:                       t.Stats,
+		Done:                        t.Done,
+		OnConnClose:                 t.OnConnClose,
+		Tap:                         t.Tap,
+		TapBodies:                   t.TapBodies,
+		TapMaxBytes:                 t.TapMaxBytes,
+		Trace1xx:                    t.Trace1xx,
+		Logger:                      t.Logger,
+		Warn:                        t.Warn,
+		OnCallbackPanic:             t.OnCallbackPanic,
+		base:                        t.base,
+		clk:                         t.clk,
+		observers:                   t.statsObservers(),
+	}
+	if t.TLSClientConfig != nil {
+		c.TLSClientConfig = t.TLSClientConfig.Clone()
+	}
+	if t.PinnedKeys != nil {
+		c.PinnedKeys = make(map[string][]string, len(t.PinnedKeys))
+		for host, keys := range t.PinnedKeys {
+			c.PinnedKeys[host] = slices.Clone(keys)
+		}
+	}
+	return c
+}
@@ -0,0 +1,140 @@
+package httpcontrol_test
+
+import (
+	"crypto/tls"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"github.com/facebookgo/httpcontrol"
+)
+
+func TestClone(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(sleepHandler(0))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	ensure.Nil(t, err)
+	transport := &httpcontrol.Transport{
+		RequestTimeout:  time.Second,
+		TLSClientConfig: &tls.Config{ServerName: "base"},
+		Header:          http.Header{"X-Service": {"base"}},
+		RetryStatuses:   []int{http.StatusServiceUnavailable},
+	}
+	res, err := (&http.Client{Transport: transport}).Get(server.URL)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	ensure.DeepEqual(t, waitIdle(t, transport, u.Host, 1).Dials, uint64(1))
+
+	clone := transport.Clone()
+	ensure.DeepEqual(t, clone.RequestTimeout, time.Second)
+	ensure.DeepEqual(t, clone.TLSClientConfig.ServerName, "base")
+	clone.RequestTimeout = time.Minute
+	clone.TLSClientConfig.ServerName = "clone"
+	clone.Header.Set("X-Service", "clone")
+	clone.RetryStatuses[0] = http.StatusBadGateway
+	ensure.DeepEqual(t, transport.RequestTimeout, time.Second)
+	ensure.DeepEqual(t, transport.TLSClientConfig.ServerName, "base")
+	ensure.DeepEqual(t, transport.Header.Get("X-Service"), "base")
+	ensure.DeepEqual(t, transport.RetryStatuses, []int{http.StatusServiceUnavailable})
+
+	// The clone starts with an empty pool and dials its own connection.
+	stat := clone.PoolStats()
+	ensure.DeepEqual(t, stat.Dials, uint64(0))
+	ensure.DeepEqual(t, len(stat.Idle), 0)
+	res, err = (&http.Client{Transport: clone}).Get(server.URL)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	ensure.DeepEqual(t, waitIdle(t, clone, u.Host, 1).Dials, uint64(1))
+	ensure.DeepEqual(t, transport.PoolStats().Dials, uint64(1))
+
+	clone.CloseIdleConnections()
+	ensure.DeepEqual(t, waitIdle(t, transport, u.Host, 1).Idle[u.Host], 1)
+}
+
+// fillValue sets v, and what it holds, to a value other than the zero value.
+// Interfaces are set from the values, by type.
+func fillValue(t *testing.T, v reflect.Value, values map[reflect.Type]interface{}) {
+	switch v.Kind() {
+	case reflect.Bool:
+		v.SetBool(true)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		v.SetInt(1)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		v.SetUint(1)
+	case reflect.Float32, reflect.Float64:
+		v.SetFloat(0.5)
+	case reflect.String:
+		v.SetString("x")
+	case reflect.Slice:
+		v.Set(reflect.MakeSlice(v.Type(), 1, 1))
+		fillValue(t, v.Index(0), values)
+	case reflect.Map:
+		v.Set(reflect.MakeMap(v.Type()))
+		key := reflect.New(v.Type().Key()).Elem()
+		elem := reflect.New(v.Type().Elem()).Elem()
+		fillValue(t, key, values)
+		fillValue(t, elem, values)
+		v.SetMapIndex(key, elem)
+	case reflect.Ptr:
+		v.Set(reflect.New(v.Type().Elem()))
+		if v.Type().Elem().Kind() != reflect.Struct {
+			fillValue(t, v.Elem(), values)
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).IsExported() {
+				fillValue(t, v.Field(i), values)
+			}
+		}
+	case reflect.Func:
+		v.Set(reflect.MakeFunc(v.Type(), func([]reflect.Value) []reflect.Value {
+			return nil
+		}))
+	case reflect.Interface:
+		value, ok := values[v.Type()]
+		if !ok {
+			t.Fatalf("no value for %s", v.Type())
+		}
+		v.Set(reflect.ValueOf(value))
+	default:
+		t.Fatalf("cannot fill %s", v.Type())
+	}
+}
+
+func TestCloneCopiesEveryField(t *testing.T) {
+	t.Parallel()
+	values := map[reflect.Type]interface{}{
+		reflect.TypeOf((*httpcontrol.Logger)(nil)).Elem():          httpcontrol.NewTextLogger(log.Default()),
+		reflect.TypeOf((*httpcontrol.BackoffStrategy)(nil)).Elem(): httpcontrol.DecorrelatedJitter(time.Second, time.Minute),
+		reflect.TypeOf((*net.Addr)(nil)).Elem():                    &net.TCPAddr{},
+	}
+	transport := &httpcontrol.Transport{}
+	v := reflect.ValueOf(transport).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		if v.Type().Field(i).IsExported() {
+			fillValue(t, v.Field(i), values)
+		}
+	}
+
+	// A field missing from Clone is left zero in the clone.
+	c := reflect.ValueOf(transport.Clone()).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		want, got := v.Field(i), c.Field(i)
+		if field.Type.Kind() == reflect.Func {
+			ensure.DeepEqual(t, got.Pointer(), want.Pointer(), field.Name)
+			continue
+		}
+		ensure.DeepEqual(t, got.Interface(), want.Interface(), field.Name)
+	}
+}
@@ -0,0 +1,52 @@
+package httpcontrol
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrClosed is returned by RoundTrip once the Transport has been closed.
+var ErrClosed = errors.New("httpcontrol: transport closed")
+
+// Close stops the Transport from accepting new requests, closes its idle
+// connections and forgets the TLS sessions of the TLSSessionCache. Requests
+// already in flight are not waited for; use CloseWait for that.
+func (t *Transport) Close() {
+	t.startOnce.Do(t.start)
+	t.mu.Lock()
+	t.closed = true
+	t.mu.Unlock()
+	t.closeIdleConnections()
+	t.sessions.clear()
+}
+
+// CloseWait stops the Transport from accepting new requests, after which
+// RoundTrip returns ErrClosed, and waits for the requests in flight to
+// complete. A request is complete once its response body has been closed.
+// Idle connections are closed, and TLS sessions forgotten, once the requests
+// are complete or ctx is done, in which case the error from ctx is returned.
+func (t *Transport) CloseWait(ctx context.Context) error {
+	t.startOnce.Do(t.start)
+	t.mu.Lock()
+	t.closed = true
+	var drained chan struct{}
+	if len(t.cancels) != 0 {
+		if t.drained == nil {
+			t.drained = make(chan struct{})
+		}
+		drained = t.drained
+	}
+	t.mu.Unlock()
+
+	var err error
+	if drained != nil {
+		select {
+		case <-drained:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+	t.closeIdleConnections()
+	t.sessions.clear()
+	return err
+}
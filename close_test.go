@@ -0,0 +1,87 @@
+package httpcontrol_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"github.com/facebookgo/httpcontrol"
+)
+
+func TestClose(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(sleepHandler(0))
+	defer server.Close()
+	transport := &httpcontrol.Transport{}
+	client := &http.Client{Transport: transport}
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	transport.Close()
+	_, err = client.Get(server.URL)
+	ensure.True(t, errors.Is(err, httpcontrol.ErrClosed))
+}
+
+func TestCloseWaitForInFlight(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(sleepHandler(50 * time.Millisecond))
+	defer server.Close()
+	transport := &httpcontrol.Transport{}
+	client := &http.Client{Transport: transport}
+	var closing int32
+	started := make(chan struct{})
+	go func() {
+		req, err := http.NewRequest("GET", server.URL, nil)
+		ensure.Nil(t, err)
+		trace := &httptrace.ClientTrace{WroteRequest: func(httptrace.WroteRequestInfo) {
+			close(started)
+		}}
+		res, err := client.Do(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+		ensure.Nil(t, err)
+		time.Sleep(20 * time.Millisecond)
+		atomic.StoreInt32(&closing, 1)
+		assertResponse(res, t)
+	}()
+	<-started
+	ensure.Nil(t, transport.CloseWait(context.Background()))
+	if atomic.LoadInt32(&closing) == 0 {
+		t.Fatal("CloseWait returned before the request completed")
+	}
+	_, err := client.Get(server.URL)
+	ensure.True(t, errors.Is(err, httpcontrol.ErrClosed))
+}
+
+func TestCloseWaitTimeout(t *testing.T) {
+	t.Parallel()
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			<-release
+			w.Write(theAnswer)
+		}))
+	defer server.Close()
+	defer close(release)
+	transport := &httpcontrol.Transport{}
+	client := &http.Client{Transport: transport}
+	started := make(chan struct{})
+	go func() {
+		req, _ := http.NewRequest("GET", server.URL, nil)
+		trace := &httptrace.ClientTrace{WroteRequest: func(httptrace.WroteRequestInfo) {
+			close(started)
+		}}
+		res, err := client.Do(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+		if err == nil {
+			res.Body.Close()
+		}
+	}()
+	<-started
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	ensure.DeepEqual(t, transport.CloseWait(ctx), context.DeadlineExceeded)
+}
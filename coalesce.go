@@ -0,0 +1,107 @@
+package httpcontrol
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// flight is a coalesced request shared by the callers waiting for it.
+type flight struct {
+	done    chan struct{}
+	cancel  context.CancelFunc
+	waiters int
+	res     *http.Response
+	body    []byte
+	err     error
+}
+
+// coalescing reports whether req may share a request with others.
+func (t *Transport) coalescing(req *http.Request) bool {
+	return t.Coalesce && req.Method == "GET" &&
+		(req.Body == nil || req.Body == http.NoBody)
+}
+
+// coalesceKey returns the key identifying the requests that req may share a
+// request with. The credentials are part of it, as the shared request is sent
+// with those of the first caller.
+func (t *Transport) coalesceKey(req *http.Request) string {
+	key := req.Method + " " + req.URL.String() +
+		"\x00" + strings.Join(req.Header.Values("Authorization"), "\x00") +
+		"\x00" + strings.Join(req.Header.Values("Cookie"), "\x00")
+	if t.CoalesceKey != nil {
+		var extra string
+		t.callback(func() { extra = t.CoalesceKey(req) })
+		key += "\x00" + extra
+	}
+	return key
+}
+
+// coalesce makes req through the flight for its key, starting one if there is
+// none. The flight makes the request of the caller that started it on a
+// context that is only cancelled once all its callers are gone.
+func (t *Transport) coalesce(req *http.Request) (*http.Response, error) {
+	key := t.coalesceKey(req)
+	t.flightsMu.Lock()
+	f := t.flights[key]
+	if f == nil {
+		ctx, cancel := context.WithCancel(context.WithoutCancel(req.Context()))
+		f = &flight{done: make(chan struct{}), cancel: cancel}
+		if t.flights == nil {
+			t.flights = make(map[string]*flight)
+		}
+		t.flights[key] = f
+		go t.fly(key, f, req.WithContext(ctx))
+	}
+	f.waiters++
+	t.flightsMu.Unlock()
+
+	select {
+	case <-f.done:
+	case <-req.Context().Done():
+		t.flightsMu.Lock()
+		if f.waiters--; f.waiters == 0 {
+			f.cancel()
+			if t.flights[key] == f {
+				delete(t.flights, key)
+			}
+		}
+		t.flightsMu.Unlock()
+		return nil, req.Context().Err()
+	}
+	if f.err != nil {
+		return nil, f.err
+	}
+	res := *f.res
+	res.Header = f.res.Header.Clone()
+	res.Trailer = f.res.Trailer.Clone()
+	res.Body = ioutil.NopCloser(bytes.NewReader(f.body))
+	res.ContentLength = int64(len(f.body))
+	res.Request = req
+	if a, ok := AttemptsFromResponse(f.res); ok {
+		res.Request = withAttempts(req, a)
+	}
+	return &res, nil
+}
+
+// fly makes the request of the flight and buffers its response body, which is
+// bounded by the MaxResponseBodyBytes.
+func (t *Transport) fly(key string, f *flight, req *http.Request) {
+	defer f.cancel()
+	res, err := t.do(req)
+	if err == nil {
+		f.body, err = ioutil.ReadAll(res.Body)
+		if cerr := res.Body.Close(); err == nil {
+			err = cerr
+		}
+	}
+	f.res, f.err = res, err
+	t.flightsMu.Lock()
+	if t.flights[key] == f {
+		delete(t.flights, key)
+	}
+	t.flightsMu.Unlock()
+	close(f.done)
+}
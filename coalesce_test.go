@@ -0,0 +1,204 @@
+package httpcontrol_test
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"github.com/facebookgo/httpcontrol"
+)
+
+// blockingServer counts the requests it gets and answers them with body once
+// release is closed.
+func blockingServer(body string) (*httptest.Server, *int32, chan struct{}) {
+	var hits int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&hits, 1)
+			<-release
+			w.Write([]byte(body))
+		}))
+	return server, &hits, release
+}
+
+// coalescingTransport returns a Transport coalescing requests, and a group
+// done once they were all made, which allows waiting for them to be joined.
+func coalescingTransport(requests int) (*httpcontrol.Transport, *sync.WaitGroup) {
+	var keyed sync.WaitGroup
+	keyed.Add(requests)
+	transport := &httpcontrol.Transport{
+		Coalesce: true,
+		CoalesceKey: func(r *http.Request) string {
+			keyed.Done()
+			return r.Header.Get("X-Tenant")
+		},
+	}
+	return transport, &keyed
+}
+
+func TestCoalesce(t *testing.T) {
+	t.Parallel()
+	const requests = 10
+	server, hits, release := blockingServer("shared")
+	defer server.Close()
+	transport, keyed := coalescingTransport(requests)
+	client := &http.Client{Transport: transport}
+
+	var wg sync.WaitGroup
+	bodies := make([]string, requests)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			res, err := client.Get(server.URL)
+			ensure.Nil(t, err)
+			b, err := ioutil.ReadAll(res.Body)
+			ensure.Nil(t, err)
+			ensure.Nil(t, res.Body.Close())
+			bodies[i] = string(b)
+		}(i)
+	}
+	keyed.Wait()
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	ensure.DeepEqual(t, atomic.LoadInt32(hits), int32(1))
+	for _, b := range bodies {
+		ensure.DeepEqual(t, b, "shared")
+	}
+
+	// Once done, the next request goes out again.
+	transport.CoalesceKey = nil
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	res.Body.Close()
+	ensure.DeepEqual(t, atomic.LoadInt32(hits), int32(2))
+}
+
+func TestCoalesceKey(t *testing.T) {
+	t.Parallel()
+	server, hits, release := blockingServer("tenant")
+	defer server.Close()
+	transport, keyed := coalescingTransport(2)
+	client := &http.Client{Transport: transport}
+
+	var wg sync.WaitGroup
+	for _, tenant := range []string{"a", "b"} {
+		wg.Add(1)
+		go func(tenant string) {
+			defer wg.Done()
+			req, err := http.NewRequest("GET", server.URL, nil)
+			ensure.Nil(t, err)
+			req.Header.Set("X-Tenant", tenant)
+			res, err := client.Do(req)
+			ensure.Nil(t, err)
+			res.Body.Close()
+		}(tenant)
+	}
+	keyed.Wait()
+	close(release)
+	wg.Wait()
+	ensure.DeepEqual(t, atomic.LoadInt32(hits), int32(2))
+}
+
+func TestCoalesceSeparatesCredentials(t *testing.T) {
+	t.Parallel()
+	var hits int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&hits, 1)
+			<-release
+			w.Write([]byte(r.Header.Get("Authorization") + r.Header.Get("Cookie")))
+		}))
+	defer server.Close()
+	transport, keyed := coalescingTransport(4)
+	client := &http.Client{Transport: transport}
+
+	var wg sync.WaitGroup
+	headers := [][2]string{
+		{"Authorization", "Bearer a"},
+		{"Authorization", "Bearer b"},
+		{"Cookie", "session=c"},
+		{"Cookie", "session=c"},
+	}
+	for _, h := range headers {
+		wg.Add(1)
+		go func(name, value string) {
+			defer wg.Done()
+			req, err := http.NewRequest("GET", server.URL, nil)
+			ensure.Nil(t, err)
+			req.Header.Set(name, value)
+			res, err := client.Do(req)
+			ensure.Nil(t, err)
+			b, err := ioutil.ReadAll(res.Body)
+			ensure.Nil(t, err)
+			ensure.Nil(t, res.Body.Close())
+			ensure.DeepEqual(t, string(b), value)
+		}(h[0], h[1])
+	}
+	keyed.Wait()
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	// Only the callers with the same cookie share a request.
+	ensure.DeepEqual(t, atomic.LoadInt32(&hits), int32(3))
+}
+
+func TestCoalesceFirstCallerCancelled(t *testing.T) {
+	t.Parallel()
+	server, hits, release := blockingServer("shared")
+	defer server.Close()
+	transport, keyed := coalescingTransport(2)
+	client := &http.Client{Transport: transport}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, "GET", server.URL, nil)
+	ensure.Nil(t, err)
+	first := make(chan error)
+	go func() {
+		_, err := client.Do(req)
+		first <- err
+	}()
+	for atomic.LoadInt32(hits) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	second := make(chan string)
+	go func() {
+		res, err := client.Get(server.URL)
+		ensure.Nil(t, err)
+		b, err := ioutil.ReadAll(res.Body)
+		ensure.Nil(t, err)
+		res.Body.Close()
+		second <- string(b)
+	}()
+	keyed.Wait()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	ensure.True(t, errors.Is(<-first, context.Canceled))
+	close(release)
+	ensure.DeepEqual(t, <-second, "shared")
+	ensure.DeepEqual(t, atomic.LoadInt32(hits), int32(1))
+}
+
+func TestCoalesceBodyTooLarge(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(strings.Repeat("x", 100)))
+		}))
+	defer server.Close()
+	transport := &httpcontrol.Transport{Coalesce: true, MaxResponseBodyBytes: 10}
+	client := &http.Client{Transport: transport}
+	_, err := client.Get(server.URL)
+	ensure.True(t, errors.Is(err, httpcontrol.ErrBodyTooLarge), err)
+}
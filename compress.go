@@ -0,0 +1,70 @@
+package httpcontrol
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// DefaultCompressMinBytes is the CompressMinBytes used if it is zero.
+const DefaultCompressMinBytes = 1 << 10
+
+// compressBody gzips the request body for CompressRequestBody, once its
+// length is known to be large enough. The original body is read through the
+// compressor, so only the compressed one is held in memory.
+func (t *Transport) compressBody(rt *roundTrip) error {
+	req := rt.req
+	if !t.CompressRequestBody || req.Body == nil || req.Body == http.NoBody ||
+		req.Header.Get("Content-Encoding") != "" {
+		return nil
+	}
+	length := req.ContentLength
+	if rt.contentLength > 0 {
+		length = rt.contentLength
+	}
+	min := t.CompressMinBytes
+	if min <= 0 {
+		min = DefaultCompressMinBytes
+	}
+	if length < min || rt.unbuffered != nil {
+		return nil
+	}
+	body := req.Body
+	if rt.getBody != nil {
+		var err error
+		if body, err = rt.getBody(); err != nil {
+			return err
+		}
+	}
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := io.Copy(gz, body); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	req.Body.Close()
+	compressed := buf.Bytes()
+	rt.getBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(compressed)), nil
+	}
+	rt.contentLength = int64(len(compressed))
+	rt.compressed = true
+	return nil
+}
+
+// setContentEncoding declares the compressed body in the outgoing request.
+func (rt *roundTrip) setContentEncoding() {
+	out := rt.out
+	if out == rt.req {
+		out = rt.req.Clone(rt.req.Context())
+		if out.Header == nil {
+			out.Header = make(http.Header)
+		}
+	}
+	out.Header.Set("Content-Encoding", "gzip")
+	rt.out = out
+}
@@ -0,0 +1,166 @@
+package httpcontrol_test
+
+import (
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+	"github.com/facebookgo/httpcontrol"
+)
+
+// gzipUpload is a request body as received, decompressed if it was gzipped.
+type gzipUpload struct {
+	encoding string
+	length   int64
+	body     string
+}
+
+// gzipServer records the uploads it receives, and fails the first one with a
+// 503.
+func gzipServer(t *testing.T) (*httptest.Server, func() []gzipUpload) {
+	var mu sync.Mutex
+	var uploads []gzipUpload
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			u := gzipUpload{encoding: r.Header.Get("Content-Encoding"), length: r.ContentLength}
+			body := r.Body
+			if u.encoding == "gzip" {
+				gz, err := gzip.NewReader(body)
+				ensure.Nil(t, err)
+				body = gz
+			}
+			b, err := ioutil.ReadAll(body)
+			ensure.Nil(t, err)
+			u.body = string(b)
+			mu.Lock()
+			uploads = append(uploads, u)
+			first := len(uploads) == 1
+			mu.Unlock()
+			if first {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Write(theAnswer)
+		}))
+	return server, func() []gzipUpload {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]gzipUpload(nil), uploads...)
+	}
+}
+
+func TestCompressRequestBody(t *testing.T) {
+	t.Parallel()
+	server, uploads := gzipServer(t)
+	defer server.Close()
+	transport := &httpcontrol.Transport{
+		CompressRequestBody: true,
+		MaxTries:            1,
+		RetryStatuses:       []int{http.StatusServiceUnavailable},
+	}
+	defer transport.Close()
+	payload := `{"answer":` + strings.Repeat("42,", 1000) + `42}`
+	req, err := http.NewRequest("PUT", server.URL, strings.NewReader(payload))
+	ensure.Nil(t, err)
+	res, err := (&http.Client{Transport: transport}).Do(req)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	ensure.DeepEqual(t, req.Header.Get("Content-Encoding"), "")
+
+	// The compressed body was sent again for the retry.
+	got := uploads()
+	ensure.DeepEqual(t, len(got), 2)
+	for _, u := range got {
+		ensure.DeepEqual(t, u.encoding, "gzip")
+		ensure.True(t, u.length > 0 && u.length < int64(len(payload)))
+		ensure.DeepEqual(t, u.body, payload)
+	}
+}
+
+func TestCompressRequestBodySkipped(t *testing.T) {
+	t.Parallel()
+	server, uploads := gzipServer(t)
+	defer server.Close()
+	transport := &httpcontrol.Transport{
+		CompressRequestBody: true,
+		CompressMinBytes:    10,
+		MaxTries:            1,
+		RetryStatuses:       []int{http.StatusServiceUnavailable},
+	}
+	defer transport.Close()
+	client := &http.Client{Transport: transport}
+
+	// Below the threshold.
+	req, err := http.NewRequest("PUT", server.URL, strings.NewReader("hello"))
+	ensure.Nil(t, err)
+	res, err := client.Do(req)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+
+	// Already encoded by the caller.
+	req, err = http.NewRequest("PUT", server.URL, strings.NewReader("hello, world"))
+	ensure.Nil(t, err)
+	req.Header.Set("Content-Encoding", "identity")
+	res, err = client.Do(req)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+
+	ensure.DeepEqual(t, uploads(), []gzipUpload{
+		{length: 5, body: "hello"},
+		{length: 5, body: "hello"},
+		{encoding: "identity", length: 12, body: "hello, world"},
+	})
+}
+
+func TestCompressRequestBodySignRequest(t *testing.T) {
+	t.Parallel()
+	hash := func(b []byte) string {
+		sum := sha256.Sum256(b)
+		return hex.EncodeToString(sum[:])
+	}
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			b, err := ioutil.ReadAll(r.Body)
+			ensure.Nil(t, err)
+			ensure.DeepEqual(t, r.Header.Get("Content-Encoding"), "gzip")
+			ensure.DeepEqual(t, r.ContentLength, int64(len(b)))
+			if r.Header.Get("X-Body-Hash") != hash(b) {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			w.Write(theAnswer)
+		}))
+	defer server.Close()
+	transport := &httpcontrol.Transport{
+		CompressRequestBody: true,
+		SignRequest: func(req *http.Request) error {
+			body, err := req.GetBody()
+			if err != nil {
+				return err
+			}
+			b, err := ioutil.ReadAll(body)
+			if err != nil {
+				return err
+			}
+			ensure.DeepEqual(t, req.ContentLength, int64(len(b)))
+			req.Header.Set("X-Body-Hash", hash(b))
+			return nil
+		},
+	}
+	defer transport.Close()
+	payload := strings.Repeat("42,", 1000)
+	req, err := http.NewRequest("PUT", server.URL, strings.NewReader(payload))
+	ensure.Nil(t, err)
+	res, err := (&http.Client{Transport: transport}).Do(req)
+	ensure.Nil(t, err)
+
+	// The signature covers the compressed bytes the server received.
+	assertResponse(res, t)
+}
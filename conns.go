@@ -0,0 +1,90 @@
+package httpcontrol
+
+import (
+	"context"
+	"slices"
+	"sort"
+	"time"
+)
+
+// hostConns tracks the connection slots in use for a host, and the attempts
+// waiting for one by priority, then in arrival order.
+type hostConns struct {
+	inUse   int
+	waiters []*connWaiter
+}
+
+// connWaiter is an attempt waiting for a connection slot.
+type connWaiter struct {
+	ready    chan struct{}
+	priority int
+}
+
+// wait queues w behind the waiters of the same or a higher priority.
+func (hc *hostConns) wait(w *connWaiter) {
+	i := sort.Search(len(hc.waiters), func(i int) bool {
+		return hc.waiters[i].priority < w.priority
+	})
+	hc.waiters = slices.Insert(hc.waiters, i, w)
+}
+
+// acquireConn waits for a connection slot for host when MaxConnsPerHost is
+// set. It returns the time spent waiting and a function to release the slot.
+func (t *Transport) acquireConn(ctx context.Context, host string) (time.Duration, func(), error) {
+	if t.MaxConnsPerHost <= 0 {
+		return 0, nil, nil
+	}
+	release := func() { t.releaseConn(host) }
+	t.connsMu.Lock()
+	if t.conns == nil {
+		t.conns = make(map[string]*hostConns)
+	}
+	hc := t.conns[host]
+	if hc == nil {
+		hc = &hostConns{}
+		t.conns[host] = hc
+	}
+	if hc.inUse < t.MaxConnsPerHost {
+		hc.inUse++
+		t.connsMu.Unlock()
+		return 0, release, nil
+	}
+	waiter := &connWaiter{ready: make(chan struct{}), priority: priority(ctx)}
+	hc.wait(waiter)
+	t.connsMu.Unlock()
+
+	start := time.Now()
+	select {
+	case <-waiter.ready:
+		return time.Since(start), release, nil
+	case <-ctx.Done():
+		t.connsMu.Lock()
+		for i, w := range hc.waiters {
+			if w == waiter {
+				hc.waiters = append(hc.waiters[:i], hc.waiters[i+1:]...)
+				t.connsMu.Unlock()
+				return time.Since(start), nil, context.Cause(ctx)
+			}
+		}
+		t.connsMu.Unlock()
+		// The slot was handed to us concurrently, pass it on.
+		t.releaseConn(host)
+		return time.Since(start), nil, context.Cause(ctx)
+	}
+}
+
+// releaseConn hands the slot for host to the next waiter, if any.
+func (t *Transport) releaseConn(host string) {
+	t.connsMu.Lock()
+	defer t.connsMu.Unlock()
+	hc := t.conns[host]
+	if len(hc.waiters) > 0 {
+		close(hc.waiters[0].ready)
+		hc.waiters = hc.waiters[1:]
+		return
+	}
+	hc.inUse--
+	if hc.inUse == 0 {
+		delete(t.conns, host)
+	}
+}
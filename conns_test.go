@@ -0,0 +1,89 @@
+package httpcontrol
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+)
+
+func TestAcquireConnUnlimited(t *testing.T) {
+	var tr Transport
+	wait, release, err := tr.acquireConn(context.Background(), "a")
+	ensure.Nil(t, err)
+	ensure.True(t, release == nil)
+	ensure.DeepEqual(t, wait, time.Duration(0))
+}
+
+func TestAcquireConnCanceled(t *testing.T) {
+	tr := Transport{MaxConnsPerHost: 1}
+	_, release, err := tr.acquireConn(context.Background(), "a")
+	ensure.Nil(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	wait, _, err := tr.acquireConn(ctx, "a")
+	ensure.DeepEqual(t, err, context.DeadlineExceeded)
+	ensure.True(t, wait >= 10*time.Millisecond)
+	ensure.DeepEqual(t, len(tr.conns["a"].waiters), 0)
+
+	release()
+	ensure.DeepEqual(t, len(tr.conns), 0)
+}
+
+func TestAcquireConnHandsOff(t *testing.T) {
+	tr := Transport{MaxConnsPerHost: 1}
+	_, release, err := tr.acquireConn(context.Background(), "a")
+	ensure.Nil(t, err)
+	acquired := make(chan func())
+	go func() {
+		_, release, err := tr.acquireConn(context.Background(), "a")
+		ensure.Nil(t, err)
+		acquired <- release
+	}()
+	select {
+	case <-acquired:
+		t.Fatal("acquired a slot while at the limit")
+	case <-time.After(10 * time.Millisecond):
+	}
+	release()
+	(<-acquired)()
+	ensure.DeepEqual(t, len(tr.conns), 0)
+}
+
+func TestAcquireConnPriority(t *testing.T) {
+	tr := Transport{MaxConnsPerHost: 1}
+	_, release, err := tr.acquireConn(context.Background(), "a")
+	ensure.Nil(t, err)
+
+	priorities := []int{0, 0, 5, -1, 5}
+	var order []int
+	var wg sync.WaitGroup
+	for i, p := range priorities {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, release, err := tr.acquireConn(WithPriority(context.Background(), p), "a")
+			ensure.Nil(t, err)
+			// Holding the slot, so the next one waits.
+			order = append(order, i)
+			release()
+		}()
+		// Wait for it to queue, so the arrival order is known.
+		for {
+			tr.connsMu.Lock()
+			queued := len(tr.conns["a"].waiters)
+			tr.connsMu.Unlock()
+			if queued == i+1 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+	release()
+	wg.Wait()
+	ensure.DeepEqual(t, order, []int{2, 4, 0, 1, 3})
+	ensure.DeepEqual(t, len(tr.conns), 0)
+}
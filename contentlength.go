@@ -0,0 +1,59 @@
+package httpcontrol
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// DefaultMaxBufferedRequestBody is the MaxBufferedRequestBody used if it is
+// zero.
+const DefaultMaxBufferedRequestBody = 1 << 20
+
+// forceContentLength finds the length of a request body of unknown length for
+// ForceContentLength. Seekable bodies are measured, others are buffered up to
+// the MaxBufferedRequestBody. The bodies found to be longer are sent chunked,
+// starting with the part already read.
+func (t *Transport) forceContentLength(rt *roundTrip) error {
+	req := rt.req
+	if !t.ForceContentLength || req.Body == nil || req.Body == http.NoBody || req.ContentLength > 0 {
+		return nil
+	}
+	if seeker, ok := req.Body.(io.Seeker); ok && req.GetBody == nil {
+		offset, err := seeker.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		end, err := seeker.Seek(0, io.SeekEnd)
+		if err != nil {
+			return err
+		}
+		if _, err := seeker.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		rt.contentLength = end - offset
+		return nil
+	}
+	max := t.MaxBufferedRequestBody
+	if max <= 0 {
+		max = DefaultMaxBufferedRequestBody
+	}
+	buf, err := ioutil.ReadAll(io.LimitReader(req.Body, max+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(buf)) > max {
+		rt.unbuffered = &prefixBody{
+			Reader: io.MultiReader(bytes.NewReader(buf), req.Body),
+			Closer: req.Body,
+		}
+		return nil
+	}
+	req.Body.Close()
+	rt.getBody = func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(buf)), nil
+	}
+	rt.contentLength = int64(len(buf))
+	return nil
+}
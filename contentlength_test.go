@@ -0,0 +1,161 @@
+package httpcontrol_test
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+	"github.com/facebookgo/httpcontrol"
+)
+
+// uploadHandler records the uploads it receives, and responds with a 502 to
+// the first fail of them.
+type uploadHandler struct {
+	fail    int32
+	calls   int32
+	mu      sync.Mutex
+	uploads []upload
+}
+
+type upload struct {
+	contentLength    int64
+	transferEncoding []string
+	body             string
+}
+
+func (h *uploadHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	h.mu.Lock()
+	h.uploads = append(h.uploads, upload{r.ContentLength, r.TransferEncoding, string(body)})
+	h.mu.Unlock()
+	if atomic.AddInt32(&h.calls, 1) <= h.fail {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	w.Write([]byte(theAnswer))
+}
+
+// streamingBody hides the type of the reader, so its length is unknown.
+func streamingBody(s string) io.ReadCloser {
+	return ioutil.NopCloser(io.MultiReader(strings.NewReader(s)))
+}
+
+func TestForceContentLength(t *testing.T) {
+	t.Parallel()
+	handler := &uploadHandler{fail: 1}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	transport := &httpcontrol.Transport{
+		ForceContentLength:     true,
+		MaxBufferedRequestBody: 5,
+		MaxTries:               1,
+		RetryStatuses:          []int{http.StatusBadGateway},
+	}
+	defer transport.Close()
+	req, err := http.NewRequest("PUT", server.URL, streamingBody("hello"))
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, req.ContentLength, int64(0))
+	res, err := (&http.Client{Transport: transport}).Do(req)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	ensure.DeepEqual(t, res.StatusCode, http.StatusOK)
+
+	// Buffered, the body was replayed for the retry.
+	want := upload{contentLength: 5, body: "hello"}
+	ensure.DeepEqual(t, handler.uploads, []upload{want, want})
+}
+
+func TestForceContentLengthOverCap(t *testing.T) {
+	t.Parallel()
+	handler := &uploadHandler{}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	transport := &httpcontrol.Transport{
+		ForceContentLength:     true,
+		MaxBufferedRequestBody: 4,
+	}
+	defer transport.Close()
+	req, err := http.NewRequest("PUT", server.URL, streamingBody("hello"))
+	ensure.Nil(t, err)
+	res, err := (&http.Client{Transport: transport}).Do(req)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	ensure.DeepEqual(t, handler.uploads, []upload{
+		{contentLength: -1, transferEncoding: []string{"chunked"}, body: "hello"},
+	})
+}
+
+func TestForceContentLengthSeekable(t *testing.T) {
+	t.Parallel()
+	handler := &uploadHandler{}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	transport := &httpcontrol.Transport{
+		ForceContentLength:     true,
+		MaxBufferedRequestBody: 1,
+	}
+	defer transport.Close()
+	r := strings.NewReader("xhello")
+	r.Seek(1, io.SeekStart)
+	req, err := http.NewRequest("PUT", server.URL, &seekableBody{Reader: r})
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, req.ContentLength, int64(0))
+	res, err := (&http.Client{Transport: transport}).Do(req)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	ensure.DeepEqual(t, handler.uploads, []upload{{contentLength: 5, body: "hello"}})
+}
+
+func TestChunkedWithoutForceContentLength(t *testing.T) {
+	t.Parallel()
+	handler := &uploadHandler{}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	transport := &httpcontrol.Transport{}
+	defer transport.Close()
+	req, err := http.NewRequest("PUT", server.URL, streamingBody("hello"))
+	ensure.Nil(t, err)
+	res, err := (&http.Client{Transport: transport}).Do(req)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	ensure.DeepEqual(t, handler.uploads, []upload{
+		{contentLength: -1, transferEncoding: []string{"chunked"}, body: "hello"},
+	})
+}
+
+func TestForceContentLengthSignRequest(t *testing.T) {
+	t.Parallel()
+	handler := &uploadHandler{}
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	var signed []string
+	transport := &httpcontrol.Transport{
+		ForceContentLength: true,
+		SignRequest: func(req *http.Request) error {
+			ensure.DeepEqual(t, req.ContentLength, int64(5))
+			body, err := req.GetBody()
+			if err != nil {
+				return err
+			}
+			b, err := ioutil.ReadAll(body)
+			signed = append(signed, string(b))
+			return err
+		},
+	}
+	defer transport.Close()
+	req, err := http.NewRequest("PUT", server.URL, streamingBody("hello"))
+	ensure.Nil(t, err)
+	res, err := (&http.Client{Transport: transport}).Do(req)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+
+	// The SignRequest saw the bytes that were sent.
+	ensure.DeepEqual(t, signed, []string{"hello"})
+	ensure.DeepEqual(t, handler.uploads, []upload{{contentLength: 5, body: "hello"}})
+}
@@ -0,0 +1,135 @@
+package httpcontrol
+
+import (
+	"context"
+	"time"
+)
+
+type contextKey int
+
+const (
+	requestTimeoutKey contextKey = iota
+	tunnelKey
+	noRetryKey
+	statsTagsKey
+	serverNameKey
+	maxTriesKey
+	uploadProgressKey
+	attemptsKey
+	dialWaitKey
+	priorityKey
+)
+
+// WithRequestTimeout returns a copy of ctx that overrides the RequestTimeout of
+// the Transport for requests made with it. A zero duration disables the
+// timeout for those requests.
+func WithRequestTimeout(ctx context.Context, d time.Duration) context.Context {
+	return context.WithValue(ctx, requestTimeoutKey, d)
+}
+
+// requestTimeout returns the RequestTimeout to use for requests made with ctx.
+func (t *Transport) requestTimeout(ctx context.Context) time.Duration {
+	if d, ok := ctx.Value(requestTimeoutKey).(time.Duration); ok {
+		return d
+	}
+	return t.RequestTimeout
+}
+
+// WithMaxTries returns a copy of ctx that overrides the MaxTries of the
+// Transport for requests made with it. Zero or negative values mean a single
+// attempt. Retries are still subject to the retry budget and backoff.
+func WithMaxTries(ctx context.Context, n int) context.Context {
+	if n < 0 {
+		n = 0
+	}
+	return context.WithValue(ctx, maxTriesKey, uint(n))
+}
+
+// maxTries returns the MaxTries to use for requests made with ctx.
+func (t *Transport) maxTries(ctx context.Context) uint {
+	if n, ok := ctx.Value(maxTriesKey).(uint); ok {
+		return n
+	}
+	return t.MaxTries
+}
+
+// WithNoRetry returns a copy of ctx that makes requests made with it use a
+// single attempt, regardless of MaxTries or ShouldRetry. They are not hedged
+// either.
+func WithNoRetry(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noRetryKey, true)
+}
+
+// noRetry reports whether requests made with ctx must not be retried.
+func noRetry(ctx context.Context) bool {
+	v, _ := ctx.Value(noRetryKey).(bool)
+	return v
+}
+
+// WithUploadProgress returns a copy of ctx that makes requests made with it
+// call progress as their body is sent, with the bytes sent so far and the
+// Content-Length, or -1 if unknown. When the body is replayed for a retry the
+// progress starts over from zero.
+func WithUploadProgress(ctx context.Context, progress func(sent, total int64)) context.Context {
+	return context.WithValue(ctx, uploadProgressKey, progress)
+}
+
+// uploadProgress returns the progress function for requests made with ctx.
+func uploadProgress(ctx context.Context) func(sent, total int64) {
+	progress, _ := ctx.Value(uploadProgressKey).(func(sent, total int64))
+	return progress
+}
+
+// WithPriority returns a copy of ctx giving the requests made with it the
+// priority n when they wait for a connection slot under MaxConnsPerHost.
+// Slots go to the waiting attempts of the highest priority first, in the
+// order they arrived. The default priority is zero, and may be negative.
+func WithPriority(ctx context.Context, n int) context.Context {
+	return context.WithValue(ctx, priorityKey, n)
+}
+
+// priority returns the priority of requests made with ctx.
+func priority(ctx context.Context) int {
+	n, _ := ctx.Value(priorityKey).(int)
+	return n
+}
+
+// WithServerName returns a copy of ctx that makes HTTPS requests made with it
+// use name as the TLS server name, like the ServerNameOverride, which it takes
+// precedence over.
+func WithServerName(ctx context.Context, name string) context.Context {
+	return context.WithValue(ctx, serverNameKey, name)
+}
+
+// WithStatsTags returns a copy of ctx that attaches tags to the Stats of
+// requests made with it, for example to attribute them to a tenant. Tags
+// already attached to ctx are kept unless overridden. The map is copied, so it
+// may be reused by the caller.
+func WithStatsTags(ctx context.Context, tags map[string]string) context.Context {
+	merged := copyTags(statsTags(ctx))
+	if merged == nil {
+		merged = make(map[string]string, len(tags))
+	}
+	for k, v := range tags {
+		merged[k] = v
+	}
+	return context.WithValue(ctx, statsTagsKey, merged)
+}
+
+// statsTags returns the tags attached to ctx, which must not be modified.
+func statsTags(ctx context.Context) map[string]string {
+	tags, _ := ctx.Value(statsTagsKey).(map[string]string)
+	return tags
+}
+
+// copyTags returns a copy of tags, nil if there are none.
+func copyTags(tags map[string]string) map[string]string {
+	if len(tags) == 0 {
+		return nil
+	}
+	c := make(map[string]string, len(tags))
+	for k, v := range tags {
+		c[k] = v
+	}
+	return c
+}
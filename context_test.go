@@ -0,0 +1,230 @@
+package httpcontrol_test
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"github.com/facebookgo/freeport"
+	"github.com/facebookgo/httpcontrol"
+)
+
+func TestWithRequestTimeout(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(sleepHandler(100 * time.Millisecond))
+	defer server.Close()
+	transport := &httpcontrol.Transport{RequestTimeout: 10 * time.Millisecond}
+	client := &http.Client{Transport: transport}
+
+	_, err := client.Get(server.URL)
+	ensure.NotNil(t, err)
+
+	for _, d := range []time.Duration{time.Minute, 0} {
+		ctx := httpcontrol.WithRequestTimeout(context.Background(), d)
+		req, err := http.NewRequestWithContext(ctx, "GET", server.URL, nil)
+		ensure.Nil(t, err)
+		res, err := client.Do(req)
+		ensure.Nil(t, err, d)
+		assertResponse(res, t)
+	}
+}
+
+func TestWithNoRetry(t *testing.T) {
+	t.Parallel()
+	port, err := freeport.Get()
+	ensure.Nil(t, err)
+	var tries int
+	transport := &httpcontrol.Transport{
+		MaxTries: 3,
+		Stats:    func(*httpcontrol.Stats) { tries++ },
+	}
+	client := &http.Client{Transport: transport}
+	url := fmt.Sprintf("http://127.0.0.1:%d/", port)
+
+	_, err = client.Get(url)
+	ensure.NotNil(t, err)
+	ensure.DeepEqual(t, tries, 4)
+
+	tries = 0
+	req, err := http.NewRequestWithContext(httpcontrol.WithNoRetry(context.Background()), "GET", url, nil)
+	ensure.Nil(t, err)
+	_, err = client.Do(req)
+	ensure.NotNil(t, err)
+	ensure.DeepEqual(t, tries, 1)
+}
+
+func TestWithMaxTries(t *testing.T) {
+	t.Parallel()
+	port, err := freeport.Get()
+	ensure.Nil(t, err)
+	var tries int
+	transport := &httpcontrol.Transport{
+		MaxTries: 2,
+		Stats:    func(*httpcontrol.Stats) { tries++ },
+	}
+	client := &http.Client{Transport: transport}
+	url := fmt.Sprintf("http://127.0.0.1:%d/", port)
+
+	cases := []struct {
+		n     int
+		tries int
+	}{
+		{n: 4, tries: 5},
+		{n: 1, tries: 2},
+		{n: 0, tries: 1},
+		{n: -1, tries: 1},
+	}
+	for _, c := range cases {
+		tries = 0
+		ctx := httpcontrol.WithMaxTries(context.Background(), c.n)
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		ensure.Nil(t, err)
+		_, err = client.Do(req)
+		ensure.NotNil(t, err)
+		ensure.DeepEqual(t, tries, c.tries, c.n)
+	}
+}
+
+func TestWithMaxTriesRetryBudget(t *testing.T) {
+	t.Parallel()
+	port, err := freeport.Get()
+	ensure.Nil(t, err)
+	var tries int
+	transport := &httpcontrol.Transport{
+		RetryBudgetRatio: 0.5,
+		Stats:            func(*httpcontrol.Stats) { tries++ },
+	}
+	client := &http.Client{Transport: transport}
+	url := fmt.Sprintf("http://127.0.0.1:%d/", port)
+
+	// The budget starts with 10 retries banked, which caps the 20 allowed.
+	ctx := httpcontrol.WithMaxTries(context.Background(), 20)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	ensure.Nil(t, err)
+	_, err = client.Do(req)
+	ensure.NotNil(t, err)
+	ensure.DeepEqual(t, tries, 11)
+}
+
+func TestWithUploadProgress(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) { io.Copy(io.Discard, r.Body) }))
+	defer server.Close()
+	var mu sync.Mutex
+	var sent, totals []int64
+	ctx := httpcontrol.WithUploadProgress(context.Background(), func(s, total int64) {
+		mu.Lock()
+		sent = append(sent, s)
+		totals = append(totals, total)
+		mu.Unlock()
+	})
+	client := &http.Client{Transport: &httpcontrol.Transport{}}
+	body := strings.Repeat("x", 100000)
+
+	req, err := http.NewRequestWithContext(ctx, "PUT", server.URL, strings.NewReader(body))
+	ensure.Nil(t, err)
+	res, err := client.Do(req)
+	ensure.Nil(t, err)
+	res.Body.Close()
+	mu.Lock()
+	ensure.True(t, len(sent) > 1, sent)
+	ensure.DeepEqual(t, sent[len(sent)-1], int64(len(body)))
+	ensure.DeepEqual(t, totals[0], int64(len(body)))
+	for i := 1; i < len(sent); i++ {
+		ensure.True(t, sent[i] > sent[i-1], sent)
+	}
+	sent, totals = nil, nil
+	mu.Unlock()
+
+	// Without a Content-Length the total is unknown.
+	req, err = http.NewRequestWithContext(ctx, "PUT", server.URL, io.MultiReader(strings.NewReader(body)))
+	ensure.Nil(t, err)
+	res, err = client.Do(req)
+	ensure.Nil(t, err)
+	res.Body.Close()
+	mu.Lock()
+	defer mu.Unlock()
+	ensure.DeepEqual(t, sent[len(sent)-1], int64(len(body)))
+	ensure.DeepEqual(t, totals[0], int64(-1))
+}
+
+func TestWithUploadProgressRetry(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(statusThenAnswerHandler(http.StatusServiceUnavailable, 1))
+	defer server.Close()
+	var mu sync.Mutex
+	var sent []int64
+	ctx := httpcontrol.WithUploadProgress(context.Background(), func(s, total int64) {
+		ensure.DeepEqual(t, total, int64(5))
+		mu.Lock()
+		sent = append(sent, s)
+		mu.Unlock()
+	})
+	transport := &httpcontrol.Transport{
+		MaxTries:      1,
+		RetryStatuses: []int{http.StatusServiceUnavailable},
+	}
+	client := &http.Client{Transport: transport}
+	req, err := http.NewRequestWithContext(ctx, "PUT", server.URL, strings.NewReader("hello"))
+	ensure.Nil(t, err)
+	res, err := client.Do(req)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	mu.Lock()
+	defer mu.Unlock()
+	ensure.DeepEqual(t, sent, []int64{5, 0, 5})
+}
+
+func TestWithStatsTags(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(statusThenAnswerHandler(http.StatusServiceUnavailable, 1))
+	defer server.Close()
+	var tags []map[string]string
+	transport := &httpcontrol.Transport{
+		MaxTries:      1,
+		RetryStatuses: []int{http.StatusServiceUnavailable},
+		Stats: func(stats *httpcontrol.Stats) {
+			_, shared := stats.Tags["mutated"]
+			ensure.False(t, shared)
+			tags = append(tags, stats.Tags)
+			stats.Tags["mutated"] = "yes"
+		},
+	}
+	client := &http.Client{Transport: transport}
+	given := map[string]string{"tenant": "a", "route": "x"}
+	ctx := httpcontrol.WithStatsTags(context.Background(), given)
+	ctx = httpcontrol.WithStatsTags(ctx, map[string]string{"route": "y"})
+	given["tenant"] = "b"
+	req, err := http.NewRequestWithContext(ctx, "GET", server.URL, nil)
+	ensure.Nil(t, err)
+	res, err := client.Do(req)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+
+	expected := map[string]string{"tenant": "a", "route": "y", "mutated": "yes"}
+	ensure.DeepEqual(t, tags, []map[string]string{expected, expected})
+	ensure.DeepEqual(t, given, map[string]string{"tenant": "b", "route": "x"})
+}
+
+func TestStatsTagsUnset(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(sleepHandler(0))
+	defer server.Close()
+	var stats *httpcontrol.Stats
+	transport := &httpcontrol.Transport{
+		Stats: func(s *httpcontrol.Stats) { stats = s },
+	}
+	client := &http.Client{Transport: transport}
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	ensure.True(t, stats.Tags == nil)
+}
@@ -0,0 +1,147 @@
+package httpcontrol
+
+import (
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// acceptEncoding is requested when the Transport decompresses responses
+// itself.
+const acceptEncoding = "gzip, deflate"
+
+// A Decoder returns a reader decoding a response body encoded by r. The
+// reader is closed along with the response body.
+type Decoder func(r io.Reader) (io.ReadCloser, error)
+
+var (
+	decodersMu sync.RWMutex
+	decoders   = make(map[string]Decoder)
+)
+
+// RegisterEncoding makes the content encoding name, such as "br", available
+// to Transport.ExtraEncodings. It is meant to be called from the init function
+// of the package providing the decoder, like httpcontrol/encodings, so the
+// core package does not depend on it. It panics if name is registered twice.
+func RegisterEncoding(name string, decoder Decoder) {
+	name = strings.ToLower(name)
+	decodersMu.Lock()
+	defer decodersMu.Unlock()
+	if _, dup := decoders[name]; dup || name == "gzip" || name == "deflate" {
+		panic("httpcontrol: RegisterEncoding called twice for " + name)
+	}
+	decoders[name] = decoder
+}
+
+// decoder returns the Decoder registered for the encoding.
+func decoder(encoding string) (Decoder, bool) {
+	decodersMu.RLock()
+	defer decodersMu.RUnlock()
+	d, ok := decoders[encoding]
+	return d, ok
+}
+
+// checkEncodings checks that the ExtraEncodings are registered.
+func (t *Transport) checkEncodings() error {
+	for _, name := range t.ExtraEncodings {
+		if _, ok := decoder(strings.ToLower(name)); !ok {
+			return fmt.Errorf("httpcontrol: ExtraEncodings %q is not registered, "+
+				"import the package providing it such as httpcontrol/encodings", name)
+		}
+	}
+	return nil
+}
+
+// manualDecompression reports whether the Transport decompresses responses
+// itself rather than leaving it to the standard transport.
+func (t *Transport) manualDecompression() bool {
+	return t.ManualDecompression || len(t.ExtraEncodings) != 0
+}
+
+// acceptEncoding returns the Accept-Encoding to request when the Transport
+// decompresses responses itself.
+func (t *Transport) acceptEncoding() string {
+	if len(t.ExtraEncodings) == 0 {
+		return acceptEncoding
+	}
+	return acceptEncoding + ", " + strings.ToLower(strings.Join(t.ExtraEncodings, ", "))
+}
+
+// decompressing reports whether the Transport should request compression for
+// req and decompress the response itself. As with the standard transport this
+// is only done when the caller has not asked for an encoding.
+func (t *Transport) decompressing(req *http.Request) bool {
+	return t.manualDecompression() && !t.DisableCompression &&
+		req.Header.Get("Accept-Encoding") == "" &&
+		req.Header.Get("Range") == "" &&
+		req.Method != "HEAD"
+}
+
+// decompress replaces the body of a compressed res with one decoding it, and
+// removes the headers describing the encoded body. It returns the encoding
+// decoded, or an empty string if res is not compressed with one requested.
+func (t *Transport) decompress(res *http.Response) string {
+	encoding := strings.ToLower(res.Header.Get("Content-Encoding"))
+	var decode Decoder
+	switch {
+	case encoding == "gzip" || encoding == "deflate":
+	case t.extraEncoding(encoding):
+		decode, _ = decoder(encoding)
+	default:
+		return ""
+	}
+	res.Body = &decodedBody{ReadCloser: res.Body, encoding: encoding, decode: decode}
+	res.Header.Del("Content-Encoding")
+	res.Header.Del("Content-Length")
+	res.ContentLength = -1
+	res.Uncompressed = true
+	return encoding
+}
+
+// extraEncoding reports whether encoding is one of the ExtraEncodings.
+func (t *Transport) extraEncoding(encoding string) bool {
+	for _, name := range t.ExtraEncodings {
+		if strings.EqualFold(name, encoding) {
+			return true
+		}
+	}
+	return false
+}
+
+// decodedBody decodes a compressed body. The decoder is created on the first
+// read, since it reads the compression header.
+type decodedBody struct {
+	io.ReadCloser
+	encoding string
+	decode   Decoder // for the ExtraEncodings
+	decoder  io.Reader
+	err      error
+}
+
+func (d *decodedBody) Read(p []byte) (int, error) {
+	if d.decoder == nil && d.err == nil {
+		switch {
+		case d.decode != nil:
+			d.decoder, d.err = d.decode(d.ReadCloser)
+		case d.encoding == "gzip":
+			d.decoder, d.err = gzip.NewReader(d.ReadCloser)
+		default:
+			d.decoder, d.err = zlib.NewReader(d.ReadCloser)
+		}
+	}
+	if d.err != nil {
+		return 0, d.err
+	}
+	return d.decoder.Read(p)
+}
+
+func (d *decodedBody) Close() error {
+	if closer, ok := d.decoder.(io.Closer); ok && d.decode != nil {
+		closer.Close()
+	}
+	return d.ReadCloser.Close()
+}
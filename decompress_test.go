@@ -0,0 +1,165 @@
+package httpcontrol_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+	"github.com/facebookgo/httpcontrol"
+)
+
+func gzipHandler(body []byte) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Accept-Encoding") == "" {
+				w.Write(body)
+				return
+			}
+			w.Header().Set("Content-Encoding", "gzip")
+			gz := gzip.NewWriter(w)
+			gz.Write(body)
+			gz.Close()
+		})
+}
+
+func TestManualDecompression(t *testing.T) {
+	t.Parallel()
+	body := bytes.Repeat([]byte("42"), 1000)
+	server := httptest.NewServer(gzipHandler(body))
+	defer server.Close()
+	var stats *httpcontrol.Stats
+	transport := &httpcontrol.Transport{
+		ManualDecompression: true,
+		Stats:               func(s *httpcontrol.Stats) { stats = s },
+	}
+	client := &http.Client{Transport: transport}
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	ensure.True(t, res.Uncompressed)
+	ensure.DeepEqual(t, res.Header.Get("Content-Encoding"), "")
+	b, err := ioutil.ReadAll(res.Body)
+	ensure.Nil(t, err)
+	ensure.Nil(t, res.Body.Close())
+	ensure.DeepEqual(t, b, body)
+	ensure.DeepEqual(t, stats.UncompressedBytes, int64(len(body)))
+	ensure.DeepEqual(t, stats.ContentEncoding, "gzip")
+	if stats.BytesReceived <= 0 || stats.BytesReceived >= int64(len(body)) {
+		t.Fatalf("unexpected compressed size %d", stats.BytesReceived)
+	}
+}
+
+func TestManualDecompressionCallerEncoding(t *testing.T) {
+	t.Parallel()
+	body := bytes.Repeat([]byte("42"), 1000)
+	server := httptest.NewServer(gzipHandler(body))
+	defer server.Close()
+	transport := &httpcontrol.Transport{ManualDecompression: true}
+	client := &http.Client{Transport: transport}
+	req, err := http.NewRequest("GET", server.URL, nil)
+	ensure.Nil(t, err)
+	req.Header.Set("Accept-Encoding", "gzip")
+	res, err := client.Do(req)
+	ensure.Nil(t, err)
+	defer res.Body.Close()
+	ensure.False(t, res.Uncompressed)
+	ensure.DeepEqual(t, res.Header.Get("Content-Encoding"), "gzip")
+}
+
+func TestUncompressedBytesDefault(t *testing.T) {
+	t.Parallel()
+	body := bytes.Repeat([]byte("42"), 1000)
+	server := httptest.NewServer(gzipHandler(body))
+	defer server.Close()
+	var stats *httpcontrol.Stats
+	transport := &httpcontrol.Transport{
+		Stats: func(s *httpcontrol.Stats) { stats = s },
+	}
+	client := &http.Client{Transport: transport}
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	ensure.True(t, res.Uncompressed)
+	_, err = ioutil.ReadAll(res.Body)
+	ensure.Nil(t, err)
+	ensure.Nil(t, res.Body.Close())
+	ensure.DeepEqual(t, stats.UncompressedBytes, int64(len(body)))
+	ensure.DeepEqual(t, stats.BytesReceived, int64(len(body)))
+}
+
+func init() {
+	// An encoding reversing the body, standing in for a real one.
+	httpcontrol.RegisterEncoding("x-reverse", func(r io.Reader) (io.ReadCloser, error) {
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(bytes.NewReader(reverse(b))), nil
+	})
+}
+
+func reverse(b []byte) []byte {
+	r := make([]byte, len(b))
+	for i, c := range b {
+		r[len(b)-1-i] = c
+	}
+	return r
+}
+
+func TestExtraEncodings(t *testing.T) {
+	t.Parallel()
+	var accept string
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			accept = r.Header.Get("Accept-Encoding")
+			w.Header().Set("Content-Encoding", "x-reverse")
+			w.Write(reverse([]byte("the answer is 42")))
+		}))
+	defer server.Close()
+	var stats *httpcontrol.Stats
+	transport := &httpcontrol.Transport{
+		ExtraEncodings: []string{"x-reverse"},
+		Stats:          func(s *httpcontrol.Stats) { stats = s },
+	}
+	client := &http.Client{Transport: transport}
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	ensure.True(t, res.Uncompressed)
+	ensure.DeepEqual(t, res.Header.Get("Content-Encoding"), "")
+	b, err := ioutil.ReadAll(res.Body)
+	ensure.Nil(t, err)
+	ensure.Nil(t, res.Body.Close())
+	ensure.DeepEqual(t, string(b), "the answer is 42")
+	ensure.DeepEqual(t, accept, "gzip, deflate, x-reverse")
+	ensure.DeepEqual(t, stats.ContentEncoding, "x-reverse")
+}
+
+func TestExtraEncodingsNotRequested(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Encoding", "x-reverse")
+			w.Write(theAnswer)
+		}))
+	defer server.Close()
+	// Registered encodings are only decoded when listed.
+	transport := &httpcontrol.Transport{ManualDecompression: true}
+	client := &http.Client{Transport: transport}
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	ensure.False(t, res.Uncompressed)
+	ensure.DeepEqual(t, res.Header.Get("Content-Encoding"), "x-reverse")
+	assertResponse(res, t)
+}
+
+func TestExtraEncodingsUnregistered(t *testing.T) {
+	t.Parallel()
+	transport := &httpcontrol.Transport{ExtraEncodings: []string{"x-unknown"}}
+	client := &http.Client{Transport: transport}
+	_, err := client.Get("http://example.invalid/")
+	ensure.Err(t, err, regexp.MustCompile(`ExtraEncodings "x-unknown" is not registered`))
+}
@@ -0,0 +1,172 @@
+package httpcontrol
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// newDialer returns the dialer used when neither Dial nor DialContext is set.
+func (t *Transport) newDialer() *net.Dialer {
+	dialer := &net.Dialer{
+		Timeout:         t.DialTimeout,
+		KeepAlive:       t.DialKeepAlive,
+		KeepAliveConfig: t.DialKeepAliveConfig,
+		LocalAddr:       t.LocalAddr,
+		Control:         t.DialControl,
+	}
+	if t.DialTimeoutJitter != 0 {
+		// Applied per dial by timedDial instead.
+		dialer.Timeout = 0
+	}
+	if t.HappyEyeballs {
+		dialer.FallbackDelay = t.HappyEyeballsDelay
+	} else {
+		dialer.FallbackDelay = -1
+	}
+	return dialer
+}
+
+// checkLocalAddr checks that the LocalAddr can be used to make connections.
+func (t *Transport) checkLocalAddr() error {
+	if t.LocalAddr == nil {
+		return nil
+	}
+	addr, ok := t.LocalAddr.(*net.TCPAddr)
+	if !ok {
+		return fmt.Errorf("httpcontrol: LocalAddr %v must be a *net.TCPAddr, not %T",
+			t.LocalAddr, t.LocalAddr)
+	}
+	// Binding a listener verifies the address belongs to this host, without
+	// taking the port which dialing may need.
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: addr.IP, Zone: addr.Zone})
+	if err != nil {
+		return fmt.Errorf("httpcontrol: LocalAddr %v is not usable: %w", addr, err)
+	}
+	l.Close()
+	return nil
+}
+
+// dialContext dials using the custom DialContext, applying DialTimeout and
+// the keep-alive settings the same way the default dialer does.
+func (t *Transport) dialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if timeout := t.dialTimeout(); timeout != 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	conn, err := t.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	if tc, ok := conn.(*net.TCPConn); ok {
+		if t.DialKeepAliveConfig.Enable {
+			tc.SetKeepAliveConfig(t.DialKeepAliveConfig)
+		} else if t.DialKeepAlive > 0 {
+			tc.SetKeepAlive(true)
+			tc.SetKeepAlivePeriod(t.DialKeepAlive)
+		}
+	}
+	return conn, nil
+}
+
+// noDelayDial wraps dial to apply the TCPNoDelay to TCP connections.
+func (t *Transport) noDelayDial(
+	dial func(ctx context.Context, network, address string) (net.Conn, error),
+) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		if tc, ok := conn.(*net.TCPConn); ok {
+			if err := tc.SetNoDelay(*t.TCPNoDelay); err != nil {
+				conn.Close()
+				return nil, err
+			}
+		}
+		return conn, nil
+	}
+}
+
+// dialErrors wraps dial to return its errors as a *DialError.
+func dialErrors(
+	dial func(ctx context.Context, network, address string) (net.Conn, error),
+) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, &DialError{Addr: address, Err: err}
+		}
+		return conn, nil
+	}
+}
+
+// jitter returns a random duration between zero and d.
+func (t *Transport) jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(randInt63n(t.RandFloat, int64(d)+1))
+}
+
+// dialTimeout returns the timeout for a dial, the DialTimeout with the
+// DialTimeoutJitter applied.
+func (t *Transport) dialTimeout() time.Duration {
+	if t.DialTimeout == 0 {
+		return 0
+	}
+	return t.DialTimeout + t.jitter(t.DialTimeoutJitter)
+}
+
+// timedDial wraps the default dialer to apply the DialTimeout with its
+// jitter, which the dialer cannot vary per dial.
+func (t *Transport) timedDial(
+	dial func(ctx context.Context, network, address string) (net.Conn, error),
+) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		if timeout := t.dialTimeout(); timeout != 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		return dial(ctx, network, address)
+	}
+}
+
+// jitterDial wraps dial to wait up to the ConnectJitter before dialing.
+func (t *Transport) jitterDial(
+	dial func(ctx context.Context, network, address string) (net.Conn, error),
+) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		select {
+		case <-t.clock().After(t.jitter(t.ConnectJitter)):
+		case <-ctx.Done():
+			return nil, context.Cause(ctx)
+		}
+		return dial(ctx, network, address)
+	}
+}
+
+// limitDial wraps dial to wait for one of the dial slots of the
+// MaxConcurrentDials, recording the wait in the trace of the attempt.
+func (t *Transport) limitDial(
+	dial func(ctx context.Context, network, address string) (net.Conn, error),
+) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		start := time.Now()
+		select {
+		case t.dialSlots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, context.Cause(ctx)
+		}
+		defer func() { <-t.dialSlots }()
+		if a, ok := ctx.Value(dialWaitKey).(*attemptTrace); ok {
+			a.mu.Lock()
+			a.dialWait += time.Since(start)
+			a.mu.Unlock()
+		}
+		return dial(ctx, network, address)
+	}
+}
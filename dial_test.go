@@ -0,0 +1,289 @@
+package httpcontrol_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"github.com/facebookgo/httpcontrol"
+)
+
+func TestCustomDialContext(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(sleepHandler(time.Millisecond))
+	defer server.Close()
+	var dialed []string
+	transport := &httpcontrol.Transport{
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			dialed = append(dialed, address)
+			var d net.Dialer
+			return d.DialContext(ctx, network, server.Listener.Addr().String())
+		},
+	}
+	client := &http.Client{Transport: transport}
+	res, err := client.Get("http://example.invalid/")
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	ensure.DeepEqual(t, dialed, []string{"example.invalid:80"})
+}
+
+func TestCustomDialContextTimeout(t *testing.T) {
+	t.Parallel()
+	var tries int
+	transport := &httpcontrol.Transport{
+		DialTimeout: 20 * time.Millisecond,
+		MaxTries:    1,
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			tries++
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	}
+	var pending bool
+	transport.Stats = func(stats *httpcontrol.Stats) {
+		pending = pending || stats.Retry.Pending
+	}
+	client := &http.Client{Transport: transport}
+	start := time.Now()
+	_, err := client.Get("http://example.invalid/")
+	ensure.True(t, errors.Is(err, context.DeadlineExceeded), err)
+	ensure.True(t, time.Since(start) < time.Second)
+	ensure.DeepEqual(t, tries, 2)
+	ensure.True(t, pending)
+}
+
+func TestAddressFamily(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(sleepHandler(time.Millisecond))
+	defer server.Close()
+	transport := &httpcontrol.Transport{HappyEyeballs: true}
+	var families []string
+	transport.Stats = func(stats *httpcontrol.Stats) {
+		families = append(families, stats.AddressFamily)
+	}
+	client := &http.Client{Transport: transport}
+	for i := 0; i < 2; i++ {
+		res, err := client.Get(server.URL)
+		ensure.Nil(t, err)
+		assertResponse(res, t)
+	}
+	ensure.DeepEqual(t, families, []string{"tcp4", ""})
+}
+
+func TestStatsAddrs(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(sleepHandler(0))
+	defer server.Close()
+	var remotes, locals []string
+	transport := &httpcontrol.Transport{
+		Stats: func(stats *httpcontrol.Stats) {
+			remotes = append(remotes, stats.RemoteAddr)
+			locals = append(locals, stats.LocalAddr)
+		},
+	}
+	client := &http.Client{Transport: transport}
+	for i := 0; i < 2; i++ {
+		res, err := client.Get(server.URL)
+		ensure.Nil(t, err)
+		assertResponse(res, t)
+	}
+	addr := server.Listener.Addr().String()
+	ensure.DeepEqual(t, remotes, []string{addr, addr})
+	// The second request reused the connection.
+	ensure.DeepEqual(t, locals[0], locals[1])
+	host, port, err := net.SplitHostPort(locals[0])
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, host, "127.0.0.1")
+	ensure.NotDeepEqual(t, port, "")
+}
+
+func TestDialControl(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(sleepHandler(0))
+	defer server.Close()
+	var addresses []string
+	var controlled bool
+	transport := &httpcontrol.Transport{
+		DialControl: func(network, address string, c syscall.RawConn) error {
+			addresses = append(addresses, address)
+			ensure.NotNil(t, c)
+			return c.Control(func(fd uintptr) { controlled = true })
+		},
+	}
+	client := &http.Client{Transport: transport}
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	ensure.DeepEqual(t, addresses, []string{server.Listener.Addr().String()})
+	ensure.True(t, controlled)
+}
+
+func TestDialControlError(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(sleepHandler(0))
+	defer server.Close()
+	transport := &httpcontrol.Transport{
+		DialControl: func(network, address string, c syscall.RawConn) error {
+			return errors.New("socket rejected")
+		},
+	}
+	client := &http.Client{Transport: transport}
+	_, err := client.Get(server.URL)
+	ensure.Err(t, err, regexp.MustCompile("socket rejected"))
+}
+
+func TestLocalAddr(t *testing.T) {
+	t.Parallel()
+	var remote string
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			remote = r.RemoteAddr
+			w.Write(theAnswer)
+		}))
+	defer server.Close()
+	transport := &httpcontrol.Transport{
+		LocalAddr: &net.TCPAddr{IP: net.ParseIP("127.0.0.1")},
+	}
+	client := &http.Client{Transport: transport}
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	host, _, err := net.SplitHostPort(remote)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, host, "127.0.0.1")
+}
+
+func TestLocalAddrInvalid(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(sleepHandler(0))
+	defer server.Close()
+	for _, addr := range []net.Addr{
+		&net.UDPAddr{IP: net.ParseIP("127.0.0.1")},
+		// TEST-NET-1 is reserved for documentation and not assigned locally.
+		&net.TCPAddr{IP: net.ParseIP("192.0.2.1")},
+	} {
+		transport := &httpcontrol.Transport{LocalAddr: addr}
+		client := &http.Client{Transport: transport}
+		_, err := client.Get(server.URL)
+		ensure.Err(t, err, regexp.MustCompile("httpcontrol: LocalAddr"))
+	}
+}
+
+func TestConnectJitter(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(sleepHandler(0))
+	defer server.Close()
+	const maxJitter = time.Hour
+	clock := httpcontrol.NewFakeClock()
+	transport := &httpcontrol.Transport{ConnectJitter: maxJitter}
+	httpcontrol.SetClock(transport, clock)
+	client := &http.Client{Transport: transport}
+	start := clock.Now()
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	waited := clock.Now().Sub(start)
+	ensure.True(t, waited > 0 && waited <= maxJitter, waited)
+}
+
+func TestConnectJitterRandFloat(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(sleepHandler(0))
+	defer server.Close()
+	clock := httpcontrol.NewFakeClock()
+	transport := &httpcontrol.Transport{
+		ConnectJitter: time.Hour,
+		RandFloat:     func() float64 { return 0.25 },
+	}
+	httpcontrol.SetClock(transport, clock)
+	client := &http.Client{Transport: transport}
+	start := clock.Now()
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	ensure.DeepEqual(t, clock.Now().Sub(start), 15*time.Minute)
+}
+
+func TestMaxConcurrentDials(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(sleepHandler(0))
+	defer server.Close()
+	var mu sync.Mutex
+	var active, peak int
+	var waited bool
+	transport := &httpcontrol.Transport{
+		MaxConcurrentDials: 2,
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			mu.Lock()
+			active++
+			peak = max(peak, active)
+			mu.Unlock()
+			time.Sleep(20 * time.Millisecond)
+			mu.Lock()
+			active--
+			mu.Unlock()
+			var d net.Dialer
+			return d.DialContext(ctx, network, address)
+		},
+		Stats: func(stats *httpcontrol.Stats) {
+			mu.Lock()
+			waited = waited || stats.Timing.DialWait > 0
+			mu.Unlock()
+		},
+	}
+	client := &http.Client{Transport: transport}
+	var wg sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := client.Get(server.URL)
+			ensure.Nil(t, err)
+			assertResponse(res, t)
+		}()
+	}
+	wg.Wait()
+	mu.Lock()
+	defer mu.Unlock()
+	ensure.DeepEqual(t, peak, 2)
+	ensure.True(t, waited)
+}
+
+func TestMaxConcurrentDialsDeadline(t *testing.T) {
+	t.Parallel()
+	release := make(chan struct{})
+	defer close(release)
+	var dials int32
+	transport := &httpcontrol.Transport{
+		MaxConcurrentDials: 1,
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			if atomic.AddInt32(&dials, 1) == 1 {
+				<-release
+			}
+			return nil, errors.New("dial failed")
+		},
+	}
+	client := &http.Client{Transport: transport}
+	go client.Get("http://example.invalid/")
+	// Give the first request time to take the only dial slot.
+	time.Sleep(20 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", "http://example.invalid/other", nil)
+	ensure.Nil(t, err)
+	start := time.Now()
+	_, err = client.Do(req)
+	ensure.True(t, errors.Is(err, context.DeadlineExceeded), err)
+	ensure.True(t, time.Since(start) < time.Second)
+	ensure.DeepEqual(t, atomic.LoadInt32(&dials), int32(1))
+}
@@ -0,0 +1,190 @@
+package httpcontrol
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// dnsCache caches resolved addresses per host for a fixed TTL and hands them
+// out round-robin.
+type dnsCache struct {
+	ttl    time.Duration
+	lookup func(ctx context.Context, host string) ([]net.IPAddr, error)
+
+	mu      sync.Mutex
+	entries map[string]*dnsEntry
+}
+
+type dnsEntry struct {
+	addrs   []net.IPAddr
+	expires time.Time
+	next    int
+}
+
+// get returns the addresses for host, starting from the next one in turn,
+// resolving them if they are not cached or the cached entry has expired.
+func (c *dnsCache) get(ctx context.Context, host string) ([]net.IPAddr, error) {
+	c.mu.Lock()
+	if e := c.entries[host]; e != nil && time.Now().Before(e.expires) {
+		addrs := rotate(e.addrs, e.next)
+		e.next++
+		c.mu.Unlock()
+		return addrs, nil
+	}
+	c.mu.Unlock()
+
+	addrs, err := c.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	if len(addrs) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.entries == nil {
+		c.entries = make(map[string]*dnsEntry)
+	}
+	c.entries[host] = &dnsEntry{
+		addrs:   addrs,
+		expires: time.Now().Add(c.ttl),
+		next:    1,
+	}
+	return addrs, nil
+}
+
+// rotate returns a copy of addrs starting at the n-th one, wrapping around.
+func rotate(addrs []net.IPAddr, n int) []net.IPAddr {
+	n %= len(addrs)
+	return append(append([]net.IPAddr(nil), addrs[n:]...), addrs[:n]...)
+}
+
+// invalidate removes the cached entry for host.
+func (c *dnsCache) invalidate(host string) {
+	c.mu.Lock()
+	delete(c.entries, host)
+	c.mu.Unlock()
+}
+
+// dialCached dials address using the DNS cache to resolve its host. The
+// cached addresses are tried in turn, or raced by family with HappyEyeballs
+// like the dialer does, and the cache entry is invalidated if all of them
+// fail, so the next dial resolves again.
+func (t *Transport) dialCached(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil || net.ParseIP(host) != nil {
+		return t.dialer.DialContext(ctx, network, address)
+	}
+	addrs, err := t.dnsCache.get(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	var conn net.Conn
+	if primaries, fallbacks := partition(addrs); t.HappyEyeballs && len(fallbacks) > 0 {
+		conn, err = t.dialParallel(ctx, network, port, primaries, fallbacks)
+	} else {
+		conn, err = t.dialSerial(ctx, network, port, addrs)
+	}
+	if err != nil {
+		t.dnsCache.invalidate(host)
+		return nil, err
+	}
+	return conn, nil
+}
+
+// dialSerial dials the addrs one after the other, returning the first
+// connection made or the first error if none could be.
+func (t *Transport) dialSerial(ctx context.Context, network, port string, addrs []net.IPAddr) (net.Conn, error) {
+	var first error
+	for _, addr := range addrs {
+		conn, err := t.dialer.DialContext(ctx, network, net.JoinHostPort(addr.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+		if first == nil {
+			first = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, first
+}
+
+// dialParallel dials the primaries, and the fallbacks once the
+// HappyEyeballsDelay has passed or the primaries failed, returning the first
+// connection made.
+func (t *Transport) dialParallel(
+	ctx context.Context, network, port string, primaries, fallbacks []net.IPAddr,
+) (net.Conn, error) {
+	type result struct {
+		conn    net.Conn
+		err     error
+		primary bool
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan result)
+	returned := make(chan struct{})
+	defer close(returned)
+	race := func(addrs []net.IPAddr, primary bool) {
+		conn, err := t.dialSerial(ctx, network, port, addrs)
+		select {
+		case results <- result{conn: conn, err: err, primary: primary}:
+		case <-returned:
+			if conn != nil {
+				conn.Close()
+			}
+		}
+	}
+	go race(primaries, true)
+
+	delay := t.HappyEyeballsDelay
+	if delay == 0 {
+		delay = 300 * time.Millisecond
+	}
+	fallbackTimer := time.NewTimer(delay)
+	defer fallbackTimer.Stop()
+
+	var primary, fallback result
+	for {
+		select {
+		case <-fallbackTimer.C:
+			go race(fallbacks, false)
+		case res := <-results:
+			if res.err == nil {
+				return res.conn, nil
+			}
+			if res.primary {
+				primary = res
+			} else {
+				fallback = res
+			}
+			if primary.err != nil && fallback.err != nil {
+				return nil, primary.err
+			}
+			if res.primary && fallbackTimer.Stop() {
+				// The primaries failed before the delay, so there is no point
+				// in waiting for it.
+				go race(fallbacks, false)
+			}
+		}
+	}
+}
+
+// partition splits addrs into those of the family of the first one and the
+// others, like the dialer does for HappyEyeballs.
+func partition(addrs []net.IPAddr) (primaries, fallbacks []net.IPAddr) {
+	v4 := addrs[0].IP.To4() != nil
+	for _, addr := range addrs {
+		if (addr.IP.To4() != nil) == v4 {
+			primaries = append(primaries, addr)
+		} else {
+			fallbacks = append(fallbacks, addr)
+		}
+	}
+	return primaries, fallbacks
+}
@@ -0,0 +1,132 @@
+package httpcontrol
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+)
+
+type fakeLookup struct {
+	mu    sync.Mutex
+	count int
+	addrs []net.IPAddr
+	err   error
+}
+
+func (f *fakeLookup) lookup(ctx context.Context, host string) ([]net.IPAddr, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.count++
+	return f.addrs, f.err
+}
+
+func TestDNSCacheRoundRobin(t *testing.T) {
+	f := &fakeLookup{addrs: []net.IPAddr{
+		{IP: net.ParseIP("10.0.0.1")},
+		{IP: net.ParseIP("10.0.0.2")},
+	}}
+	c := &dnsCache{ttl: time.Hour, lookup: f.lookup}
+	var got []string
+	for i := 0; i < 4; i++ {
+		addrs, err := c.get(context.Background(), "a")
+		ensure.Nil(t, err)
+		ensure.DeepEqual(t, len(addrs), 2)
+		got = append(got, addrs[0].String())
+	}
+	ensure.DeepEqual(t, got, []string{"10.0.0.1", "10.0.0.2", "10.0.0.1", "10.0.0.2"})
+	ensure.DeepEqual(t, f.count, 1)
+
+	c.invalidate("a")
+	_, err := c.get(context.Background(), "a")
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, f.count, 2)
+}
+
+func TestDNSCacheExpires(t *testing.T) {
+	f := &fakeLookup{addrs: []net.IPAddr{{IP: net.ParseIP("10.0.0.1")}}}
+	c := &dnsCache{ttl: time.Millisecond, lookup: f.lookup}
+	c.get(context.Background(), "a")
+	time.Sleep(5 * time.Millisecond)
+	c.get(context.Background(), "a")
+	ensure.DeepEqual(t, f.count, 2)
+}
+
+func TestDNSCacheLookupError(t *testing.T) {
+	f := &fakeLookup{err: errors.New("boom")}
+	c := &dnsCache{ttl: time.Hour, lookup: f.lookup}
+	_, err := c.get(context.Background(), "a")
+	ensure.DeepEqual(t, err, f.err)
+	f.err = nil
+	_, err = c.get(context.Background(), "a")
+	ensure.NotNil(t, err)
+	ensure.True(t, err.(*net.DNSError).IsNotFound)
+}
+
+func TestDNSCacheInvalidatedOnDialFailure(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	l.Close()
+
+	f := &fakeLookup{addrs: []net.IPAddr{{IP: net.ParseIP("127.0.0.1")}}}
+	tr := Transport{dialer: &net.Dialer{}}
+	tr.dnsCache = &dnsCache{ttl: time.Hour, lookup: f.lookup}
+	_, err = tr.dialCached(context.Background(), "tcp", net.JoinHostPort("a", port))
+	ensure.NotNil(t, err)
+	_, err = tr.dialCached(context.Background(), "tcp", net.JoinHostPort("a", port))
+	ensure.NotNil(t, err)
+	ensure.DeepEqual(t, f.count, 2)
+}
+
+// deadAddrs returns the address of a listener along with a port, and an
+// address of the loopback network on which nothing listens on that port.
+func deadAddrs(t *testing.T) (net.Listener, string, net.IPAddr) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+	return l, port, net.IPAddr{IP: net.ParseIP("127.0.0.2")}
+}
+
+func TestDNSCacheFallsBackToOtherAddresses(t *testing.T) {
+	l, port, dead := deadAddrs(t)
+	defer l.Close()
+
+	f := &fakeLookup{addrs: []net.IPAddr{dead, {IP: net.ParseIP("127.0.0.1")}}}
+	tr := Transport{dialer: &net.Dialer{}}
+	tr.dnsCache = &dnsCache{ttl: time.Hour, lookup: f.lookup}
+	for i := 0; i < 3; i++ {
+		conn, err := tr.dialCached(context.Background(), "tcp", net.JoinHostPort("a", port))
+		ensure.Nil(t, err)
+		ensure.DeepEqual(t, conn.RemoteAddr().String(), l.Addr().String())
+		conn.Close()
+	}
+	ensure.DeepEqual(t, f.count, 1)
+}
+
+func TestDNSCacheHappyEyeballs(t *testing.T) {
+	l, port, dead := deadAddrs(t)
+	defer l.Close()
+	l6, err := net.Listen("tcp6", net.JoinHostPort("::1", port))
+	if err != nil {
+		t.Skip("IPv6 loopback is not available:", err)
+	}
+	l6.Close()
+
+	// The IPv6 address is dialed first, the IPv4 ones after the delay.
+	f := &fakeLookup{addrs: []net.IPAddr{{IP: net.ParseIP("::1")}, dead, {IP: net.ParseIP("127.0.0.1")}}}
+	tr := Transport{
+		dialer:             &net.Dialer{},
+		HappyEyeballs:      true,
+		HappyEyeballsDelay: time.Hour,
+	}
+	tr.dnsCache = &dnsCache{ttl: time.Hour, lookup: f.lookup}
+	conn, err := tr.dialCached(context.Background(), "tcp", net.JoinHostPort("a", port))
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, conn.RemoteAddr().String(), l.Addr().String())
+	conn.Close()
+}
@@ -0,0 +1,34 @@
+// Package encodings registers the brotli ("br") and zstd content encodings
+// for httpcontrol.Transport.ExtraEncodings.
+//
+// The decoders come from third-party modules, which the core package does not
+// import unless this one is. Importing it for its side effect is enough:
+//
+//	import _ "github.com/facebookgo/httpcontrol/encodings"
+//
+//	transport := &httpcontrol.Transport{ExtraEncodings: []string{"br", "zstd"}}
+package encodings
+
+import (
+	"io"
+	"io/ioutil"
+
+	"github.com/andybalholm/brotli"
+	"github.com/facebookgo/httpcontrol"
+	"github.com/klauspost/compress/zstd"
+)
+
+func init() {
+	httpcontrol.RegisterEncoding("br", func(r io.Reader) (io.ReadCloser, error) {
+		return ioutil.NopCloser(brotli.NewReader(r)), nil
+	})
+	httpcontrol.RegisterEncoding("zstd", func(r io.Reader) (io.ReadCloser, error) {
+		// A single goroutine keeps a decoder per response cheap, and the
+		// window is bounded as recommended for HTTP by RFC 8878.
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxWindow(8<<20))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	})
+}
@@ -0,0 +1,79 @@
+package encodings_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/facebookgo/ensure"
+	"github.com/facebookgo/httpcontrol"
+	_ "github.com/facebookgo/httpcontrol/encodings"
+	"github.com/klauspost/compress/zstd"
+)
+
+var body = bytes.Repeat([]byte("42"), 1000)
+
+func encodingHandler(t *testing.T) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			accept := r.Header.Get("Accept-Encoding")
+			switch {
+			case strings.Contains(accept, "zstd"):
+				w.Header().Set("Content-Encoding", "zstd")
+				zw, err := zstd.NewWriter(w)
+				ensure.Nil(t, err)
+				zw.Write(body)
+				zw.Close()
+			case strings.Contains(accept, "br"):
+				w.Header().Set("Content-Encoding", "br")
+				bw := brotli.NewWriter(w)
+				bw.Write(body)
+				bw.Close()
+			default:
+				w.Write(body)
+			}
+		})
+}
+
+func TestEncodings(t *testing.T) {
+	server := httptest.NewServer(encodingHandler(t))
+	defer server.Close()
+	for _, encoding := range []string{"br", "zstd"} {
+		var stats *httpcontrol.Stats
+		transport := &httpcontrol.Transport{
+			ExtraEncodings: []string{encoding},
+			Stats:          func(s *httpcontrol.Stats) { stats = s },
+		}
+		client := &http.Client{Transport: transport}
+		res, err := client.Get(server.URL)
+		ensure.Nil(t, err)
+		ensure.True(t, res.Uncompressed, encoding)
+		b, err := ioutil.ReadAll(res.Body)
+		ensure.Nil(t, err)
+		ensure.Nil(t, res.Body.Close())
+		ensure.DeepEqual(t, b, body)
+		ensure.DeepEqual(t, stats.ContentEncoding, encoding)
+		ensure.True(t, stats.BytesReceived < int64(len(body)), stats.BytesReceived, encoding)
+		ensure.DeepEqual(t, stats.UncompressedBytes, int64(len(body)))
+	}
+}
+
+func TestEncodingsCorrupt(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Encoding", "zstd")
+			w.Write([]byte("not zstd"))
+		}))
+	defer server.Close()
+	transport := &httpcontrol.Transport{ExtraEncodings: []string{"zstd"}}
+	client := &http.Client{Transport: transport}
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	_, err = ioutil.ReadAll(res.Body)
+	ensure.NotNil(t, err)
+	ensure.Nil(t, res.Body.Close())
+}
@@ -0,0 +1,144 @@
+package httpcontrol
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+)
+
+// ErrRequestTimeout is returned when an attempt exceeds its RequestTimeout. It
+// is a net.Error reporting a timeout. When the timeout interrupts the
+// connection the error returned wraps the resulting connection error, which
+// is available using errors.Unwrap, and errors.Is reports it as
+// ErrRequestTimeout.
+var ErrRequestTimeout net.Error = &timeoutError{"httpcontrol: request timeout"}
+
+// ErrResponseBodyTimeout is returned when reading a response body stalls for
+// longer than the ResponseBodyTimeout. It is a net.Error reporting a timeout.
+var ErrResponseBodyTimeout net.Error = &timeoutError{"httpcontrol: response body timeout"}
+
+// RetryError is returned when a request fails after being retried. It carries
+// the error of every attempt, while Unwrap returns the final error so
+// errors.Is and errors.As see through it. Requests that fail on their first
+// and only attempt return the plain error.
+type RetryError struct {
+	// Err is the final error.
+	Err error
+
+	// Attempts is the total number of attempts made.
+	Attempts int
+
+	// Errors holds the error of each attempt in order. Attempts retried
+	// because of their response status are recorded as a *StatusError. The
+	// slice is truncated after more than 10 attempts: it then holds the error
+	// of the first attempt followed by those of the last 9, and is shorter
+	// than Attempts.
+	Errors []error
+}
+
+func (e *RetryError) Error() string {
+	errs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		errs[i] = err.Error()
+	}
+	return fmt.Sprintf("httpcontrol: failed after %d tries: [%s]: %v",
+		e.Attempts, strings.Join(errs, ", "), e.Err)
+}
+
+// Unwrap returns the final error.
+func (e *RetryError) Unwrap() error {
+	return e.Err
+}
+
+// StatusError records an attempt that was retried because of its response
+// status.
+type StatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *StatusError) Error() string {
+	return "httpcontrol: retryable status " + e.Status
+}
+
+// DialError is returned when an attempt fails to connect, whether to the
+// server or to a proxy. Its message is that of the underlying error. Dials
+// made by the RoundTripper given to Wrap are not covered.
+type DialError struct {
+	// The address dialed, as host:port.
+	Addr string
+
+	// The error of the dial, for example a *net.OpError.
+	Err error
+}
+
+func (e *DialError) Error() string { return e.Err.Error() }
+
+// Unwrap returns the error of the dial.
+func (e *DialError) Unwrap() error { return e.Err }
+
+// Timeout reports whether the dial timed out, as opposed to failing outright.
+func (e *DialError) Timeout() bool {
+	var neterr net.Error
+	return errors.Is(e.Err, context.DeadlineExceeded) ||
+		errors.As(e.Err, &neterr) && neterr.Timeout()
+}
+
+// Temporary is the same as Timeout, for net.Error.
+func (e *DialError) Temporary() bool { return e.Timeout() }
+
+// Refused reports whether the server actively refused the connection, which
+// usually means nothing listens on the port.
+func (e *DialError) Refused() bool {
+	return errors.Is(e.Err, syscall.ECONNREFUSED)
+}
+
+// errResponseHeaderTimeout is returned when the response headers take longer
+// than the ResponseHeaderTimeout to arrive.
+var errResponseHeaderTimeout net.Error = &timeoutError{"httpcontrol: timeout awaiting response headers"}
+
+// timeoutError is a net.Error reporting a timeout.
+type timeoutError struct {
+	message string
+}
+
+func (e *timeoutError) Error() string   { return e.message }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+// requestTimeoutError is an error caused by the RequestTimeout interrupting
+// the connection.
+type requestTimeoutError struct {
+	err error
+}
+
+func (e *requestTimeoutError) Error() string {
+	return ErrRequestTimeout.Error() + ": " + e.err.Error()
+}
+
+func (e *requestTimeoutError) Timeout() bool   { return true }
+func (e *requestTimeoutError) Temporary() bool { return true }
+
+func (e *requestTimeoutError) Is(target error) bool {
+	return target == ErrRequestTimeout
+}
+
+func (e *requestTimeoutError) Unwrap() error {
+	return e.err
+}
+
+// timeoutError translates err into an ErrRequestTimeout if it was caused by
+// the RequestTimeout of the attempt firing.
+func (a *attempt) timeoutError(err error) error {
+	if err == nil || err == io.EOF || a.ctx == nil {
+		return err
+	}
+	if context.Cause(a.ctx) != ErrRequestTimeout || errors.Is(err, ErrRequestTimeout) {
+		return err
+	}
+	return &requestTimeoutError{err: err}
+}
@@ -0,0 +1,223 @@
+package httpcontrol_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"github.com/facebookgo/freeport"
+	"github.com/facebookgo/httpcontrol"
+)
+
+func TestRetryError(t *testing.T) {
+	t.Parallel()
+	port, err := freeport.Get()
+	ensure.Nil(t, err)
+	transport := &httpcontrol.Transport{MaxTries: 2}
+	client := &http.Client{Transport: transport}
+	_, err = client.Get(fmt.Sprintf("http://127.0.0.1:%d/", port))
+	var retryErr *httpcontrol.RetryError
+	ensure.True(t, errors.As(err, &retryErr))
+	ensure.DeepEqual(t, retryErr.Attempts, 3)
+	ensure.DeepEqual(t, len(retryErr.Errors), 3)
+	for _, err := range retryErr.Errors {
+		ensure.True(t, errors.Is(err, syscall.ECONNREFUSED))
+	}
+	ensure.True(t, errors.Is(err, syscall.ECONNREFUSED))
+	ensure.Err(t, err, regexp.MustCompile("failed after 3 tries"))
+}
+
+func TestRetryErrorKeepsFirstAndLatest(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(sleepHandler(0))
+	defer server.Close()
+	var n int
+	transport := &httpcontrol.Transport{
+		MaxTries: 14,
+		ValidateResponse: func(*http.Response) error {
+			n++
+			return fmt.Errorf("attempt %d", n)
+		},
+	}
+	defer transport.Close()
+	_, err := (&http.Client{Transport: transport}).Get(server.URL)
+	var retryErr *httpcontrol.RetryError
+	ensure.True(t, errors.As(err, &retryErr), err)
+	ensure.DeepEqual(t, retryErr.Attempts, 15)
+	var got []string
+	for _, err := range retryErr.Errors {
+		got = append(got, err.Error())
+	}
+	ensure.DeepEqual(t, got, []string{
+		"attempt 1", "attempt 7", "attempt 8", "attempt 9", "attempt 10",
+		"attempt 11", "attempt 12", "attempt 13", "attempt 14", "attempt 15",
+	})
+}
+
+func TestNoRetryErrorForSingleAttempt(t *testing.T) {
+	t.Parallel()
+	port, err := freeport.Get()
+	ensure.Nil(t, err)
+	transport := &httpcontrol.Transport{}
+	client := &http.Client{Transport: transport}
+	_, err = client.Get(fmt.Sprintf("http://127.0.0.1:%d/", port))
+	var retryErr *httpcontrol.RetryError
+	ensure.False(t, errors.As(err, &retryErr))
+	ensure.True(t, errors.Is(err, syscall.ECONNREFUSED))
+}
+
+func TestRetryErrorString(t *testing.T) {
+	err := &httpcontrol.RetryError{
+		Err:      errors.New("timeout"),
+		Attempts: 2,
+		Errors: []error{
+			&httpcontrol.StatusError{StatusCode: 503, Status: "503 Service Unavailable"},
+			errors.New("timeout"),
+		},
+	}
+	ensure.DeepEqual(t, err.Error(), "httpcontrol: failed after 2 tries: "+
+		"[httpcontrol: retryable status 503 Service Unavailable, timeout]: timeout")
+}
+
+func TestRequestTimeoutError(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(sleepHandler(200 * time.Millisecond))
+	defer server.Close()
+	transport := &httpcontrol.Transport{RequestTimeout: 20 * time.Millisecond}
+	client := &http.Client{Transport: transport}
+	_, err := client.Get(server.URL)
+	ensure.True(t, errors.Is(err, httpcontrol.ErrRequestTimeout))
+	var neterr net.Error
+	ensure.True(t, errors.As(err, &neterr))
+	ensure.True(t, neterr.Timeout())
+	ensure.False(t, strings.Contains(err.Error(), "closed network connection"))
+}
+
+func TestResponseTimeoutIsRequestTimeout(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(sleepHandler(5 * time.Second))
+	defer server.Close()
+	var statsErr error
+	transport := &httpcontrol.Transport{
+		RequestTimeout: 50 * time.Millisecond,
+		Stats:          func(stats *httpcontrol.Stats) { statsErr = stats.Error },
+	}
+	defer transport.Close()
+	res, err := (&http.Client{Transport: transport}).Get(server.URL)
+	ensure.True(t, res == nil)
+	ensure.StringContains(t, err.Error(), "httpcontrol: request timeout")
+	for _, err := range []error{err, statsErr} {
+		ensure.True(t, errors.Is(err, httpcontrol.ErrRequestTimeout), err)
+		var neterr net.Error
+		ensure.True(t, errors.As(err, &neterr))
+		ensure.True(t, neterr.Timeout())
+	}
+}
+
+func TestRequestTimeoutDuringBody(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write(theAnswer)
+			w.(http.Flusher).Flush()
+			time.Sleep(250 * time.Millisecond)
+		}))
+	defer server.Close()
+	transport := &httpcontrol.Transport{RequestTimeout: 50 * time.Millisecond}
+	client := &http.Client{Transport: transport}
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	defer res.Body.Close()
+	_, err = ioutil.ReadAll(res.Body)
+	ensure.True(t, errors.Is(err, httpcontrol.ErrRequestTimeout), err)
+	var neterr net.Error
+	ensure.True(t, errors.As(err, &neterr))
+	ensure.True(t, neterr.Timeout())
+}
+
+func TestRequestTimeoutCoversBody(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write(theAnswer[:1])
+			w.(http.Flusher).Flush()
+			time.Sleep(250 * time.Millisecond)
+			w.Write(theAnswer[1:])
+		}))
+	defer server.Close()
+	slow := httptest.NewServer(sleepHandler(250 * time.Millisecond))
+	defer slow.Close()
+	on, off := true, false
+	for _, covers := range []*bool{nil, &on, &off} {
+		transport := &httpcontrol.Transport{
+			RequestTimeout:           50 * time.Millisecond,
+			RequestTimeoutCoversBody: covers,
+		}
+		client := &http.Client{Transport: transport}
+		res, err := client.Get(server.URL)
+		ensure.Nil(t, err)
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if covers == nil || *covers {
+			ensure.True(t, errors.Is(err, httpcontrol.ErrRequestTimeout), err)
+			var neterr net.Error
+			ensure.True(t, errors.As(err, &neterr))
+			ensure.True(t, neterr.Timeout())
+		} else {
+			ensure.Nil(t, err)
+			ensure.DeepEqual(t, body, theAnswer)
+		}
+
+		// The headers are bounded either way.
+		_, err = client.Get(slow.URL)
+		ensure.True(t, errors.Is(err, httpcontrol.ErrRequestTimeout), err)
+		transport.Close()
+	}
+}
+
+func TestDialErrorRefused(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(sleepHandler(0))
+	addr := server.Listener.Addr().String()
+	server.Close()
+	client := &http.Client{Transport: &httpcontrol.Transport{}}
+	_, err := client.Get(server.URL)
+	var dialErr *httpcontrol.DialError
+	ensure.True(t, errors.As(err, &dialErr), err)
+	ensure.True(t, dialErr.Refused())
+	ensure.False(t, dialErr.Timeout())
+	ensure.DeepEqual(t, dialErr.Addr, addr)
+	ensure.StringContains(t, err.Error(), "connection refused")
+	ensure.True(t, errors.Is(err, syscall.ECONNREFUSED))
+}
+
+func TestDialErrorTimeout(t *testing.T) {
+	t.Parallel()
+	transport := &httpcontrol.Transport{
+		DialTimeout: 20 * time.Millisecond,
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			<-ctx.Done()
+			return d.DialContext(ctx, network, address)
+		},
+	}
+	client := &http.Client{Transport: transport}
+	_, err := client.Get("http://example.invalid/")
+	var dialErr *httpcontrol.DialError
+	ensure.True(t, errors.As(err, &dialErr), err)
+	ensure.True(t, dialErr.Timeout())
+	ensure.False(t, dialErr.Refused())
+	ensure.DeepEqual(t, dialErr.Addr, "example.invalid:80")
+	var netErr net.Error
+	ensure.True(t, errors.As(err, &netErr) && netErr.Timeout())
+}
@@ -0,0 +1,105 @@
+package httpcontrol
+
+import (
+	"sync"
+	"time"
+)
+
+// SetClock replaces the clock used for the timeouts and backoff of t.
+func SetClock(t *Transport, c *FakeClock) {
+	t.clk = c
+}
+
+// FakeClock is a clock whose time only moves when advanced. Waiting on it
+// with After or Sleep advances it by the duration waited, so backoff returns
+// immediately while appearing to have taken the full delay.
+type FakeClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+// NewFakeClock returns a FakeClock starting at the current time.
+func NewFakeClock() *FakeClock {
+	return &FakeClock{now: time.Now()}
+}
+
+func (c *FakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d, firing the timers that become due.
+func (c *FakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	c.now = c.now.Add(d)
+	var due []*fakeTimer
+	active := c.timers[:0]
+	for _, t := range c.timers {
+		if !t.when.After(c.now) {
+			due = append(due, t)
+		} else {
+			active = append(active, t)
+		}
+	}
+	c.timers = active
+	c.mu.Unlock()
+	for _, t := range due {
+		t.f()
+	}
+}
+
+func (c *FakeClock) After(d time.Duration) <-chan time.Time {
+	c.Advance(d)
+	ch := make(chan time.Time, 1)
+	ch <- c.Now()
+	return ch
+}
+
+func (c *FakeClock) Sleep(d time.Duration) {
+	c.Advance(d)
+}
+
+func (c *FakeClock) AfterFunc(d time.Duration, f func()) clockTimer {
+	t := &fakeTimer{c: c, f: f}
+	t.Reset(d)
+	return t
+}
+
+// fakeTimer is a timer of a FakeClock, pending while in its list.
+type fakeTimer struct {
+	c    *FakeClock
+	f    func()
+	when time.Time
+}
+
+// remove removes the timer from the list, reporting whether it was pending.
+// The clock must be locked.
+func (t *fakeTimer) remove() bool {
+	for i, other := range t.c.timers {
+		if other == t {
+			t.c.timers = append(t.c.timers[:i], t.c.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	return t.remove()
+}
+
+func (t *fakeTimer) Reset(d time.Duration) bool {
+	t.c.mu.Lock()
+	pending := t.remove()
+	t.when = t.c.now.Add(d)
+	t.c.timers = append(t.c.timers, t)
+	t.c.mu.Unlock()
+	if d <= 0 {
+		t.c.Advance(0)
+	}
+	return pending
+}
@@ -0,0 +1,50 @@
+// Package expvarstats aggregates httpcontrol.Stats into expvar variables, for
+// services that want basic metrics without additional dependencies.
+package expvarstats
+
+import (
+	"expvar"
+
+	"github.com/facebookgo/httpcontrol"
+)
+
+// Collector aggregates Stats into published expvar variables. A single
+// Collector may be shared by multiple Transports.
+type Collector struct {
+	// Total number of request attempts.
+	Requests *expvar.Int
+
+	// Total number of request attempts that resulted in an error.
+	Errors *expvar.Int
+
+	// Total number of request attempts that were retried.
+	Retries *expvar.Int
+
+	// Cumulative duration of request attempts in seconds, including reading
+	// the body.
+	Duration *expvar.Float
+}
+
+// New creates a Collector publishing its variables as prefix.requests,
+// prefix.errors, prefix.retries and prefix.duration_seconds. Like
+// expvar.Publish, it panics if any of the names is already in use.
+func New(prefix string) *Collector {
+	return &Collector{
+		Requests: expvar.NewInt(prefix + ".requests"),
+		Errors:   expvar.NewInt(prefix + ".errors"),
+		Retries:  expvar.NewInt(prefix + ".retries"),
+		Duration: expvar.NewFloat(prefix + ".duration_seconds"),
+	}
+}
+
+// Stats records s and is suitable for Transport.Stats.
+func (c *Collector) Stats(s *httpcontrol.Stats) {
+	c.Requests.Add(1)
+	if s.Error != nil {
+		c.Errors.Add(1)
+	}
+	if s.Retry.Pending {
+		c.Retries.Add(1)
+	}
+	c.Duration.Add((s.Duration.Header + s.Duration.Body).Seconds())
+}
@@ -0,0 +1,39 @@
+package expvarstats_test
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+	"github.com/facebookgo/httpcontrol"
+	"github.com/facebookgo/httpcontrol/expvarstats"
+)
+
+func TestCollector(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("42"))
+		}))
+	defer server.Close()
+
+	c := expvarstats.New("test")
+	first := &httpcontrol.Transport{Stats: c.Stats}
+	second := &httpcontrol.Transport{Stats: c.Stats, MaxTries: 1}
+	for _, transport := range []*httpcontrol.Transport{first, second} {
+		res, err := (&http.Client{Transport: transport}).Get(server.URL)
+		ensure.Nil(t, err)
+		res.Body.Close()
+	}
+	ensure.DeepEqual(t, expvar.Get("test.requests").String(), "2")
+	ensure.DeepEqual(t, expvar.Get("test.errors").String(), "0")
+
+	server.Close()
+	_, err := (&http.Client{Transport: second}).Get(server.URL)
+	ensure.NotNil(t, err)
+	ensure.DeepEqual(t, expvar.Get("test.requests").String(), "4")
+	ensure.DeepEqual(t, expvar.Get("test.errors").String(), "2")
+	ensure.DeepEqual(t, expvar.Get("test.retries").String(), "1")
+	ensure.True(t, c.Duration.Value() > 0)
+}
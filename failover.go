@@ -0,0 +1,34 @@
+package httpcontrol
+
+import (
+	"net/http"
+	"net/url"
+)
+
+// failoverURL returns the URL for the attempt try given by the Failover, or
+// nil to use the URL of the request.
+func (t *Transport) failoverURL(req *http.Request, try uint) *url.URL {
+	if t.Failover == nil || try == 0 {
+		return nil
+	}
+	var u *url.URL
+	t.callback(func() { u = t.Failover(req, int(try)) })
+	if u == nil || u.Host == "" {
+		return nil
+	}
+	target := *req.URL
+	if u.Scheme != "" {
+		target.Scheme = u.Scheme
+	}
+	target.Host = u.Host
+	return &target
+}
+
+// retarget points out, a copy of the outgoing request of req, at target. A
+// Host header only repeating the original host follows the URL.
+func retarget(out, req *http.Request, target *url.URL) {
+	out.URL = target
+	if out.Host == req.URL.Host {
+		out.Host = ""
+	}
+}
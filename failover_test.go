@@ -0,0 +1,67 @@
+package httpcontrol_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+	"github.com/facebookgo/httpcontrol"
+)
+
+func TestFailover(t *testing.T) {
+	t.Parallel()
+	primary := httptest.NewServer(sleepHandler(0))
+	primary.Close()
+	var host string
+	secondary := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			host = r.Host
+			w.Write(theAnswer)
+		}))
+	defer secondary.Close()
+	u, err := url.Parse(secondary.URL)
+	ensure.Nil(t, err)
+	var tries []int
+	var errs []bool
+	transport := &httpcontrol.Transport{
+		MaxTries: 1,
+		Failover: func(req *http.Request, try int) *url.URL {
+			tries = append(tries, try)
+			return u
+		},
+		Stats: func(stats *httpcontrol.Stats) {
+			errs = append(errs, stats.Error != nil)
+		},
+	}
+	client := &http.Client{Transport: transport}
+	res, err := client.Get(primary.URL + "/path")
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	ensure.DeepEqual(t, tries, []int{1})
+	ensure.DeepEqual(t, errs, []bool{true, false})
+	ensure.DeepEqual(t, host, u.Host)
+	// The caller sees its own request.
+	ensure.DeepEqual(t, res.Request.URL.String(), primary.URL+"/path")
+}
+
+func TestFailoverKeepURL(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(statusThenAnswerHandler(http.StatusServiceUnavailable, 1))
+	defer server.Close()
+	var calls int
+	transport := &httpcontrol.Transport{
+		MaxTries:      1,
+		RetryStatuses: []int{http.StatusServiceUnavailable},
+		Failover: func(req *http.Request, try int) *url.URL {
+			calls++
+			return nil
+		},
+	}
+	client := &http.Client{Transport: transport}
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	ensure.DeepEqual(t, calls, 1)
+}
@@ -0,0 +1,74 @@
+package httpcontrol
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/http"
+)
+
+// outgoing returns the request to send for req with the default Header, the
+// RequestIDHeader, the Accept-Encoding for ManualDecompression and the
+// HostOverride merged in, and reports whether the response should be
+// decompressed. The request of the caller is never modified, so it is copied
+// if anything is missing.
+func (t *Transport) outgoing(req *http.Request) (*http.Request, bool) {
+	var out *http.Request
+	clone := func() {
+		if out == nil {
+			out = req.Clone(req.Context())
+			if out.Header == nil {
+				out.Header = make(http.Header)
+			}
+		}
+	}
+	set := func(key string, values []string) {
+		clone()
+		out.Header[http.CanonicalHeaderKey(key)] = values
+	}
+	if host, ok := t.hostOverride(req); ok {
+		clone()
+		out.Host = host
+	}
+	for key, values := range t.Header {
+		if len(values) == 0 || len(req.Header.Values(key)) != 0 {
+			continue
+		}
+		set(key, append([]string(nil), values...))
+	}
+	if t.RequestIDHeader != "" && req.Header.Get(t.RequestIDHeader) == "" {
+		set(t.RequestIDHeader, []string{newRequestID()})
+	}
+	decompress := false
+	if out != nil {
+		decompress = t.decompressing(out)
+	} else {
+		decompress = t.decompressing(req)
+	}
+	if decompress {
+		set("Accept-Encoding", []string{t.acceptEncoding()})
+	}
+	if out == nil {
+		return req, false
+	}
+	return out, decompress
+}
+
+// hostOverride returns the Host header to send for req from the HostOverride,
+// unless the caller set one that differs from the URL.
+func (t *Transport) hostOverride(req *http.Request) (string, bool) {
+	if len(t.HostOverride) == 0 || (req.Host != "" && req.Host != req.URL.Host) {
+		return "", false
+	}
+	return lookupHost(t.HostOverride, req.URL)
+}
+
+// newRequestID returns a random (version 4) UUID.
+func newRequestID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic(err)
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,194 @@
+package httpcontrol_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"sync"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+	"github.com/facebookgo/httpcontrol"
+)
+
+func TestDefaultHeader(t *testing.T) {
+	t.Parallel()
+	var mu sync.Mutex
+	var seen []http.Header
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			seen = append(seen, r.Header)
+			n := len(seen)
+			mu.Unlock()
+			if n == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Write(theAnswer)
+		}))
+	defer server.Close()
+	transport := &httpcontrol.Transport{
+		MaxTries:      1,
+		RetryStatuses: []int{http.StatusServiceUnavailable},
+		Header: http.Header{
+			"User-Agent":    {"httpcontrol-test"},
+			"Authorization": {"Bearer default"},
+		},
+	}
+	client := &http.Client{Transport: transport}
+	req, err := http.NewRequest("GET", server.URL, nil)
+	ensure.Nil(t, err)
+	req.Header.Set("Authorization", "Bearer caller")
+	res, err := client.Do(req)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+
+	ensure.DeepEqual(t, len(seen), 2)
+	for _, h := range seen {
+		ensure.DeepEqual(t, h.Get("User-Agent"), "httpcontrol-test")
+		ensure.DeepEqual(t, h.Get("Authorization"), "Bearer caller")
+	}
+	// The request of the caller is left untouched.
+	ensure.DeepEqual(t, req.Header.Get("User-Agent"), "")
+}
+
+func TestRequestIDHeader(t *testing.T) {
+	t.Parallel()
+	var mu sync.Mutex
+	var ids []string
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			ids = append(ids, r.Header.Get("X-Request-Id"))
+			n := len(ids)
+			mu.Unlock()
+			if n == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Write(theAnswer)
+		}))
+	defer server.Close()
+	var reported []string
+	transport := &httpcontrol.Transport{
+		MaxTries:        1,
+		RetryStatuses:   []int{http.StatusServiceUnavailable},
+		RequestIDHeader: "X-Request-Id",
+		Stats: func(stats *httpcontrol.Stats) {
+			mu.Lock()
+			reported = append(reported, stats.RequestID)
+			mu.Unlock()
+		},
+	}
+	client := &http.Client{Transport: transport}
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+
+	mu.Lock()
+	defer mu.Unlock()
+	ensure.DeepEqual(t, len(ids), 2)
+	uuid := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	ensure.True(t, uuid.MatchString(ids[0]), ids[0])
+	ensure.DeepEqual(t, ids[1], ids[0])
+	ensure.DeepEqual(t, reported, []string{ids[0], ids[0]})
+}
+
+func TestRequestIDHeaderFromCaller(t *testing.T) {
+	t.Parallel()
+	var id string
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			id = r.Header.Get("X-Request-Id")
+			w.Write(theAnswer)
+		}))
+	defer server.Close()
+	var reported string
+	transport := &httpcontrol.Transport{
+		RequestIDHeader: "X-Request-Id",
+		Stats: func(stats *httpcontrol.Stats) {
+			reported = stats.RequestID
+		},
+	}
+	client := &http.Client{Transport: transport}
+	req, err := http.NewRequest("GET", server.URL, nil)
+	ensure.Nil(t, err)
+	req.Header.Set("X-Request-Id", "caller-id")
+	res, err := client.Do(req)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	ensure.DeepEqual(t, id, "caller-id")
+	ensure.DeepEqual(t, reported, "caller-id")
+}
+
+func TestHostOverride(t *testing.T) {
+	t.Parallel()
+	var mu sync.Mutex
+	var hosts []string
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			hosts = append(hosts, r.Host)
+			mu.Unlock()
+			w.Write(theAnswer)
+		}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	ensure.Nil(t, err)
+	transport := &httpcontrol.Transport{
+		HostOverride: map[string]string{u.Host: "staging.example.com"},
+	}
+	client := &http.Client{Transport: transport}
+
+	req, err := http.NewRequest("GET", server.URL, nil)
+	ensure.Nil(t, err)
+	res, err := client.Do(req)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	ensure.DeepEqual(t, req.Host, u.Host)
+
+	req, err = http.NewRequest("GET", server.URL, nil)
+	ensure.Nil(t, err)
+	req.Host = "explicit.example.com"
+	res, err = client.Do(req)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+
+	transport = &httpcontrol.Transport{
+		HostOverride: map[string]string{u.Hostname(): "any-port.example.com"},
+	}
+	client = &http.Client{Transport: transport}
+	res, err = client.Get(server.URL)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+
+	ensure.DeepEqual(t, hosts, []string{
+		"staging.example.com",
+		"explicit.example.com",
+		"any-port.example.com",
+	})
+}
+
+func TestHostOverrideKeepsTLSServerName(t *testing.T) {
+	t.Parallel()
+	var host string
+	server := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			host = r.Host
+			w.Write(theAnswer)
+		}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	ensure.Nil(t, err)
+	transport := &httpcontrol.Transport{
+		TLSClientConfig: server.Client().Transport.(*http.Transport).TLSClientConfig,
+		HostOverride:    map[string]string{u.Host: "not-in-the-cert.example.com"},
+	}
+	client := &http.Client{Transport: transport}
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	ensure.DeepEqual(t, host, "not-in-the-cert.example.com")
+}
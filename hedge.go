@@ -0,0 +1,106 @@
+package httpcontrol
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// errHedgeLost cancels the copy of a hedged request that did not win.
+var errHedgeLost = errors.New("httpcontrol: hedged request lost")
+
+// hedgeResult is the outcome of one copy of a hedged request.
+type hedgeResult struct {
+	rt  *roundTrip
+	res *http.Response
+	err error
+}
+
+// hedging reports whether req should be hedged. Only requests with an
+// idempotent method and no body are hedged, so they can be sent twice at
+// once.
+func (t *Transport) hedging(req *http.Request) bool {
+	return t.HedgeDelay > 0 && idempotent(req.Method) && !t.singleAttempt(req) &&
+		(req.Body == nil || req.Body == http.NoBody)
+}
+
+// hedge runs the RoundTrip as the primary copy and, if it has not returned
+// within the HedgeDelay, a second hedge copy. The first successful response
+// wins and the other copy is cancelled and cleaned up. Each copy does its own
+// retries.
+func (t *Transport) hedge(rt *roundTrip) (*http.Response, error) {
+	results := make(chan hedgeResult, 2)
+	launch := func(hedge bool) *roundTrip {
+		ctx, cancel := context.WithCancelCause(rt.ctx)
+		c := &roundTrip{
+			ctx:        ctx,
+			req:        rt.req,
+			out:        rt.out,
+			requestID:  rt.requestID,
+			serverName: rt.serverName,
+			decompress: rt.decompress,
+			parent:     rt,
+			cancel:     cancel,
+			hedge:      hedge,
+		}
+		atomic.AddInt32(&rt.copies, 1)
+		go func() {
+			res, err := t.tries(c)
+			results <- hedgeResult{rt: c, res: res, err: err}
+		}()
+		return c
+	}
+
+	copies := []*roundTrip{launch(false)}
+	timer := time.NewTimer(t.HedgeDelay)
+	var first hedgeResult
+	select {
+	case first = <-results:
+		timer.Stop()
+		return t.hedgeResult(rt, copies, first, nil)
+	case <-timer.C:
+		copies = append(copies, launch(true))
+	}
+
+	first = <-results
+	if first.err == nil {
+		return t.hedgeResult(rt, copies, first, results)
+	}
+	second := <-results
+	for _, err := range append(first.rt.errs, second.rt.errs...) {
+		rt.fail(err)
+	}
+	rt.failures = first.rt.failures + second.rt.failures
+	return t.hedgeResult(rt, copies, second, nil)
+}
+
+// hedgeResult returns the winning result, after cancelling the other copies.
+// If pending is non-nil a copy is still running, and its response is closed
+// once it returns.
+func (t *Transport) hedgeResult(rt *roundTrip, copies []*roundTrip, won hedgeResult, pending chan hedgeResult) (*http.Response, error) {
+	if won.err != nil {
+		if rt.failures == 0 {
+			rt.errs, rt.failures = won.rt.errs, won.rt.failures
+		}
+		for _, c := range copies {
+			c.cancel(nil)
+		}
+		return nil, won.err
+	}
+	won.rt.winner = true
+	for _, c := range copies {
+		if c != won.rt {
+			c.cancel(errHedgeLost)
+		}
+	}
+	if pending != nil {
+		go func() {
+			if lost := <-pending; lost.err == nil {
+				lost.res.Body.Close()
+			}
+		}()
+	}
+	return won.res, nil
+}
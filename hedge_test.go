@@ -0,0 +1,140 @@
+package httpcontrol_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"github.com/facebookgo/httpcontrol"
+)
+
+func TestHedgeWins(t *testing.T) {
+	t.Parallel()
+	var count int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&count, 1) == 1 {
+				select {
+				case <-release:
+				case <-r.Context().Done():
+				}
+				return
+			}
+			w.Write(theAnswer)
+		}))
+	defer server.Close()
+	defer close(release)
+	var mu sync.Mutex
+	var all []*httpcontrol.Stats
+	transport := &httpcontrol.Transport{
+		HedgeDelay: 20 * time.Millisecond,
+		Stats: func(stats *httpcontrol.Stats) {
+			mu.Lock()
+			all = append(all, stats)
+			mu.Unlock()
+		},
+	}
+	client := &http.Client{Transport: transport}
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	ensure.DeepEqual(t, atomic.LoadInt32(&count), int32(2))
+
+	// Wait for the losing primary to be cancelled and reported.
+	deadline := time.Now().Add(time.Second)
+	for {
+		mu.Lock()
+		n := len(all)
+		mu.Unlock()
+		if n == 2 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	ensure.DeepEqual(t, len(all), 2)
+	var winner, loser *httpcontrol.Stats
+	for _, stats := range all {
+		if stats.Error == nil {
+			winner = stats
+		} else {
+			loser = stats
+		}
+	}
+	ensure.NotNil(t, winner)
+	ensure.NotNil(t, loser)
+	ensure.True(t, winner.Hedge.Hedged)
+	ensure.DeepEqual(t, winner.Hedge.Copies, 2)
+	ensure.False(t, loser.Hedge.Hedged)
+}
+
+func TestHedgeNotNeeded(t *testing.T) {
+	t.Parallel()
+	var count int32
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&count, 1)
+			w.Write(theAnswer)
+		}))
+	defer server.Close()
+	var stats *httpcontrol.Stats
+	transport := &httpcontrol.Transport{
+		HedgeDelay: time.Second,
+		Stats:      func(s *httpcontrol.Stats) { stats = s },
+	}
+	client := &http.Client{Transport: transport}
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	ensure.DeepEqual(t, atomic.LoadInt32(&count), int32(1))
+	ensure.False(t, stats.Hedge.Hedged)
+	ensure.DeepEqual(t, stats.Hedge.Copies, 1)
+}
+
+func TestHedgeSkipsNonIdempotent(t *testing.T) {
+	t.Parallel()
+	var count int32
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&count, 1)
+			time.Sleep(50 * time.Millisecond)
+			w.Write(theAnswer)
+		}))
+	defer server.Close()
+	transport := &httpcontrol.Transport{HedgeDelay: 10 * time.Millisecond}
+	client := &http.Client{Transport: transport}
+	res, err := client.Post(server.URL, "text/plain", nil)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	ensure.DeepEqual(t, atomic.LoadInt32(&count), int32(1))
+}
+
+func TestHedgeCloseWait(t *testing.T) {
+	t.Parallel()
+	var count int32
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&count, 1) == 1 {
+				<-r.Context().Done()
+				return
+			}
+			w.Write(theAnswer)
+		}))
+	defer server.Close()
+	transport := &httpcontrol.Transport{HedgeDelay: 10 * time.Millisecond}
+	client := &http.Client{Transport: transport}
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	// Both copies are cleaned up so the Transport has nothing in flight.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	ensure.Nil(t, transport.CloseWait(ctx))
+}
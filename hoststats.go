@@ -0,0 +1,117 @@
+package httpcontrol
+
+import (
+	"time"
+)
+
+// HostStat is a point-in-time snapshot of the counters for a host, as
+// returned by HostStats. Every attempt counts as a request.
+type HostStat struct {
+	// Attempts currently in flight, including reading the response body.
+	InFlight int
+
+	// Total attempts made.
+	Requests uint64
+
+	// Total failed attempts. As for the circuit breaker, these are errors and
+	// responses with one of the RetryStatuses. Cancelled attempts and those
+	// failing before the host is contacted are not counted.
+	Errors uint64
+
+	// The number of failures since the last success.
+	ConsecutiveFailures int
+
+	// The time of the last failure, zero if there was none.
+	LastError time.Time
+
+	// The state of the circuit breaker: "closed", "open", or "half-open" when
+	// the cooldown has passed and a probe is allowed or in flight.
+	Circuit string
+}
+
+// hostStat holds the counters for a host.
+type hostStat struct {
+	inFlight    int
+	requests    uint64
+	errors      uint64
+	consecutive int
+	lastError   time.Time
+}
+
+// hostStart records the start of an attempt to host, and returns the function
+// to call once the attempt is finished.
+func (t *Transport) hostStart(host string) func() {
+	t.hostsMu.Lock()
+	defer t.hostsMu.Unlock()
+	if t.hosts == nil {
+		t.hosts = make(map[string]*hostStat)
+	}
+	h := t.hosts[host]
+	if h == nil {
+		h = &hostStat{}
+		t.hosts[host] = h
+	}
+	h.inFlight++
+	h.requests++
+	return func() {
+		t.hostsMu.Lock()
+		h.inFlight--
+		t.hostsMu.Unlock()
+	}
+}
+
+// record records the result of an attempt to host in its counters, the retry
+// budget and the circuit breaker, and reports whether the circuit is now open.
+func (t *Transport) record(host string, result circuitResult) bool {
+	if result != circuitIgnore {
+		t.hostsMu.Lock()
+		if h := t.hosts[host]; h != nil {
+			if result == circuitFailure {
+				h.errors++
+				h.consecutive++
+				h.lastError = time.Now()
+			} else {
+				h.consecutive = 0
+			}
+		}
+		t.hostsMu.Unlock()
+	}
+	if result == circuitSuccess {
+		t.retryBudgetDeposit()
+	}
+	return t.circuitRecord(host, result)
+}
+
+// HostStats returns a snapshot of the counters for each host the Transport
+// has made requests to.
+func (t *Transport) HostStats() map[string]HostStat {
+	t.hostsMu.Lock()
+	stats := make(map[string]HostStat, len(t.hosts))
+	for host, h := range t.hosts {
+		stats[host] = HostStat{
+			InFlight:            h.inFlight,
+			Requests:            h.requests,
+			Errors:              h.errors,
+			ConsecutiveFailures: h.consecutive,
+			LastError:           h.lastError,
+		}
+	}
+	t.hostsMu.Unlock()
+
+	now := time.Now()
+	t.circuitMu.Lock()
+	for host, s := range stats {
+		s.Circuit = "closed"
+		if c := t.circuits[host]; c != nil && t.CircuitThreshold > 0 &&
+			c.failures >= t.CircuitThreshold {
+			if c.probing || !now.Before(c.openUntil) {
+				s.Circuit = "half-open"
+			} else {
+				s.Circuit = "open"
+			}
+		}
+		stats[host] = s
+	}
+	t.circuitMu.Unlock()
+	return stats
+}
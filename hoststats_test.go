@@ -0,0 +1,58 @@
+package httpcontrol_test
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"github.com/facebookgo/freeport"
+	"github.com/facebookgo/httpcontrol"
+)
+
+func TestHostStats(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(statusThenAnswerHandler(http.StatusServiceUnavailable, 2))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	ensure.Nil(t, err)
+	transport := &httpcontrol.Transport{
+		MaxTries:      2,
+		RetryStatuses: []int{http.StatusServiceUnavailable},
+	}
+	client := &http.Client{Transport: transport}
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, transport.HostStats()[u.Host].InFlight, 1)
+	assertResponse(res, t)
+
+	stat := transport.HostStats()[u.Host]
+	ensure.DeepEqual(t, stat.InFlight, 0)
+	ensure.DeepEqual(t, stat.Requests, uint64(3))
+	ensure.DeepEqual(t, stat.Errors, uint64(2))
+	ensure.DeepEqual(t, stat.ConsecutiveFailures, 0)
+	ensure.False(t, stat.LastError.IsZero())
+	ensure.DeepEqual(t, stat.Circuit, "closed")
+}
+
+func TestHostStatsCircuitOpen(t *testing.T) {
+	t.Parallel()
+	port, err := freeport.Get()
+	ensure.Nil(t, err)
+	host := fmt.Sprintf("127.0.0.1:%d", port)
+	transport := &httpcontrol.Transport{
+		CircuitThreshold: 1,
+		CircuitCooldown:  time.Hour,
+	}
+	client := &http.Client{Transport: transport}
+	_, err = client.Get("http://" + host + "/")
+	ensure.NotNil(t, err)
+	stat := transport.HostStats()[host]
+	ensure.DeepEqual(t, stat.Requests, uint64(1))
+	ensure.DeepEqual(t, stat.Errors, uint64(1))
+	ensure.DeepEqual(t, stat.ConsecutiveFailures, 1)
+	ensure.DeepEqual(t, stat.Circuit, "open")
+}
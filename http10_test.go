@@ -0,0 +1,90 @@
+package httpcontrol_test
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+	"github.com/facebookgo/httpcontrol"
+)
+
+// http10Server answers every request with the raw response and closes the
+// connection, like a legacy HTTP/1.0 server.
+func http10Server(t *testing.T, response string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				req, err := http.ReadRequest(bufio.NewReader(c))
+				if err != nil {
+					return
+				}
+				io.Copy(ioutil.Discard, req.Body)
+				io.WriteString(c, response)
+			}()
+		}
+	}()
+	return "http://" + l.Addr().String()
+}
+
+func TestHTTP10Close(t *testing.T) {
+	t.Parallel()
+	for _, response := range []string{
+		"HTTP/1.0 200 OK\r\n\r\n42",
+		"HTTP/1.0 200 OK\r\nContent-Length: 2\r\n\r\n42",
+		"HTTP/1.0 200 OK\r\nConnection: keep-alive\r\nContent-Length: 2\r\n\r\n42",
+	} {
+		url := http10Server(t, response)
+		var stats []*httpcontrol.Stats
+		transport := &httpcontrol.Transport{
+			MaxTries:           2,
+			RetryNonIdempotent: true,
+			Stats:              func(s *httpcontrol.Stats) { stats = append(stats, s) },
+		}
+		client := &http.Client{Transport: transport}
+		const requests = 20
+		for i := 0; i < requests; i++ {
+			res, err := client.Post(url, "text/plain", strings.NewReader("hello"))
+			ensure.Nil(t, err, response)
+			assertResponse(res, t)
+		}
+		ensure.DeepEqual(t, len(stats), requests, response)
+		for _, s := range stats {
+			ensure.Nil(t, s.Error, response)
+			ensure.DeepEqual(t, s.Retry.Count, uint(0), response)
+		}
+	}
+}
+
+func TestHTTP10Truncated(t *testing.T) {
+	t.Parallel()
+	url := http10Server(t, "HTTP/1.0 200 OK\r\nContent-Length: 10\r\n\r\n42")
+	var stats *httpcontrol.Stats
+	var summary *httpcontrol.Summary
+	transport := &httpcontrol.Transport{
+		Stats: func(s *httpcontrol.Stats) { stats = s },
+		Done:  func(s *httpcontrol.Summary) { summary = s },
+	}
+	client := &http.Client{Transport: transport}
+	res, err := client.Get(url)
+	ensure.Nil(t, err)
+	b, err := ioutil.ReadAll(res.Body)
+	ensure.DeepEqual(t, err, io.ErrUnexpectedEOF)
+	ensure.DeepEqual(t, string(b), "42")
+	ensure.Nil(t, res.Body.Close())
+	ensure.DeepEqual(t, stats.Error, io.ErrUnexpectedEOF)
+	ensure.DeepEqual(t, summary.Error, io.ErrUnexpectedEOF)
+	ensure.True(t, httpcontrol.IsRetryableError(stats.Error))
+}
@@ -0,0 +1,42 @@
+package httpcontrol_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"github.com/facebookgo/httpcontrol"
+)
+
+func testProtocol(t *testing.T, enable bool, proto string, major int) {
+	server := httptest.NewUnstartedServer(sleepHandler(time.Millisecond))
+	server.EnableHTTP2 = true
+	server.StartTLS()
+	defer server.Close()
+	var protocol string
+	transport := &httpcontrol.Transport{
+		TLSClientConfig: server.Client().Transport.(*http.Transport).TLSClientConfig,
+		EnableHTTP2:     enable,
+		Stats: func(stats *httpcontrol.Stats) {
+			protocol = stats.Protocol
+		},
+	}
+	client := &http.Client{Transport: transport}
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, res.ProtoMajor, major)
+	assertResponse(res, t)
+	ensure.DeepEqual(t, protocol, proto)
+}
+
+func TestEnableHTTP2(t *testing.T) {
+	t.Parallel()
+	testProtocol(t, true, "h2", 2)
+}
+
+func TestDisableHTTP2(t *testing.T) {
+	t.Parallel()
+	testProtocol(t, false, "http/1.1", 1)
+}
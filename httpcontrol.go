@@ -7,17 +7,28 @@ package httpcontrol
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
+	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
+
+	"golang.org/x/net/http2"
+	"golang.org/x/time/rate"
 )
 
 // Stats for a RoundTrip.
@@ -25,11 +36,33 @@ type Stats struct {
 	// The RoundTrip request.
 	Request *http.Request
 
+	// The first request of the redirect chain when the http.Client is
+	// following redirects, otherwise the same as Request. All hops of a
+	// logical request share it, which allows correlating them.
+	OriginalRequest *http.Request
+
+	// The ID of the request when RequestIDHeader is set. Retries of the
+	// request share it.
+	RequestID string
+
+	// The tags attached to the request context with WithStatsTags. Each
+	// Stats has its own copy, which the callback may keep or modify.
+	Tags map[string]string
+
+	// The number of redirects followed to arrive at Request. It is non-zero
+	// for redirect follow-ups, which allows not counting them twice.
+	RedirectCount int
+
 	// May not always be available.
 	Response *http.Response
 
 	// Will be set if the RoundTrip resulted in an error. Note that these are
-	// RoundTrip errors and we do not care about the HTTP Status.
+	// RoundTrip errors and we do not care about the HTTP Status. For a
+	// response returned to the caller it is the error that ended reading its
+	// body, if any, such as io.ErrUnexpectedEOF for a connection closed before
+	// the body was complete per its Content-Length or chunked framing. Closing
+	// the connection to end a body without framing, as HTTP/1.0 servers do,
+	// is not an error.
 	Error error
 
 	// Each duration is independent and the sum of all of them is the total
@@ -38,14 +71,131 @@ type Stats struct {
 		Header, Body time.Duration
 	}
 
+	// The time from the start of the attempt to the first byte of the
+	// response, as reported by httptrace. Unlike Duration.Header it excludes
+	// parsing the headers, and it is zero if no response arrived. After
+	// informational responses, such as 100 Continue, it is the time until the
+	// final response headers were read instead, as their first byte is not
+	// reported.
+	TimeToFirstByte time.Duration
+
+	// Breakdown of where the time before the response headers went. The DNS,
+	// connect and TLS durations are zero when a pooled connection was reused.
+	Timing struct {
+		DNSResolve, Connect, TLSHandshake, WaitResponse time.Duration
+
+		// Time spent waiting for a connection slot when MaxConnsPerHost is
+		// set.
+		ConnWait time.Duration
+
+		// Time spent waiting for a dial slot when MaxConcurrentDials is set.
+		DialWait time.Duration
+	}
+
+	// Will be set if a pooled connection was reused rather than dialing a new
+	// one.
+	ConnReused bool
+
+	// Will be set if the reused connection was idle in the pool, as opposed
+	// to being handed over directly by a request finishing with it, in which
+	// case IdleTime is how long it sat there. Long idle times hint at
+	// connections that are about to be closed by the server.
+	WasIdle  bool
+	IdleTime time.Duration
+
+	// The state of the TLS connection for requests that negotiated TLS, as
+	// captured when the handshake completed. For reused connections it is
+	// taken from the response, and it is nil for plain HTTP requests.
+	TLS *tls.ConnectionState
+
+	// The address family of a newly dialed connection, "tcp4" or "tcp6". This
+	// shows which family won when HappyEyeballs is enabled.
+	AddressFamily string
+
+	// The remote and local addresses of the connection used, dialed or
+	// reused, as host:port. With several addresses for a host, RemoteAddr
+	// tells which one served the attempt. They are empty if no connection was
+	// obtained.
+	RemoteAddr, LocalAddr string
+
+	// The negotiated protocol, "h2" or "http/1.1".
+	Protocol string
+
+	// Will be set if the circuit breaker for the host is open, either because
+	// the attempt was failed fast or because it opened the circuit.
+	CircuitOpen bool
+
+	// Will be set if the attempt failed to establish a CONNECT tunnel through
+	// the proxy, rather than failing to reach the origin. The Error is then a
+	// *ProxyConnectError.
+	ProxyError bool
+
+	// Bytes of the request and response bodies transferred across all attempts
+	// of the RoundTrip so far. For a response that is returned to the caller
+	// these are only final once its body has been closed, which is also when
+	// the Stats for it are delivered.
+	BytesSent, BytesReceived int64
+
+	// Bytes of the request and response bodies transferred for this attempt
+	// alone.
+	Attempt struct {
+		BytesSent, BytesReceived int64
+	}
+
+	// Bytes of the response body for this attempt after decompression. With
+	// ManualDecompression the BytesReceived count the compressed bytes as
+	// transferred. Otherwise the standard transport decompresses the body
+	// before it is counted, and this is the same as Attempt.BytesReceived.
+	UncompressedBytes int64
+
+	// The content encoding of the response body decoded by the Transport
+	// itself, such as "gzip" or one of the ExtraEncodings. It is empty if the
+	// body was not encoded or was decoded by the standard transport.
+	ContentEncoding string
+
+	// Set for requests that were hedged.
+	Hedge struct {
+		// Will be set if the attempt belongs to the hedge sent after the
+		// HedgeDelay, rather than to the primary request.
+		Hedged bool
+
+		// The number of copies of the request launched so far, 1 or 2.
+		Copies int
+	}
+
 	Retry struct {
 		// Will be incremented for each retry. The initial request will have this
 		// set to 0, and the first retry to 1 and so on.
 		Count uint
 
-		// Will be set if and only if an error was encountered and a retry is
-		// pending.
+		// Will be set if and only if an error or a retryable status was
+		// encountered and a retry is pending.
 		Pending bool
+
+		// The amount of time actually slept before the pending retry. Only set
+		// when Pending is true.
+		Delay time.Duration
+
+		// Will be set if retries are enabled for the request but its body
+		// cannot be replayed, so it gets a single attempt. Bodies can be
+		// replayed when Request.GetBody is set or the body is an io.Seeker.
+		BodyNotReplayable bool
+
+		// Will be set if a retry would have been made but was skipped because
+		// the RetryBudgetRatio was exhausted.
+		BudgetExhausted bool
+
+		// Will be set if the attempt failed on a reused connection that had
+		// been closed by the server while idle, before the request was
+		// written to it. A retry on a fresh connection is then pending,
+		// regardless of the method and MaxTries.
+		StaleConn bool
+
+		// Will be set if a retry would have been made but was abandoned
+		// because it could not start before the deadline of the RoundTrip,
+		// from its context or the TotalTimeout, once backed off, or because
+		// backing off would exceed the MaxTotalBackoff.
+		Skipped bool
 	}
 }
 
@@ -65,18 +215,80 @@ func (s *Stats) String() string {
 // and http proxies (for either http or https with CONNECT). Transport can
 // cache connections for future re-use, provides various timeouts, retry logic
 // and the ability to track request statistics.
+//
+// Redirects are left to the http.Client, which makes a RoundTrip for each
+// request it follows, each with its own retries, and Stats.RedirectCount
+// tells them apart. The client only follows a 307 or 308 redirect of a
+// request with a body if Request.GetBody is set, as http.NewRequest does for
+// bodies in memory, and the retries after the redirect replay the body with
+// it too. When CheckRedirect returns http.ErrUseLastResponse the redirect is
+// returned like any other response. Its Request, a copy of the request made,
+// keeps the GetBody, or gets one for a body buffered by ForceContentLength,
+// so that the redirect can be followed with a fresh copy of the body.
 type Transport struct {
 
 	// Proxy specifies a function to return a proxy for a given
 	// *http.Request. If the function returns a non-nil error, the
 	// request is aborted with the provided error.
-	// If Proxy is nil or returns a nil *url.URL, no proxy is used.
+	// If Proxy is nil or returns a nil *url.URL, no proxy is used. SetProxyURL
+	// overrides it.
+	// SOCKS5 proxies are supported using socks5:// URLs, with authentication
+	// taken from the URL userinfo. HTTPS requests through http:// proxies use
+	// a CONNECT tunnel, authenticated the same way.
 	Proxy func(*http.Request) (*url.URL, error)
 
+	// ProxyConnect, if true, also tunnels plain HTTP requests through http://
+	// proxies using CONNECT, rather than having the proxy forward them. This
+	// allows reaching services the proxy only tunnels to, such as ones on
+	// non-standard ports.
+	ProxyConnect bool
+
+	// DynamicProxyEnv, if true and Proxy is nil, chooses the proxy for each
+	// request from the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment
+	// variables as they are at the time, rather than as they were when first
+	// read like http.ProxyFromEnvironment. Changes to the environment then
+	// take effect without restarting.
+	DynamicProxyEnv bool
+
 	// TLSClientConfig specifies the TLS configuration to use with
 	// tls.Client. If nil, the default configuration is used.
 	TLSClientConfig *tls.Config
 
+	// TLSConfigForHost, if non-nil, is called with the host name of each
+	// HTTPS request, as sent in the TLS handshake, and may return the TLS
+	// configuration to use with it instead of the TLSClientConfig, for
+	// example with a client certificate only one service asks for. A nil
+	// result falls back to the TLSClientConfig. The other TLS settings are
+	// merged into the configuration as into the TLSClientConfig. Connections
+	// are only pooled with those using the same configuration, so the same
+	// *tls.Config must be returned each time for a host.
+	TLSConfigForHost func(host string) *tls.Config
+
+	// MinTLSVersion, if non-zero, is the minimum TLS version to accept, for
+	// example tls.VersionTLS12. It is merged into TLSClientConfig, whose own
+	// MinVersion wins if both are set.
+	MinTLSVersion uint16
+
+	// CipherSuites, if non-empty, is the list of enabled TLS 1.0-1.2 cipher
+	// suites. It is merged into TLSClientConfig, whose own CipherSuites win if
+	// both are set.
+	CipherSuites []uint16
+
+	// TLSSessionCache, if true, gives the Transport its own TLS session cache
+	// so that reconnecting to a host resumes the previous session instead of
+	// doing a full handshake. Stats.TLS.DidResume reports whether it did. The
+	// cache is cleared by Close. A ClientSessionCache set in TLSClientConfig
+	// wins if both are set.
+	TLSSessionCache bool
+
+	// PinnedKeys, if non-empty, maps host names to the base64 encoded SHA-256
+	// hashes of the SubjectPublicKeyInfo of the certificates they may present.
+	// Connections to a listed host fail with ErrPinMismatch unless one of the
+	// certificates in the verified chain matches, or the leaf certificate if
+	// InsecureSkipVerify is set. Pinning is in addition to the regular
+	// certificate verification, unless InsecureSkipVerify is set.
+	PinnedKeys map[string][]string
+
 	// DisableKeepAlives, if true, prevents re-use of TCP connections
 	// between different HTTP requests.
 	DisableKeepAlives bool
@@ -91,17 +303,94 @@ type Transport struct {
 	// uncompressed.
 	DisableCompression bool
 
+	// ManualDecompression, if true, makes the Transport request compressed
+	// responses and decompress them itself, instead of the standard
+	// transport, so both the compressed and uncompressed sizes are known.
+	// It has no effect if DisableCompression is set.
+	ManualDecompression bool
+
+	// ExtraEncodings lists content encodings to request and decode in
+	// addition to gzip and deflate, such as "br" and "zstd". Their decoders
+	// must be registered with RegisterEncoding, which the httpcontrol/encodings
+	// package does for those two. It implies ManualDecompression.
+	ExtraEncodings []string
+
+	// Header holds default headers added to every request which does not
+	// already set them. Headers set by the caller take precedence.
+	Header http.Header
+
+	// RequestIDHeader, if non-empty, is the name of a header carrying a
+	// unique ID for each request. A random UUID is generated unless the
+	// caller already set the header, and is kept for retries. The ID is
+	// reported as Stats.RequestID.
+	RequestIDHeader string
+
+	// HostOverride maps the host of request URLs, with or without the port, to
+	// the Host header to send instead. This allows dialing one address while
+	// addressing a virtual host of another name, without changing every
+	// request. Requests whose Host already differs from their URL are left
+	// alone. The TLS server name is still taken from the URL, unless set by
+	// the ServerNameOverride.
+	HostOverride map[string]string
+
+	// ServerNameOverride maps the host of HTTPS request URLs, with or without
+	// the port, to the TLS server name to send and verify the certificate
+	// against. The address dialed and the Host header are unchanged, which
+	// allows reaching a named service by IP address, for example a canary.
+	// Connections are pooled by server name as well as by address.
+	// WithServerName sets it for a single request.
+	ServerNameOverride map[string]string
+
+	// SignRequest, if non-nil, is called with each attempt right before it is
+	// sent, once its headers are final, and may set headers such as a
+	// signature. Signing every attempt keeps the signatures of retries from
+	// expiring. The body must be left unread, GetBody provides a copy. An
+	// error fails the attempt, which may then be retried like any other.
+	SignRequest func(*http.Request) error
+
+	// EnableHTTP2, if true, negotiates HTTP/2 over TLS using ALPN. Otherwise
+	// HTTP/2 is disabled and requests always use HTTP/1.1.
+	EnableHTTP2 bool
+
 	// MaxIdleConnsPerHost, if non-zero, controls the maximum idle
 	// (keep-alive) to keep per-host.  If zero,
 	// http.DefaultMaxIdleConnsPerHost is used.
 	MaxIdleConnsPerHost int
 
+	// IdleConnTimeout, if non-zero, is the maximum amount of time an idle
+	// (keep-alive) connection will remain idle before closing itself. This
+	// avoids reusing connections silently dropped by load balancers. If zero,
+	// idle connections are kept indefinitely.
+	IdleConnTimeout time.Duration
+
+	// MaxConnsPerHost, if non-zero, limits the number of requests in flight,
+	// and thus of active connections, per host. Once reached, further attempts
+	// block until a slot frees up, the request context is done or the
+	// RequestTimeout expires. A slot is held until the response body is
+	// closed. Waiting attempts get the slots by priority, see WithPriority,
+	// then in the order they arrived.
+	MaxConnsPerHost int
+
+	// MaxConcurrentDials, if positive, limits the number of connections being
+	// dialed at once across all hosts, so a burst of requests on a cold
+	// Transport does not open a flood of connections. Dials wait their turn,
+	// bounded by the request context, and DialTimeout only applies once
+	// dialing starts. Connections already established are not limited.
+	MaxConcurrentDials int
+
 	// Dial connects to the address on the named network.
 	//
 	// See func Dial for a description of the network and address
 	// parameters.
 	Dial func(network, address string) (net.Conn, error)
 
+	// DialContext, if non-nil, connects to the address on the named network
+	// using the provided context, and takes precedence over Dial. It allows
+	// routing traffic over custom network stacks such as Unix sockets or in
+	// memory pipes. DialTimeout is applied to the context passed to it, and
+	// DialKeepAlive to the returned connection if it is a *net.TCPConn.
+	DialContext func(ctx context.Context, network, address string) (net.Conn, error)
+
 	// Timeout is the maximum amount of time a dial will wait for
 	// a connect to complete.
 	//
@@ -112,23 +401,160 @@ type Transport struct {
 	// often around 3 minutes.
 	DialTimeout time.Duration
 
+	// DialTimeoutJitter, if non-zero, adds a random duration of up to
+	// DialTimeoutJitter to the DialTimeout of each dial, so that dials started
+	// together against an unresponsive host do not all time out, and retry,
+	// together. It has no effect without a DialTimeout.
+	DialTimeoutJitter time.Duration
+
+	// ConnectJitter, if non-zero, delays each dial by a random duration of up
+	// to ConnectJitter, spreading out reconnections when many clients lose
+	// their connections to a shared upstream at once. Unlike the retry
+	// backoff it also applies to the first attempt. The delay is not part of
+	// the DialTimeout, but counts against the RequestTimeout.
+	ConnectJitter time.Duration
+
+	// RandFloat, if non-nil, is the source of the DialTimeoutJitter and the
+	// ConnectJitter instead of math/rand. Like rand.Float64 it returns numbers
+	// in [0, 1), and it must be safe for concurrent use. The backoff takes its
+	// own, see ExponentialBackoffRand.
+	RandFloat func() float64
+
+	// TLSHandshakeTimeout, if non-zero, specifies the maximum amount of time
+	// to wait for a TLS handshake, after which the attempt fails with
+	// ErrTLSHandshakeTimeout. If zero, DialTimeout is used.
+	TLSHandshakeTimeout time.Duration
+
 	// DialKeepAlive specifies the keep-alive period for an active
 	// network connection.
-	// If zero, keep-alives are not enabled. Network protocols
-	// that do not support keep-alives ignore this field.
+	// If zero, the default dialer enables keep-alives with the default
+	// period of the net package, and if negative they are not enabled.
+	// Network protocols that do not support keep-alives ignore this field.
 	DialKeepAlive time.Duration
 
+	// DialKeepAliveConfig, if Enable is set, configures TCP keep-alive probes
+	// in detail and takes precedence over DialKeepAlive: the idle time before
+	// the first probe, the interval between probes and how many unanswered
+	// probes drop the connection. Zero values use the defaults of the net
+	// package, and negative ones those of the operating system. Support
+	// varies by platform: Linux, the BSDs and macOS honor all three, while
+	// on older versions of Windows Idle and Interval can only be set together
+	// and Count is fixed. Unsupported settings are ignored.
+	DialKeepAliveConfig net.KeepAliveConfig
+
+	// LocalAddr, if non-nil, is the local address connections are made from
+	// by the default dialer, which allows choosing the network interface. It
+	// must be a *net.TCPAddr for an address of this host, otherwise every
+	// RoundTrip fails with an error describing the problem.
+	LocalAddr net.Addr
+
+	// DialControl, if non-nil, is called by the default dialer with every
+	// socket it creates, after creating it and before connecting, like
+	// net.Dialer.Control. It allows setting socket options such as
+	// SO_REUSEADDR, and an error aborts the dial. The options and how to set
+	// them through c depend on the platform: c.Control gives a file
+	// descriptor on Unix but a handle on Windows, and for example
+	// golang.org/x/sys provides the constants for each. With HappyEyeballs
+	// it may be called concurrently, once per address tried.
+	DialControl func(network, address string, c syscall.RawConn) error
+
+	// TCPNoDelay, if non-nil, sets TCP_NODELAY on TCP connections, which Go
+	// enables by default. Disabling it turns Nagle's algorithm back on, which
+	// coalesces small writes into fewer packets: that can help throughput of
+	// bulk uploads written in small pieces, at the cost of latency for small
+	// requests and responses. It is set once connected, after the
+	// DialControl, since Go enables it then.
+	TCPNoDelay *bool
+
+	// HappyEyeballs, if true, enables RFC 6555 style dual-stack dialing for
+	// hosts with both IPv4 and IPv6 addresses: the primary address family is
+	// dialed first, the other one after HappyEyeballsDelay, and the first
+	// connection to succeed is used. If false, addresses are dialed one after
+	// the other. It only applies when neither Dial nor DialContext is set,
+	// and with DNSCacheTTL it is the cached addresses that are raced.
+	HappyEyeballs bool
+
+	// HappyEyeballsDelay is the head start given to the primary address family
+	// when HappyEyeballs is enabled. If zero, a default of 300ms is used.
+	HappyEyeballsDelay time.Duration
+
+	// DNSCacheTTL, if non-zero, enables caching of resolved addresses per host
+	// for this long. Each dial starts from the next cached address in turn
+	// and tries the others if it fails, raced by family with HappyEyeballs,
+	// and the entry for a host is dropped when dialing all of its addresses
+	// fails. It only applies when neither Dial nor DialContext is set.
+	DNSCacheTTL time.Duration
+
 	// ResponseHeaderTimeout, if non-zero, specifies the amount of
 	// time to wait for a server's response headers after fully
 	// writing the request (including its body, if any). This
 	// time does not include the time to read the response body.
 	ResponseHeaderTimeout time.Duration
 
+	// StrictResponseHeaderTimeout makes the ResponseHeaderTimeout cover the
+	// response headers in full, including any informational responses.
+	// Otherwise it stops with the first byte of the response, and a server
+	// trickling the rest of its headers can hold the attempt indefinitely.
+	StrictResponseHeaderTimeout bool
+
+	// ResponseBodyTimeout, if non-zero, specifies the amount of time to wait
+	// for more of the response body to arrive while it is being read. The
+	// timeout restarts with every read, so it bounds stalls rather than the
+	// whole body. Reads fail with ErrResponseBodyTimeout when it fires.
+	ResponseBodyTimeout time.Duration
+
+	// MaxResponseHeaderBytes, if non-zero, limits the size of the response
+	// headers, as in http.Transport. Responses with larger headers fail with
+	// the error of the standard transport. Zero uses its default limit.
+	MaxResponseHeaderBytes int64
+
+	// MaxResponseBodyBytes, if non-zero, limits the size of response bodies.
+	// Reading past the limit fails with ErrBodyTooLarge.
+	MaxResponseBodyBytes int64
+
+	// ForceContentLength sends request bodies of unknown length, which would
+	// otherwise be chunked, with a Content-Length for servers that reject
+	// chunked uploads. Seekable bodies are measured, other bodies are read
+	// into memory first, which also makes them replayable for retries.
+	// Bodies longer than the MaxBufferedRequestBody are still sent chunked.
+	ForceContentLength bool
+
+	// MaxBufferedRequestBody bounds the request bodies read into memory for
+	// ForceContentLength. If zero, DefaultMaxBufferedRequestBody is used.
+	MaxBufferedRequestBody int64
+
+	// CompressRequestBody gzips the request bodies of at least
+	// CompressMinBytes and sends them with "Content-Encoding: gzip", for
+	// servers accepting compressed requests. Bodies are compressed once into
+	// memory, so they are replayable for retries. Requests which set their
+	// own Content-Encoding are sent as they are, and so are bodies of unknown
+	// length unless ForceContentLength finds it.
+	CompressRequestBody bool
+
+	// CompressMinBytes is the size from which request bodies are compressed
+	// for CompressRequestBody. If zero, DefaultCompressMinBytes is used.
+	CompressMinBytes int64
+
 	// RequestTimeout, if non-zero, specifies the amount of time for the entire
 	// request. This includes dialing (if necessary), the response header as well
-	// as the entire body.
+	// as the entire body by default, see RequestTimeoutCoversBody. It can be
+	// overridden for individual requests using WithRequestTimeout.
 	RequestTimeout time.Duration
 
+	// RequestTimeoutCoversBody, if non-nil, sets whether the RequestTimeout
+	// also covers reading the response body, which it does by default. When
+	// it does, reads of the body fail with ErrRequestTimeout once the
+	// RequestTimeout fires. Otherwise the RequestTimeout ends once the
+	// response headers are received, and ResponseBodyTimeout may still bound
+	// stalls of the body.
+	RequestTimeoutCoversBody *bool
+
+	// TotalTimeout, if non-zero, specifies the amount of time for the entire
+	// RoundTrip, including all retries and the waits between them, as well as
+	// reading the body of the final response. Each attempt is still bound by
+	// RequestTimeout. Once exceeded the request fails with ErrTotalTimeout.
+	TotalTimeout time.Duration
+
 	// RetryAfterTimeout, if true, will enable retries for a number of failures
 	// that are probably safe to retry for most cases but, depending on the
 	// context, might not be safe. Retried errors: net.Errors where Timeout()
@@ -138,37 +564,385 @@ type Transport struct {
 	// before the remote side was contacted.
 	RetryAfterTimeout bool
 
+	// RetryableError, if non-nil, decides whether a failed attempt may be
+	// retried, replacing the default IsRetryableError classification. It may
+	// call IsRetryableError to extend or restrict the default. Requests
+	// cancelled by the caller are never retried.
+	RetryableError func(err error) bool
+
+	// ShouldRetry, if non-nil, is called after each attempt with either the
+	// response or the error, or both for a response rejected by the
+	// ValidateResponse, and the count of the attempt starting at 0. It
+	// decides whether to retry, replacing RetryableError, RetryStatuses,
+	// MaxTries and the idempotency checks, so it is responsible for capping the
+	// number of attempts. Requests cancelled by the caller, or whose body
+	// cannot be replayed, are never retried. The response body is drained and
+	// closed before retrying, and must not be read by ShouldRetry.
+	ShouldRetry func(req *http.Request, resp *http.Response, err error, try int) bool
+
 	// MaxTries, if non-zero, specifies the number of times we will retry on
-	// failure. Retries are only attempted for temporary network errors or known
-	// safe failures.
+	// failure. Retries are only attempted for errors considered retryable by
+	// RetryableError, or IsRetryableError by default. WithMaxTries overrides
+	// it for a single request. UnlimitedTries retries until the TotalTimeout
+	// or the deadline of the request context, and fails requests with neither
+	// with ErrUnboundedRetries.
 	MaxTries uint
 
+	// RetryFreshConn makes retries dial a new connection rather than reuse
+	// one from the pool, which may share the broken path of the failed
+	// attempt. The connection is closed after the retry, and the Stats show
+	// ConnReused as false. The first attempt still uses the pool.
+	RetryFreshConn bool
+
+	// NoRetryHosts lists hosts whose requests are always made in a single
+	// attempt, regardless of MaxTries, ShouldRetry or HedgeDelay. An entry is
+	// a host name, such as "pay.example.com", or a pattern matching its
+	// subdomains, such as "*.example.com". It may include a port to only
+	// match that port. Matching is case-insensitive.
+	NoRetryHosts []string
+
+	// Failover, if non-nil, is called before each retry with the request and
+	// the number of the attempt to make, starting at 1, and may return a URL
+	// whose scheme and host replace those of the request for that attempt,
+	// such as the same service in another region. It returns nil to keep the
+	// URL of the request. Connections are pooled per host, so the attempt
+	// never reuses a connection to the host that failed. The circuit breaker
+	// and MaxConnsPerHost account the attempt against the new host.
+	Failover func(req *http.Request, try int) *url.URL
+
+	// RetryBackoff, if non-nil, is called with the count of the attempt that
+	// just failed (starting at 0) and returns the amount of time to wait before
+	// the next retry. If nil, retries are attempted immediately. The wait never
+	// exceeds RequestTimeout if one is set, and is cut short if the request is
+	// cancelled.
+	RetryBackoff func(try int) time.Duration
+
+	// Backoff, if non-nil, is used instead of RetryBackoff for strategies
+	// that depend on the previous delay, such as DecorrelatedJitter.
+	Backoff BackoffStrategy
+
+	// ValidateResponse, if non-nil, is called with each response once its
+	// headers are received. Returning an error fails the attempt, which is
+	// retried like responses with one of the RetryStatuses, and the error is
+	// returned if it is not. The body is only available to it when
+	// ValidateBodyBytes is set.
+	ValidateResponse func(*http.Response) error
+
+	// ValidateBodyBytes, if non-zero, is how much of the response body is
+	// buffered ahead for the ValidateResponse, which then sees only this
+	// prefix as the body. The caller still reads the whole body.
+	ValidateBodyBytes int64
+
+	// RetryStatuses, if non-empty, specifies HTTP status codes for which a
+	// response is eligible for a retry, for example []int{502, 503, 504}. The
+	// body of such a response is consumed and closed before retrying.
+	RetryStatuses []int
+
+	// RetryNonIdempotent, if true, allows retrying requests with methods that
+	// are not idempotent, such as POST. By default only GET, HEAD, OPTIONS,
+	// TRACE, PUT and DELETE requests are retried.
+	RetryNonIdempotent bool
+
+	// RetryOnlyBeforeWrite, if true, only retries attempts that failed before
+	// the request headers were written to the connection, such as failures to
+	// dial. The server cannot have seen such a request, so this applies to all
+	// methods, including non-idempotent ones regardless of
+	// RetryNonIdempotent. Failures after the headers were written, and
+	// responses with one of the RetryStatuses, are not retried. A ShouldRetry
+	// function takes precedence.
+	RetryOnlyBeforeWrite bool
+
+	// StrictRetry, if true, makes RoundTrip fail up front with
+	// ErrBodyNotReplayable for requests that could be retried but whose body
+	// cannot be replayed. Otherwise such requests get a single attempt, which
+	// is noted in Stats.Retry.BodyNotReplayable.
+	StrictRetry bool
+
+	// MaxRetryAfter, if non-zero, enables honoring the Retry-After header on
+	// responses with one of the RetryStatuses. The next attempt will wait at
+	// least as long as the header asks for, but never longer than this.
+	MaxRetryAfter time.Duration
+
+	// MaxTotalBackoff, if non-zero, bounds the time a request may spend
+	// backing off between its attempts, regardless of the time they take
+	// themselves. A retry whose delay would exceed it is skipped, even if
+	// MaxTries allows more. The total is reported as Summary.RetryDelay.
+	MaxTotalBackoff time.Duration
+
+	// HedgeDelay, if non-zero, enables hedging of requests using an
+	// idempotent method and without a body. If the response headers have not
+	// arrived within the delay a second copy of the request is sent, and the
+	// first successful response is used while the other copy is cancelled.
+	HedgeDelay time.Duration
+
+	// Coalesce enables sharing a single request between the concurrent GET
+	// requests without a body for the same URL and with the same
+	// Authorization and Cookie headers, such as during a cache stampede.
+	// The request of the first caller is sent, bound by the RequestTimeout
+	// and TotalTimeout but not by its context, and is only cancelled once
+	// all callers are gone. Its response body is buffered, bounded by the
+	// MaxResponseBodyBytes, and each caller gets a copy of the response.
+	// Stats and the like are delivered for the shared request only.
+	Coalesce bool
+
+	// CoalesceKey, if non-nil, returns a key that must also match for
+	// requests to be coalesced, such as a header that varies the response.
+	// The Authorization and Cookie headers must match regardless.
+	CoalesceKey func(*http.Request) string
+
+	// RetryBudgetRatio, if non-zero, limits retries across the Transport to
+	// this fraction of the successful attempts, so retries do not amplify an
+	// outage. For example 0.1 allows one retry per ten successes. A reserve
+	// of up to 10 retries can be banked, and is available initially. Retries
+	// skipped for lack of budget are reported in Stats.Retry.BudgetExhausted.
+	RetryBudgetRatio float64
+
+	// RateLimit, if non-zero, limits the rate of outgoing requests, including
+	// retries, to this many per second. Requests wait for their turn, unless
+	// that would take them past their deadline in which case they fail with
+	// ErrRateLimited.
+	RateLimit rate.Limit
+
+	// RateBurst is the maximum burst of requests allowed by RateLimit. If zero,
+	// a burst of 1 is used.
+	RateBurst int
+
+	// Limiter, if non-nil, is used instead of RateLimit and RateBurst. This
+	// allows sharing a limiter across multiple Transports.
+	Limiter *rate.Limiter
+
+	// CircuitThreshold, if non-zero, enables a circuit breaker per host. After
+	// this many consecutive failed attempts to a host, requests to it fail fast
+	// with ErrCircuitOpen for CircuitCooldown, after which a single probe
+	// request is let through. Failed attempts are those that resulted in an
+	// error or in one of the RetryStatuses, leaving out those failing before
+	// the host is contacted, such as with ErrRateLimited or a SignRequest
+	// error.
+	CircuitThreshold int
+
+	// CircuitWindow, if non-zero, is the period within which the consecutive
+	// failures must occur to open the circuit.
+	CircuitWindow time.Duration
+
+	// CircuitCooldown is the amount of time an open circuit fails requests
+	// before allowing a probe request through.
+	CircuitCooldown time.Duration
+
 	// Stats allows for capturing the result of a request and is useful for
 	// monitoring purposes.
 	Stats func(*Stats)
 
+	// Done, if non-nil, is called once for each RoundTrip after its last
+	// attempt, with a Summary covering all of them. For a successful
+	// RoundTrip this happens when the response body is closed.
+	Done func(*Summary)
+
+	// OnConnClose, if non-nil, is called whenever a connection is closed, with
+	// the address it was dialed to and the reason: "request-timeout",
+	// "response-header-timeout" or "response-body-timeout" when an attempt
+	// timed out while using it, "server-close" when the server closed it or
+	// it failed, "idle" when it was closed while idle in the pool, such as by
+	// the IdleConnTimeout or CloseIdleConnections, and "closed" otherwise,
+	// for example for a canceled request. It shows connections churning in
+	// a way the Stats of the requests do not.
+	OnConnClose func(addr, reason string)
+
+	// Tap, if non-nil, is called after each attempt that sent a request, once
+	// its response body is closed or it failed. With TapBodies the request
+	// body as sent and the response body as read by the caller are captured
+	// and passed along, otherwise they are nil. This is meant for debugging.
+	Tap func(req *http.Request, reqBody, respBody []byte)
+
+	// TapBodies enables capturing the bodies for the Tap. Capturing buffers
+	// up to TapMaxBytes of each body, so it is off by default.
+	TapBodies bool
+
+	// TapMaxBytes limits how much of each body is captured for the Tap, the
+	// rest being left out. It defaults to 64 KiB and never exceeds the
+	// MaxResponseBodyBytes.
+	TapMaxBytes int64
+
+	// Trace1xx, if non-nil, is called with each informational response
+	// received before the final response of an attempt, such as 103 Early
+	// Hints, whose links can be preloaded. The final response still sets
+	// Stats.TimeToFirstByte.
+	Trace1xx func(code int, header http.Header)
+
+	// Logger, if non-nil, is called after each attempt with the same Stats as
+	// the Stats function. Unlike Stats, which is meant for monitoring, Logger
+	// is meant for human readable audit logs. See NewTextLogger.
+	Logger Logger
+
+	// Warn, if non-nil, is called with a description of problems with the
+	// configuration, such as conflicting settings.
+	Warn func(message string)
+
+	// OnCallbackPanic, if non-nil, is called with the value recovered from a
+	// panic in a user function, which is logged with the standard logger by
+	// default. Panics in the Stats, Done, Tap, Trace1xx, OnConnClose, Warn
+	// functions, the Logger, a stats observer or an upload progress function
+	// never fail the request. A panicking ValidateResponse or SignRequest
+	// fails the attempt with ErrCallbackPanic, while ShouldRetry and
+	// RetryableError count as false, Failover and TLSConfigForHost as nil,
+	// CoalesceKey as empty and RetryBackoff and Backoff as no delay. Panics in
+	// the Proxy and dial functions, called by net/http, are not recovered.
+	OnCallbackPanic func(interface{})
+
+	clk       clock
 	startOnce sync.Once
+	startErr  error
+	base      http.RoundTripper // from Wrap
 	transport *http.Transport
+	freshOnce sync.Once
+	fresh     *http.Transport
+	hostMu    sync.Mutex
+	hostTLS   map[hostKey]*hostTransport
+	dialer    *net.Dialer
+	dnsCache  *dnsCache
+	sessions  *sessionCache
+	limiter   *rate.Limiter
+	dialSlots chan struct{} // for MaxConcurrentDials
+
+	observersMu sync.Mutex
+	observers   []func(*Stats)
+
+	proxyMu  sync.Mutex
+	proxySet bool
+	proxyURL *url.URL // from SetProxyURL
+
+	mu      sync.Mutex
+	cancels map[*http.Request]context.CancelCauseFunc
+	closed  bool
+	drained chan struct{}
+
+	circuitMu sync.Mutex
+	circuits  map[string]*circuit
+
+	connsMu sync.Mutex
+	conns   map[string]*hostConns
+
+	hostsMu sync.Mutex
+	hosts   map[string]*hostStat
+
+	poolMu     sync.Mutex
+	pool       map[*poolConn]struct{}
+	poolDials  uint64
+	poolReused uint64
+
+	budgetMu sync.Mutex
+	budget   retryBudget
+
+	flightsMu sync.Mutex
+	flights   map[string]*flight
 }
 
+// ErrTotalTimeout is returned when a request exceeds the TotalTimeout.
+var ErrTotalTimeout = errors.New("httpcontrol: total timeout exceeded")
+
+// UnlimitedTries is the MaxTries that retries for as long as the TotalTimeout
+// and the deadline of the request context allow, one of which must be set.
+// Retries still back off per RetryBackoff and the retry budget, and wait at
+// least MinUnlimitedBackoff so that a server that is down is not hammered.
+const UnlimitedTries = ^uint(0)
+
+// ErrUnboundedRetries is returned for a request with UnlimitedTries but
+// neither a TotalTimeout nor a deadline, which could be retried forever.
+var ErrUnboundedRetries = errors.New("httpcontrol: UnlimitedTries without a TotalTimeout or deadline")
+
+// MinUnlimitedBackoff is the least delay between the attempts of a request
+// with UnlimitedTries.
+const MinUnlimitedBackoff = 10 * time.Millisecond
+
+// ErrBodyTooLarge is returned when reading a response body larger than the
+// MaxResponseBodyBytes.
+var ErrBodyTooLarge = errors.New("httpcontrol: response body too large")
+
+// ErrBodyNotReplayable is returned with StrictRetry for requests that could be
+// retried but whose body cannot be replayed. Setting Request.GetBody fixes it.
+var ErrBodyNotReplayable = errors.New("httpcontrol: request body not replayable for retries")
+
+var errRequestCanceled = errors.New("httpcontrol: request canceled")
+
 var knownFailureSuffixes = []string{
 	syscall.ECONNREFUSED.Error(),
 	syscall.ECONNRESET.Error(),
 	syscall.ETIMEDOUT.Error(),
-	"no such host",
-	"remote error: handshake failure",
 	io.ErrUnexpectedEOF.Error(),
 	io.EOF.Error(),
 }
 
-func (t *Transport) shouldRetryError(err error) bool {
-	if neterr, ok := err.(net.Error); ok {
-		if neterr.Temporary() {
+var permanentFailureSuffixes = []string{
+	"no such host",
+}
+
+// IsRetryableError is the default classification of errors used to decide if
+// a failed attempt may be retried. Timeouts, refused or reset connections and
+// unexpected EOFs are retryable. Permanent failures such as unknown hosts and
+// certificate errors, including ErrPinMismatch, are not.
+func IsRetryableError(err error) bool {
+	if isPermanentError(err) {
+		return false
+	}
+	if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
+		return true
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ETIMEDOUT) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	s := err.Error()
+	for _, suffix := range knownFailureSuffixes {
+		if strings.HasSuffix(s, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+func isPermanentError(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return true
+	}
+	if errors.Is(err, ErrPinMismatch) {
+		return true
+	}
+	var (
+		verifyErr    *tls.CertificateVerificationError
+		authorityErr x509.UnknownAuthorityError
+		hostnameErr  x509.HostnameError
+		invalidErr   x509.CertificateInvalidError
+	)
+	if errors.As(err, &verifyErr) || errors.As(err, &authorityErr) ||
+		errors.As(err, &hostnameErr) || errors.As(err, &invalidErr) {
+		return true
+	}
+	s := err.Error()
+	for _, suffix := range permanentFailureSuffixes {
+		if strings.HasSuffix(s, suffix) {
 			return true
 		}
 	}
+	return false
+}
+
+func (t *Transport) shouldRetryError(err error) bool {
+	if errors.Is(err, context.Canceled) {
+		return false
+	}
+	if t.RetryableError != nil {
+		var retry bool
+		t.callback(func() { retry = t.RetryableError(err) })
+		return retry
+	}
+	if errors.Is(err, ErrRequestTimeout) {
+		return t.RetryAfterTimeout
+	}
 
-	if t.RetryAfterTimeout {
+	if t.RetryAfterTimeout && !isPermanentError(err) {
 		if neterr, ok := err.(net.Error); ok && neterr.Timeout() {
 			return true
 		}
@@ -191,113 +965,1017 @@ func (t *Transport) shouldRetryError(err error) bool {
 		}
 	}
 
-	s := err.Error()
-	for _, suffix := range knownFailureSuffixes {
-		if strings.HasSuffix(s, suffix) {
-			return true
-		}
-	}
-	return false
+	return IsRetryableError(err)
 }
 
 // Start the Transport.
 func (t *Transport) start() {
-	if t.Dial == nil {
-		dialer := &net.Dialer{
-			Timeout:   t.DialTimeout,
-			KeepAlive: t.DialKeepAlive,
-		}
-		t.Dial = dialer.Dial
+	t.startErr = t.checkEncodings()
+	if t.base != nil {
+		t.limiter = t.rateLimiter()
+		return
+	}
+	if t.TLSSessionCache {
+		t.sessions = newSessionCache()
 	}
 	t.transport = &http.Transport{
-		Dial:                  t.Dial,
-		Proxy:                 t.Proxy,
-		TLSClientConfig:       t.TLSClientConfig,
-		DisableKeepAlives:     t.DisableKeepAlives,
-		DisableCompression:    t.DisableCompression,
-		MaxIdleConnsPerHost:   t.MaxIdleConnsPerHost,
-		ResponseHeaderTimeout: t.ResponseHeaderTimeout,
+		TLSClientConfig:        t.tlsConfig(),
+		DisableKeepAlives:      t.DisableKeepAlives,
+		DisableCompression:     t.DisableCompression || t.manualDecompression(),
+		MaxIdleConnsPerHost:    t.MaxIdleConnsPerHost,
+		IdleConnTimeout:        t.IdleConnTimeout,
+		TLSHandshakeTimeout:    t.tlsHandshakeTimeout(),
+		MaxResponseHeaderBytes: t.MaxResponseHeaderBytes,
+	}
+	if t.EnableHTTP2 {
+		if err := http2.ConfigureTransport(t.transport); err != nil {
+			t.warn("failed to enable HTTP/2: " + err.Error())
+		}
+	} else {
+		t.transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	t.limiter = t.rateLimiter()
+	switch {
+	case t.DialContext != nil:
+		t.transport.DialContext = t.dialContext
+	case t.Dial == nil:
+		// Dialing with the request context allows the dial to be traced.
+		if err := t.checkLocalAddr(); t.startErr == nil {
+			t.startErr = err
+		}
+		t.dialer = t.newDialer()
+		t.transport.DialContext = t.dialer.DialContext
+		if t.DNSCacheTTL > 0 {
+			t.dnsCache = &dnsCache{
+				ttl:    t.DNSCacheTTL,
+				lookup: net.DefaultResolver.LookupIPAddr,
+			}
+			t.transport.DialContext = t.dialCached
+		}
 	}
+	dial := t.transport.DialContext
+	if dial == nil {
+		dial = func(ctx context.Context, network, address string) (net.Conn, error) {
+			return t.Dial(network, address)
+		}
+	} else if t.dialer != nil && t.DialTimeoutJitter != 0 {
+		dial = t.timedDial(dial)
+	}
+	if t.TCPNoDelay != nil {
+		dial = t.noDelayDial(dial)
+	}
+	dial = dialErrors(dial)
+	t.transport.Proxy = t.proxy
+	dial = t.tunnelDialer(dial)
+	if t.MaxConcurrentDials > 0 {
+		t.dialSlots = make(chan struct{}, t.MaxConcurrentDials)
+		dial = t.limitDial(dial)
+	}
+	if t.ConnectJitter > 0 {
+		dial = t.jitterDial(dial)
+	}
+	t.transport.DialContext = t.poolDialer(dial)
+}
+
+// Underlying returns the standard transport the Transport is built on, which
+// allows tuning settings that are not exposed by the Transport, such as the
+// buffer sizes. It is created on the first call using the configuration of the
+// Transport, which must not change afterwards. Modifying the returned
+// transport is only safe before the first request is made. It returns nil for
+// a Transport made by Wrap.
+func (t *Transport) Underlying() *http.Transport {
+	t.startOnce.Do(t.start)
+	return t.transport
 }
 
 // CloseIdleConnections closes the idle connections.
 func (t *Transport) CloseIdleConnections() {
 	t.startOnce.Do(t.start)
-	t.transport.CloseIdleConnections()
+	t.closeIdleConnections()
 }
 
 // CancelRequest cancels an in-flight request by closing its connection.
 func (t *Transport) CancelRequest(req *http.Request) {
-	t.startOnce.Do(t.start)
-	if bc, ok := req.Body.(*bodyCloser); ok {
+	if bc, ok := req.Body.(*bodyCloser); ok && bc.timer != nil {
 		bc.timer.Stop()
 	}
-	t.transport.CancelRequest(req)
+	t.mu.Lock()
+	cancel := t.cancels[req]
+	t.mu.Unlock()
+	if cancel != nil {
+		cancel(errRequestCanceled)
+	}
+}
+
+// track registers the function that cancels the RoundTrip for req. It fails
+// with ErrClosed once the Transport has been closed.
+func (t *Transport) track(req *http.Request, cancel context.CancelCauseFunc) error {
+	t.mu.Lock()
+	if t.closed {
+		t.mu.Unlock()
+		return ErrClosed
+	}
+	if t.cancels == nil {
+		t.cancels = make(map[*http.Request]context.CancelCauseFunc)
+	}
+	t.cancels[req] = cancel
+	t.mu.Unlock()
+	return nil
+}
+
+// untrack releases the RoundTrip for req once it is complete.
+func (t *Transport) untrack(req *http.Request) {
+	t.mu.Lock()
+	cancel := t.cancels[req]
+	delete(t.cancels, req)
+	if len(t.cancels) == 0 && t.drained != nil {
+		close(t.drained)
+		t.drained = nil
+	}
+	t.mu.Unlock()
+	if cancel != nil {
+		cancel(nil)
+	}
+}
+
+// roundTrip holds the state of a single RoundTrip across all of its attempts.
+type roundTrip struct {
+	ctx           context.Context
+	req           *http.Request
+	out           *http.Request // req with the default headers
+	requestID     string
+	serverName    string // the TLS server name, from the ServerNameOverride
+	decompress    bool
+	start         time.Time
+	timer         clockTimer
+	bodyOffset    int64
+	closeBody     bool
+	bytesSent     int64
+	bytesReceived int64
+	errs          []error // the first error and the latest 9, see fail
+	failures      int     // attempts failed or retried
+	notReplayable bool
+	staleRetried  bool          // retried after a staleConn
+	backoff       time.Duration // last delay from the Backoff
+	fresh         bool          // the next attempt must not reuse a pooled connection
+	tries         int32         // attempts made, on the root
+	delayed       int64         // time spent in backoff, on the root
+	summarized    int32
+
+	// Set for ForceContentLength and CompressRequestBody.
+	getBody       func() (io.ReadCloser, error) // copies of the buffered body
+	unbuffered    io.ReadCloser                 // the body too long to be buffered
+	contentLength int64
+	compressed    bool // getBody returns the gzipped body
+
+	// Set for the copies of a hedged request, which share the RoundTrip of
+	// their parent.
+	parent *roundTrip
+	cancel context.CancelCauseFunc
+	hedge  bool  // the copy sent after the HedgeDelay
+	winner bool  // the copy whose response was returned
+	copies int32 // copies launched, on the parent
+}
+
+// maxRetryErrors is the number of attempt errors kept for the RetryError.
+const maxRetryErrors = 10
+
+// fail records the error of a failed or retried attempt. Only the first error
+// and the latest maxRetryErrors-1 are kept, dropping the oldest but the first
+// as new ones arrive, so that a request retried for long does not hold on to
+// all of them. The failures still count every attempt.
+func (rt *roundTrip) fail(err error) {
+	rt.failures++
+	if len(rt.errs) == maxRetryErrors {
+		rt.errs = append(rt.errs[:1], rt.errs[2:]...)
+	}
+	rt.errs = append(rt.errs, err)
+}
+
+// attempt holds the state of a single attempt of a RoundTrip.
+type attempt struct {
+	try             uint
+	startTime       time.Time
+	headerTime      time.Time
+	trace           *attemptTrace
+	sent            *countingBody
+	received        *countingBody
+	uncompressed    *countingBody
+	encoding        string // decoded by the Transport
+	tapReq          *tapBody
+	tapRes          *tapBody
+	circuit         bool
+	notReplayable   bool
+	budgetExhausted bool
+	retrySkipped    bool
+	fresh           bool // must not reuse a pooled connection
+	staleConn       bool
+	connWait        time.Duration
+	timer           clockTimer
+	headerTimer     *headerTimer
+	ctx             context.Context
+	cancel          context.CancelCauseFunc
+	conn            *poolConn // guarded by the poolMu
+	release         func()
+	hostDone        func()
+}
+
+// finish releases the resources held by the attempt.
+func (a *attempt) finish() {
+	if a.timer != nil {
+		a.timer.Stop()
+	}
+	if a.headerTimer != nil {
+		a.headerTimer.stop()
+	}
+	a.cancel(nil)
+	if a.release != nil {
+		a.release()
+		a.release = nil
+	}
+	if a.hostDone != nil {
+		a.hostDone()
+		a.hostDone = nil
+	}
+}
+
+// stats returns the Stats for the attempt, and accounts the bytes it
+// transferred to the RoundTrip.
+func (rt *roundTrip) stats(a *attempt, res *http.Response, err error) *Stats {
+	stats := &Stats{
+		Request:  rt.req,
+		Response: res,
+		Error:    err,
+	}
+	stats.OriginalRequest, stats.RedirectCount = redirectChain(rt.req)
+	stats.RequestID = rt.requestID
+	stats.Tags = copyTags(statsTags(rt.req.Context()))
+	if rt.parent != nil {
+		stats.Hedge.Hedged = rt.hedge
+		stats.Hedge.Copies = int(atomic.LoadInt32(&rt.parent.copies))
+	}
+	stats.Duration.Header = a.headerTime.Sub(a.startTime)
+	stats.Retry.Count = a.try
+	a.trace.fill(stats)
+	stats.Timing.ConnWait = a.connWait
+	if stats.TLS == nil && res != nil {
+		stats.TLS = res.TLS
+	}
+	if res != nil {
+		if res.ProtoMajor == 2 {
+			stats.Protocol = "h2"
+		} else {
+			stats.Protocol = "http/1.1"
+		}
+	}
+	stats.CircuitOpen = a.circuit
+	var pce *ProxyConnectError
+	stats.ProxyError = errors.As(err, &pce)
+	stats.Retry.BodyNotReplayable = a.notReplayable || rt.root().notReplayable
+	stats.Retry.StaleConn = a.staleConn
+	stats.Retry.BudgetExhausted = a.budgetExhausted
+	stats.Retry.Skipped = a.retrySkipped
+	stats.Attempt.BytesSent = a.sent.count()
+	stats.Attempt.BytesReceived = a.received.count()
+	stats.UncompressedBytes = stats.Attempt.BytesReceived
+	if a.uncompressed != nil {
+		stats.UncompressedBytes = a.uncompressed.count()
+		stats.ContentEncoding = a.encoding
+	}
+	rt.bytesSent += stats.Attempt.BytesSent
+	rt.bytesReceived += stats.Attempt.BytesReceived
+	stats.BytesSent = rt.bytesSent
+	stats.BytesReceived = rt.bytesReceived
+	return stats
+}
+
+// redirectChain returns the first request of the redirect chain leading to
+// req and the number of redirects followed. The http.Client sets the Response
+// of each follow-up request to the redirect response which caused it.
+func redirectChain(req *http.Request) (*http.Request, int) {
+	var count int
+	for req.Response != nil && req.Response.Request != nil {
+		req = madeRequest(req.Response.Request)
+		count++
+	}
+	return req, count
+}
+
+// reporting reports whether Stats need to be collected.
+func (t *Transport) reporting() bool {
+	return t.Stats != nil || t.Logger != nil || len(t.statsObservers()) != 0
+}
+
+// AddStatsObserver registers a function to be called with the Stats of each
+// attempt, like the Stats function. This allows independent consumers to
+// share the Transport. Observers are called in the order they were added,
+// after the Stats function. It is safe to call concurrently with requests.
+func (t *Transport) AddStatsObserver(observer func(*Stats)) {
+	t.observersMu.Lock()
+	defer t.observersMu.Unlock()
+	// Copied on write so reporting can use the slice without the lock.
+	observers := make([]func(*Stats), len(t.observers), len(t.observers)+1)
+	copy(observers, t.observers)
+	t.observers = append(observers, observer)
+}
+
+func (t *Transport) statsObservers() []func(*Stats) {
+	t.observersMu.Lock()
+	defer t.observersMu.Unlock()
+	return t.observers
+}
+
+// report delivers the stats to the Stats function, the observers and the
+// Logger.
+func (t *Transport) report(stats *Stats) {
+	if t.Stats != nil {
+		t.callback(func() { t.Stats(stats) })
+	}
+	for _, observer := range t.statsObservers() {
+		t.callback(func() { observer(stats) })
+	}
+	if t.Logger != nil {
+		t.callback(func() { t.Logger.Log(stats) })
+	}
+}
+
+// trace1xx returns the Trace1xx guarded against panics, or nil.
+func (t *Transport) trace1xx() func(code int, header http.Header) {
+	if t.Trace1xx == nil {
+		return nil
+	}
+	return func(code int, header http.Header) {
+		t.callback(func() { t.Trace1xx(code, header) })
+	}
+}
+
+func (t *Transport) warn(message string) {
+	if t.Warn != nil {
+		t.callback(func() { t.Warn(message) })
+	}
+}
+
+// tries makes the attempts for the request within the RoundTrip context,
+// until one is not retried.
+func (t *Transport) tries(rt *roundTrip) (*http.Response, error) {
+	for try := uint(0); ; try++ {
+		res, retry, err := t.tryOnce(rt, try)
+		if !retry {
+			return res, err
+		}
+	}
 }
 
-func (t *Transport) tries(req *http.Request, try uint) (*http.Response, error) {
-	startTime := time.Now()
-	var timer *time.Timer
-	if t.RequestTimeout != 0 {
-		timer = time.AfterFunc(t.RequestTimeout, func() {
-			t.CancelRequest(req)
+// tryOnce makes the attempt try for the request, and reports whether it is to
+// be retried, once it has waited for the backoff. Each attempt gets its own
+// context derived from the RoundTrip context, which is also bound by
+// RequestTimeout. The effective deadline of an attempt is thus the earlier of
+// the request context deadline and RequestTimeout.
+func (t *Transport) tryOnce(rt *roundTrip, try uint) (*http.Response, bool, error) {
+	ctx, req := rt.ctx, rt.req
+	a := &attempt{
+		try:       try,
+		startTime: t.clock().Now(),
+		trace:     &attemptTrace{start: time.Now(), on1xx: t.trace1xx()},
+		fresh:     rt.fresh || t.RetryFreshConn && try > 0,
+	}
+	rt.fresh = false
+	atomic.AddInt32(&rt.root().tries, 1)
+	host := req.URL.Host
+	target := t.failoverURL(req, try)
+	if target != nil {
+		host = target.Host
+	}
+	if !t.circuitAllow(host) {
+		a.headerTime = a.startTime
+		a.circuit = true
+		if t.reporting() {
+			t.report(rt.stats(a, nil, ErrCircuitOpen))
+		}
+		rt.fail(ErrCircuitOpen)
+		return nil, false, ErrCircuitOpen
+	}
+	attemptCtx, cancel := context.WithCancelCause(ctx)
+	cancel = t.closeReasonCancel(a, cancel)
+	a.ctx, a.cancel = attemptCtx, cancel
+	deadline, _ := ctx.Deadline()
+	if timeout := t.requestTimeout(ctx); timeout != 0 {
+		a.timer = t.clock().AfterFunc(timeout, func() {
+			cancel(ErrRequestTimeout)
 		})
+		if d := a.startTime.Add(timeout); deadline.IsZero() || d.Before(deadline) {
+			deadline = d
+		}
+	}
+	outCtx := t.withPoolTrace(a.trace.withTrace(attemptCtx), a)
+	if t.dialSlots != nil {
+		outCtx = context.WithValue(outCtx, dialWaitKey, a.trace)
+	}
+	if t.transport != nil && t.transport.Proxy != nil {
+		outCtx = withTunnel(outCtx)
+	}
+	if t.ResponseHeaderTimeout > 0 {
+		a.headerTimer = newHeaderTimer(t.clock(), t.ResponseHeaderTimeout, t.StrictResponseHeaderTimeout, cancel)
+		outCtx = a.headerTimer.withTrace(outCtx)
+	}
+	out := rt.out.WithContext(outCtx)
+	if rt.getBody != nil {
+		// A SignRequest hashing the body reads it from the copy.
+		out.GetBody = rt.getBody
+	}
+	if rt.contentLength > 0 {
+		out.ContentLength = rt.contentLength
+	}
+	if target != nil {
+		retarget(out, req, target)
+	}
+	if req.Body != nil && req.Body != http.NoBody {
+		body, err := rt.body(try)
+		if err != nil {
+			a.finish()
+			t.record(host, circuitIgnore)
+			a.headerTime = t.clock().Now()
+			if t.reporting() {
+				t.report(rt.stats(a, nil, err))
+			}
+			rt.fail(err)
+			return nil, false, err
+		}
+		if t.tapping() {
+			a.tapReq = t.newTapBody(body)
+			body = a.tapReq
+		}
+		a.sent = &countingBody{ReadCloser: body}
+		if progress := uploadProgress(ctx); progress != nil {
+			a.sent.total = out.ContentLength
+			if a.sent.total <= 0 {
+				a.sent.total = -1
+			}
+			a.sent.progress = func(sent, total int64) {
+				t.callback(func() { progress(sent, total) })
+			}
+			if try > 0 {
+				a.sent.progress(0, a.sent.total)
+			}
+		}
+		out.Body = a.sent
+	}
+	var res *http.Response
+	var err error
+	var sent bool
+	a.hostDone = t.hostStart(host)
+	a.connWait, a.release, err = t.acquireConn(attemptCtx, host)
+	if err == nil {
+		err = t.waitRate(attemptCtx, deadline)
+	}
+	if err == nil {
+		err = t.chooseTunnel(out)
+	}
+	if err == nil && t.SignRequest != nil {
+		err = t.sign(out)
+	}
+	if err == nil {
+		sent = true
+		res, err = t.roundTripper(out, rt.serverName, a.fresh).RoundTrip(out)
+	}
+	a.headerTime = t.clock().Now()
+	if a.headerTimer != nil {
+		a.headerTimer.stop()
 	}
-	res, err := t.transport.RoundTrip(req)
-	headerTime := time.Now()
 	if err != nil {
-		if timer != nil {
-			timer.Stop()
+		a.finish()
+		a.staleConn = ctx.Err() == nil && t.staleConn(rt, a, err)
+		if isTLSHandshakeTimeout(err) {
+			err = ErrTLSHandshakeTimeout
+		}
+		if context.Cause(attemptCtx) == errResponseHeaderTimeout {
+			err = errResponseHeaderTimeout
+		}
+		err = a.timeoutError(err)
+		if ctx.Err() != nil {
+			err = context.Cause(ctx)
+			a.circuit = t.record(host, circuitIgnore)
+		} else if a.staleConn || !sent {
+			// Failing before the host was contacted, such as when rate
+			// limited or signing, says nothing about the host.
+			a.circuit = t.record(host, circuitIgnore)
+		} else {
+			a.circuit = t.record(host, circuitFailure)
+		}
+		rt.fail(err)
+		t.tap(req, a)
+		retry := a.staleConn || ctx.Err() == nil && t.shouldRetry(rt, a, nil, err)
+		var delay time.Duration
+		if a.staleConn {
+			rt.staleRetried, rt.fresh = true, true
+		} else if retry {
+			delay, retry = t.retryDelay(rt, a, try, 0)
 		}
 		var stats *Stats
-		if t.Stats != nil {
-			stats = &Stats{
-				Request:  req,
-				Response: res,
-				Error:    err,
-			}
-			stats.Duration.Header = headerTime.Sub(startTime)
-			stats.Retry.Count = try
+		if t.reporting() {
+			stats = rt.stats(a, res, err)
 		}
 
-		if try < t.MaxTries && req.Method == "GET" && t.shouldRetryError(err) {
-			if t.Stats != nil {
-				stats.Retry.Pending = true
-				t.Stats(stats)
+		if retry {
+			slept, ok := t.backoff(ctx, rt, req, delay)
+			if ok {
+				if t.reporting() {
+					stats.Retry.Pending = true
+					stats.Retry.Delay = slept
+					t.report(stats)
+				}
+				return nil, true, nil
+			}
+			err = canceled(ctx)
+			if t.reporting() {
+				stats.Error = err
 			}
-			return t.tries(req, try+1)
 		}
 
-		if t.Stats != nil {
-			t.Stats(stats)
+		if t.reporting() {
+			t.report(stats)
 		}
-		return nil, err
+		return nil, false, err
+	}
+	res.Request = req
+	a.trace.gotResponse()
+	if a.timer != nil && t.RequestTimeoutCoversBody != nil && !*t.RequestTimeoutCoversBody {
+		a.timer.Stop()
+		a.timer = nil
+	}
+	a.received = &countingBody{ReadCloser: res.Body}
+	res.Body = a.received
+	if rt.decompress {
+		if a.encoding = t.decompress(res); a.encoding != "" {
+			a.uncompressed = &countingBody{ReadCloser: res.Body}
+			res.Body = a.uncompressed
+		}
+	}
+	if t.MaxResponseBodyBytes > 0 {
+		// Also bounds draining the body of a response that is retried.
+		res.Body = &limitedBody{ReadCloser: res.Body, remaining: t.MaxResponseBodyBytes}
+	}
+	if t.tapping() {
+		a.tapRes = t.newTapBody(res.Body)
+		res.Body = a.tapRes
+	}
+	if t.ResponseBodyTimeout > 0 {
+		res.Body = newStallBody(t.clock(), res.Body, t.ResponseBodyTimeout, a.cancel)
+	}
+	var invalid error
+	if t.ValidateResponse != nil {
+		invalid = t.validate(res)
+	}
+	if invalid != nil || t.shouldRetryStatus(res.StatusCode) {
+		a.circuit = t.record(host, circuitFailure)
+	} else {
+		a.circuit = t.record(host, circuitSuccess)
+	}
+
+	retry := t.shouldRetry(rt, a, res, invalid)
+	var delay time.Duration
+	if retry {
+		delay, retry = t.retryDelay(rt, a, try, t.retryAfter(res, a.headerTime))
+	}
+	if retry {
+		io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+		a.finish()
+		t.tap(req, a)
+		if invalid != nil {
+			rt.fail(invalid)
+		} else {
+			rt.fail(&StatusError{
+				StatusCode: res.StatusCode,
+				Status:     res.Status,
+			})
+		}
+		var stats *Stats
+		if t.reporting() {
+			stats = rt.stats(a, res, invalid)
+		}
+		slept, ok := t.backoff(ctx, rt, req, delay)
+		if !ok {
+			err = canceled(ctx)
+			if t.reporting() {
+				stats.Error = err
+				t.report(stats)
+			}
+			return nil, false, err
+		}
+		if t.reporting() {
+			stats.Retry.Pending = true
+			stats.Retry.Delay = slept
+			t.report(stats)
+		}
+		return nil, true, nil
+	}
+	if invalid != nil {
+		res.Body.Close()
+		a.finish()
+		t.tap(req, a)
+		rt.fail(invalid)
+		if t.reporting() {
+			t.report(rt.stats(a, res, invalid))
+		}
+		return nil, false, invalid
 	}
 
 	res.Body = &bodyCloser{
 		ReadCloser: res.Body,
-		timer:      timer,
+		timer:      a.timer,
 		res:        res,
 		transport:  t,
-		startTime:  startTime,
-		headerTime: headerTime,
+		rt:         rt,
+		attempt:    a,
 	}
-	return res, nil
+	return res, false, nil
+}
+
+// replayable reports whether the request body can be sent again, either
+// because there is none, Request.GetBody is set or the body is an io.Seeker.
+func (rt *roundTrip) replayable() bool {
+	body := rt.req.Body
+	if body == nil || body == http.NoBody || rt.req.GetBody != nil || rt.getBody != nil {
+		return true
+	}
+	_, ok := body.(io.Seeker)
+	return ok
+}
+
+// body returns the request body to send for the given try. The first attempt
+// sends the original body, later ones get a fresh copy from Request.GetBody or
+// rewind a seekable body. Seekable bodies are protected from being closed by
+// the underlying transport, and closed once the RoundTrip is done instead.
+// Bodies buffered for ForceContentLength are sent from the buffer.
+func (rt *roundTrip) body(try uint) (io.ReadCloser, error) {
+	req := rt.req
+	if rt.getBody != nil {
+		return rt.getBody()
+	}
+	if try == 0 && rt.unbuffered != nil {
+		return rt.unbuffered, nil
+	}
+	if req.GetBody != nil {
+		if try == 0 {
+			return req.Body, nil
+		}
+		return req.GetBody()
+	}
+	seeker, ok := req.Body.(io.Seeker)
+	if !ok {
+		return req.Body, nil
+	}
+	if try == 0 {
+		offset, err := seeker.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		rt.bodyOffset = offset
+		rt.closeBody = true
+	} else if _, err := seeker.Seek(rt.bodyOffset, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(req.Body), nil
+}
+
+// done releases the resources of the RoundTrip once it is complete.
+func (t *Transport) done(rt *roundTrip) {
+	if rt.parent != nil {
+		rt.cancel(nil)
+		if rt.winner {
+			t.done(rt.parent)
+		}
+		return
+	}
+	if rt.timer != nil {
+		rt.timer.Stop()
+	}
+	t.untrack(rt.req)
+	if rt.closeBody {
+		rt.req.Body.Close()
+	}
+}
+
+// canceled returns the error for a RoundTrip that was cancelled between
+// attempts.
+func canceled(ctx context.Context) error {
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+	return errRequestCanceled
+}
+
+// shouldRetry decides whether to retry after an attempt that returned either
+// res or err.
+func (t *Transport) shouldRetry(rt *roundTrip, a *attempt, res *http.Response, err error) bool {
+	if t.singleAttempt(rt.req) {
+		return false
+	}
+	if t.ShouldRetry != nil {
+		var retry bool
+		t.callback(func() { retry = t.ShouldRetry(rt.req, res, err, int(a.try)) })
+		if !retry {
+			return false
+		}
+		if !rt.replayable() {
+			a.notReplayable = true
+			return false
+		}
+		return t.withdrawRetry(a)
+	}
+	if res != nil && err != nil {
+		// The response was rejected by the ValidateResponse.
+		return t.retryable(rt, a)
+	}
+	if err != nil {
+		return t.shouldRetryError(err) && t.retryable(rt, a)
+	}
+	return t.shouldRetryStatus(res.StatusCode) && t.retryable(rt, a)
+}
+
+// retryable reports whether the attempt may be followed by a retry, noting in
+// the attempt when it is only prevented by the request body.
+func (t *Transport) retryable(rt *roundTrip, a *attempt) bool {
+	tries := t.maxTries(rt.ctx)
+	if rt.staleRetried && tries != UnlimitedTries {
+		tries++
+	}
+	if a.try >= tries {
+		return false
+	}
+	if t.RetryOnlyBeforeWrite {
+		if a.trace.wrote() {
+			return false
+		}
+	} else if !t.canRetry(rt.req) {
+		return false
+	}
+	if !rt.replayable() {
+		a.notReplayable = true
+		return false
+	}
+	return t.withdrawRetry(a)
+}
+
+// retriesEnabled reports whether the request could be retried at all.
+func (t *Transport) retriesEnabled(rt *roundTrip) bool {
+	if t.singleAttempt(rt.req) {
+		return false
+	}
+	return t.ShouldRetry != nil ||
+		(t.maxTries(rt.ctx) > 0 && (t.RetryOnlyBeforeWrite || t.canRetry(rt.req)))
+}
+
+// withdrawRetry takes a retry from the budget, noting in the attempt when it
+// is exhausted.
+func (t *Transport) withdrawRetry(a *attempt) bool {
+	if !t.retryBudgetWithdraw() {
+		a.budgetExhausted = true
+		return false
+	}
+	return true
+}
+
+// canRetry reports whether the method of the request allows sending it again.
+func (t *Transport) canRetry(req *http.Request) bool {
+	return t.RetryNonIdempotent || idempotent(req.Method)
+}
+
+// idempotent reports whether requests with the method can safely be sent more
+// than once.
+func idempotent(method string) bool {
+	switch method {
+	case "", "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+		return true
+	}
+	return false
+}
+
+func (t *Transport) shouldRetryStatus(code int) bool {
+	for _, s := range t.RetryStatuses {
+		if s == code {
+			return true
+		}
+	}
+	return false
+}
+
+// retryAfter returns the wait requested by the Retry-After header of the
+// response, capped at MaxRetryAfter. It is zero if MaxRetryAfter is not set or
+// the header is missing or invalid.
+func (t *Transport) retryAfter(res *http.Response, now time.Time) time.Duration {
+	if t.MaxRetryAfter == 0 {
+		return 0
+	}
+	wait, ok := parseRetryAfter(res.Header.Get("Retry-After"), now)
+	if !ok {
+		return 0
+	}
+	if wait > t.MaxRetryAfter {
+		return t.MaxRetryAfter
+	}
+	return wait
+}
+
+// parseRetryAfter parses the value of a Retry-After header, which may be
+// either a number of seconds or an HTTP-date.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	if wait := date.Sub(now); wait > 0 {
+		return wait, true
+	}
+	return 0, true
+}
+
+// retryDelay returns the delay before the retry following the attempt, the
+// larger of the Backoff or RetryBackoff duration for its try and min. It
+// reports false, noting it in the attempt, if the retry could not start before
+// the deadline of the RoundTrip, in which case the retry taken from the budget
+// is returned.
+func (t *Transport) retryDelay(rt *roundTrip, a *attempt, try uint, min time.Duration) (time.Duration, bool) {
+	delay := min
+	if t.Backoff != nil {
+		var d time.Duration
+		t.callback(func() { d = t.Backoff.Backoff(int(try), rt.backoff) })
+		rt.backoff = d
+		if d > delay {
+			delay = d
+		}
+	} else if t.RetryBackoff != nil {
+		var d time.Duration
+		t.callback(func() { d = t.RetryBackoff(int(try)) })
+		if d > delay {
+			delay = d
+		}
+	}
+	if t.maxTries(rt.ctx) == UnlimitedTries && delay < MinUnlimitedBackoff {
+		delay = MinUnlimitedBackoff
+	}
+	if timeout := t.requestTimeout(rt.ctx); timeout != 0 && delay > timeout {
+		delay = timeout
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	if t.MaxTotalBackoff != 0 {
+		if delayed := time.Duration(atomic.LoadInt64(&rt.root().delayed)); delayed+delay > t.MaxTotalBackoff {
+			a.retrySkipped = true
+			t.retryBudgetRefund()
+			return 0, false
+		}
+	}
+	deadline, _ := rt.ctx.Deadline()
+	if t.TotalTimeout != 0 {
+		if d := rt.root().start.Add(t.TotalTimeout); deadline.IsZero() || d.Before(deadline) {
+			deadline = d
+		}
+	}
+	if !deadline.IsZero() && !t.clock().Now().Add(delay).Before(deadline) {
+		a.retrySkipped = true
+		t.retryBudgetRefund()
+		return 0, false
+	}
+	return delay, true
+}
+
+// backoff sleeps for delay before a retry. It returns the time actually slept
+// and false if the request was cancelled, or its context done, while waiting.
+func (t *Transport) backoff(ctx context.Context, rt *roundTrip, req *http.Request, delay time.Duration) (time.Duration, bool) {
+	if delay <= 0 {
+		return 0, true
+	}
+	clock := t.clock()
+	start := clock.Now()
+	var ok bool
+	select {
+	case <-clock.After(delay):
+		ok = true
+	case <-ctx.Done():
+	case <-req.Cancel:
+	}
+	slept := clock.Now().Sub(start)
+	atomic.AddInt64(&rt.root().delayed, int64(slept))
+	return slept, ok
 }
 
 // RoundTrip implements the RoundTripper interface.
 func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
 	t.startOnce.Do(t.start)
-	return t.tries(req, 0)
+	if t.startErr != nil {
+		return nil, t.startErr
+	}
+	if err := req.Context().Err(); err != nil {
+		return nil, err
+	}
+	if t.coalescing(req) {
+		return t.coalesce(req)
+	}
+	return t.do(req)
+}
+
+// do makes the RoundTrip for req.
+func (t *Transport) do(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancelCause(req.Context())
+	if err := t.track(req, cancel); err != nil {
+		cancel(nil)
+		return nil, err
+	}
+	if _, ok := ctx.Deadline(); !ok && t.TotalTimeout == 0 && t.maxTries(ctx) == UnlimitedTries {
+		t.untrack(req)
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return nil, ErrUnboundedRetries
+	}
+	rt := &roundTrip{ctx: ctx, req: req, start: t.clock().Now()}
+	err := t.forceContentLength(rt)
+	if err == nil {
+		err = t.compressBody(rt)
+	}
+	if err != nil {
+		t.untrack(req)
+		req.Body.Close()
+		return nil, err
+	}
+	if t.retriesEnabled(rt) && !rt.replayable() {
+		if t.StrictRetry {
+			t.untrack(req)
+			req.Body.Close()
+			return nil, ErrBodyNotReplayable
+		}
+		rt.notReplayable = true
+	}
+	rt.out, rt.decompress = t.outgoing(req)
+	if rt.compressed {
+		rt.setContentEncoding()
+	}
+	t.overrideServerName(rt)
+	if t.RequestIDHeader != "" {
+		rt.requestID = rt.out.Header.Get(t.RequestIDHeader)
+	}
+	if t.TotalTimeout != 0 {
+		rt.timer = t.clock().AfterFunc(t.TotalTimeout, func() {
+			cancel(ErrTotalTimeout)
+		})
+	}
+	var res *http.Response
+	if t.hedging(req) {
+		res, err = t.hedge(rt)
+	} else {
+		res, err = t.tries(rt)
+	}
+	if err != nil {
+		t.done(rt)
+		if rt.failures > 1 {
+			err = &RetryError{Err: err, Attempts: rt.failures, Errors: rt.errs}
+		}
+		t.summarize(rt, nil, err)
+		return nil, err
+	}
+	res.Request = withAttempts(res.Request, rt.attempts())
+	if res.Request.GetBody == nil && rt.getBody != nil && !rt.compressed {
+		// The copy can be sent again, such as to the Location of a redirect.
+		res.Request.GetBody = rt.getBody
+	}
+	return res, nil
 }
 
 type bodyCloser struct {
 	io.ReadCloser
-	timer      *time.Timer
-	res        *http.Response
-	transport  *Transport
-	startTime  time.Time
-	headerTime time.Time
+	timer     clockTimer
+	res       *http.Response
+	transport *Transport
+	rt        *roundTrip
+	attempt   *attempt
+
+	mu      sync.Mutex
+	readErr error // the error that ended reading the body, other than io.EOF
+}
+
+func (b *bodyCloser) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	err = b.attempt.timeoutError(err)
+	if err != nil && err != io.EOF {
+		b.mu.Lock()
+		if b.readErr == nil {
+			b.readErr = err
+		}
+		b.mu.Unlock()
+	}
+	return n, err
 }
 
 func (b *bodyCloser) Close() error {
@@ -305,20 +1983,158 @@ func (b *bodyCloser) Close() error {
 		b.timer.Stop()
 	}
 	err := b.ReadCloser.Close()
-	closeTime := time.Now()
-	if b.transport.Stats != nil {
-		stats := &Stats{
-			Request:  b.res.Request,
-			Response: b.res,
-		}
-		stats.Duration.Header = b.headerTime.Sub(b.startTime)
-		stats.Duration.Body = closeTime.Sub(b.startTime) - stats.Duration.Header
-		b.transport.Stats(stats)
+	b.mu.Lock()
+	readErr := b.readErr
+	b.mu.Unlock()
+	b.attempt.finish()
+	b.transport.tap(b.rt.req, b.attempt)
+	b.transport.done(b.rt)
+	closeTime := b.transport.clock().Now()
+	if b.transport.reporting() {
+		stats := b.rt.stats(b.attempt, b.res, readErr)
+		stats.Duration.Body = closeTime.Sub(b.attempt.startTime) - stats.Duration.Header
+		b.transport.report(stats)
 	}
+	// After the Stats, so the Summary comes last as for failed RoundTrips.
+	b.transport.summarize(b.rt, b.res, readErr)
 	return err
 }
 
+// countingBody counts the bytes read through it, reporting them to the
+// progress function if any. The request body is read on a different goroutine
+// than the one collecting Stats, hence the atomic.
+type countingBody struct {
+	io.ReadCloser
+	n        int64
+	total    int64
+	progress func(sent, total int64)
+}
+
+func (c *countingBody) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	sent := atomic.AddInt64(&c.n, int64(n))
+	if n > 0 && c.progress != nil {
+		c.progress(sent, c.total)
+	}
+	return n, err
+}
+
+// count returns the bytes read so far. It is safe to call on a nil body.
+func (c *countingBody) count() int64 {
+	if c == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&c.n)
+}
+
+// limitedBody fails reads with ErrBodyTooLarge once more than remaining bytes
+// are available.
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (l *limitedBody) Read(p []byte) (int, error) {
+	if l.remaining < 0 {
+		return 0, ErrBodyTooLarge
+	}
+	// Read one byte past the limit to tell a body of exactly the limit apart
+	// from a larger one.
+	if int64(len(p)) > l.remaining+1 {
+		p = p[:l.remaining+1]
+	}
+	n, err := l.ReadCloser.Read(p)
+	if int64(n) > l.remaining {
+		n = int(l.remaining)
+		l.remaining = -1
+		return n, ErrBodyTooLarge
+	}
+	l.remaining -= int64(n)
+	return n, err
+}
+
+// stallBody cancels the attempt with ErrResponseBodyTimeout if a read waits
+// longer than timeout for data.
+type stallBody struct {
+	io.ReadCloser
+	timeout time.Duration
+	timer   clockTimer
+}
+
+func newStallBody(clock clock, body io.ReadCloser, timeout time.Duration, cancel context.CancelCauseFunc) *stallBody {
+	timer := clock.AfterFunc(timeout, func() {
+		cancel(ErrResponseBodyTimeout)
+	})
+	timer.Stop()
+	return &stallBody{ReadCloser: body, timeout: timeout, timer: timer}
+}
+
+func (s *stallBody) Read(p []byte) (int, error) {
+	s.timer.Reset(s.timeout)
+	n, err := s.ReadCloser.Read(p)
+	s.timer.Stop()
+	return n, err
+}
+
+func (s *stallBody) Close() error {
+	s.timer.Stop()
+	return s.ReadCloser.Close()
+}
+
+// headerTimer cancels the attempt with errResponseHeaderTimeout if the
+// response headers take longer than timeout to arrive once the request has
+// been written. Unless strict, the first byte of the response is enough. The
+// hooks fire on other goroutines, possibly after the response arrived, hence
+// the mutex.
+type headerTimer struct {
+	mu      sync.Mutex
+	timer   clockTimer
+	timeout time.Duration
+	strict  bool
+	stopped bool
+}
+
+func newHeaderTimer(clock clock, timeout time.Duration, strict bool, cancel context.CancelCauseFunc) *headerTimer {
+	timer := clock.AfterFunc(timeout, func() {
+		cancel(errResponseHeaderTimeout)
+	})
+	timer.Stop()
+	return &headerTimer{timer: timer, timeout: timeout, strict: strict}
+}
+
+// withTrace returns a context that starts the timer when the request has been
+// written, in addition to any ClientTrace already present in ctx.
+func (h *headerTimer) withTrace(ctx context.Context) context.Context {
+	trace := &httptrace.ClientTrace{
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			h.mu.Lock()
+			if !h.stopped {
+				h.timer.Reset(h.timeout)
+			}
+			h.mu.Unlock()
+		},
+	}
+	if !h.strict {
+		trace.GotFirstResponseByte = h.stop
+	}
+	return httptrace.WithClientTrace(ctx, trace)
+}
+
+// stop stops the timer for good.
+func (h *headerTimer) stop() {
+	h.mu.Lock()
+	h.stopped = true
+	h.timer.Stop()
+	h.mu.Unlock()
+}
+
 // TransportFlag - A Flag configured Transport instance.
+//
+// Each flag may also be set using an environment variable, named by
+// uppercasing the flag name and replacing non-alphanumeric characters with
+// underscores. For example "api.dial-timeout" may be set with
+// API_DIAL_TIMEOUT. A flag set on the command line takes precedence over the
+// environment, which takes precedence over the default.
 func TransportFlag(name string) *Transport {
 	t := &Transport{TLSClientConfig: &tls.Config{}}
 	flag.BoolVar(
@@ -375,5 +2191,83 @@ func TransportFlag(name string) *Transport {
 		0,
 		name+" max retries for known safe failures",
 	)
+	flag.Var(
+		&backoffFlag{t: t},
+		name+".retry-backoff",
+		name+" base delay for exponential retry backoff, 0 retries immediately",
+	)
+	flagEnv(flag.CommandLine, name)
 	return t
 }
+
+// backoffFlag sets RetryBackoff to an ExponentialBackoff from a base delay.
+// The delay is capped at the RequestTimeout, or 64 times the base if there is
+// none.
+type backoffFlag struct {
+	t    *Transport
+	base time.Duration
+}
+
+func (f *backoffFlag) String() string {
+	if f.t == nil {
+		return "0s"
+	}
+	return f.base.String()
+}
+
+func (f *backoffFlag) Set(s string) error {
+	base, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	f.base = base
+	if base <= 0 {
+		f.t.RetryBackoff = nil
+		return nil
+	}
+	t := f.t
+	f.t.RetryBackoff = func(try int) time.Duration {
+		max := t.RequestTimeout
+		if max <= 0 {
+			max = 64 * base
+		}
+		return ExponentialBackoff(base, max)(try)
+	}
+	return nil
+}
+
+// flagEnv applies environment variables to the flags registered with the
+// given name prefix. Since the command line is parsed later, explicitly set
+// flags still win.
+func flagEnv(fs *flag.FlagSet, name string) {
+	prefix := name + "."
+	fs.VisitAll(func(f *flag.Flag) {
+		if !strings.HasPrefix(f.Name, prefix) {
+			return
+		}
+		env := flagEnvName(f.Name)
+		f.Usage += " (env " + env + ")"
+		v, ok := os.LookupEnv(env)
+		if !ok {
+			return
+		}
+		if err := f.Value.Set(v); err != nil {
+			fmt.Fprintf(fs.Output(), "invalid value %q for env %s: %v\n", v, env, err)
+			return
+		}
+		f.DefValue = f.Value.String()
+	})
+}
+
+// flagEnvName returns the environment variable name for a flag.
+func flagEnvName(flagName string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, flagName)
+}
@@ -1,7 +1,11 @@
 package httpcontrol_test
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -9,8 +13,10 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"net/url"
+	"regexp"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -186,8 +192,11 @@ func TestResponseTimeout(t *testing.T) {
 	if res != nil {
 		t.Fatal("was expecting nil response")
 	}
-	if !strings.Contains(err.Error(), "use of closed network connection") {
-		t.Fatalf("was expecting closed network connection related error, got %s", err)
+	// The request is cancelled rather than its connection closed, so the
+	// error is a timeout instead of "use of closed network connection".
+	var neterr net.Error
+	if !errors.As(err, &neterr) || !neterr.Timeout() {
+		t.Fatalf("was expecting timeout error, got %s", err)
 	}
 }
 
@@ -389,3 +398,1104 @@ func TestStatsString(t *testing.T) {
 func TestCloseIdleConnections(t *testing.T) {
 	(&httpcontrol.Transport{}).CloseIdleConnections()
 }
+
+func TestRetryBackoff(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(sleepHandler(time.Millisecond))
+	server.Close()
+	const delay = time.Minute
+	var tries []int
+	transport := &httpcontrol.Transport{
+		MaxTries: 2,
+		RetryBackoff: func(try int) time.Duration {
+			tries = append(tries, try)
+			return delay
+		},
+	}
+	httpcontrol.SetClock(transport, httpcontrol.NewFakeClock())
+	var delays []time.Duration
+	transport.Stats = func(stats *httpcontrol.Stats) {
+		delays = append(delays, stats.Retry.Delay)
+	}
+	client := &http.Client{Transport: transport}
+	_, err := client.Get(server.URL)
+	ensure.NotNil(t, err)
+	ensure.DeepEqual(t, tries, []int{0, 1})
+	ensure.DeepEqual(t, len(delays), 3)
+	ensure.DeepEqual(t, delays, []time.Duration{delay, delay, 0})
+}
+
+func TestRetryBackoffCappedByRequestTimeout(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(sleepHandler(time.Millisecond))
+	server.Close()
+	const timeout = time.Minute
+	transport := &httpcontrol.Transport{
+		MaxTries:       1,
+		RequestTimeout: timeout,
+		RetryBackoff:   func(int) time.Duration { return time.Hour },
+	}
+	httpcontrol.SetClock(transport, httpcontrol.NewFakeClock())
+	var delay time.Duration
+	transport.Stats = func(stats *httpcontrol.Stats) {
+		if stats.Retry.Pending {
+			delay = stats.Retry.Delay
+		}
+	}
+	client := &http.Client{Transport: transport}
+	_, err := client.Get(server.URL)
+	ensure.NotNil(t, err)
+	ensure.DeepEqual(t, delay, timeout)
+}
+
+func TestRetryAfterHeader(t *testing.T) {
+	t.Parallel()
+	var count int
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			count++
+			if count == 1 {
+				w.Header().Set("Retry-After", "3600")
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Write(theAnswer)
+		}))
+	defer server.Close()
+	const maxRetryAfter = time.Minute
+	transport := &httpcontrol.Transport{
+		MaxTries:      1,
+		RetryStatuses: []int{http.StatusServiceUnavailable},
+		MaxRetryAfter: maxRetryAfter,
+	}
+	httpcontrol.SetClock(transport, httpcontrol.NewFakeClock())
+	var delay time.Duration
+	transport.Stats = func(stats *httpcontrol.Stats) {
+		if stats.Retry.Pending {
+			ensure.DeepEqual(t, stats.Response.StatusCode, http.StatusServiceUnavailable)
+			delay = stats.Retry.Delay
+		}
+	}
+	client := &http.Client{Transport: transport}
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	ensure.DeepEqual(t, count, 2)
+	ensure.DeepEqual(t, delay, maxRetryAfter)
+}
+
+func statusThenAnswerHandler(code int, failures int) http.Handler {
+	var mu sync.Mutex
+	var count int
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			count++
+			n := count
+			mu.Unlock()
+			if n <= failures {
+				w.WriteHeader(code)
+				w.Write(theAnswer)
+				return
+			}
+			w.Write(theAnswer)
+		})
+}
+
+func TestRetryStatus(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(statusThenAnswerHandler(http.StatusBadGateway, 2))
+	defer server.Close()
+	transport := &httpcontrol.Transport{
+		MaxTries:      2,
+		RetryStatuses: []int{http.StatusBadGateway, http.StatusServiceUnavailable},
+	}
+	var statuses []int
+	transport.Stats = func(stats *httpcontrol.Stats) {
+		ensure.Nil(t, stats.Error)
+		ensure.NotNil(t, stats.Response)
+		statuses = append(statuses, stats.Response.StatusCode)
+	}
+	req, err := http.NewRequest("PUT", server.URL, nil)
+	ensure.Nil(t, err)
+	client := &http.Client{Transport: transport}
+	res, err := client.Do(req)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	ensure.DeepEqual(t, statuses, []int{502, 502, 200})
+}
+
+func TestRetryFreshConn(t *testing.T) {
+	t.Parallel()
+	var mu sync.Mutex
+	var remotes []string
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			remotes = append(remotes, r.RemoteAddr)
+			n := len(remotes)
+			mu.Unlock()
+			// Fail the first two attempts after the warm up.
+			if n == 2 || n == 3 {
+				w.WriteHeader(http.StatusBadGateway)
+			}
+			w.Write(theAnswer)
+		}))
+	defer server.Close()
+	var reused []bool
+	transport := &httpcontrol.Transport{
+		MaxTries:       2,
+		RetryStatuses:  []int{http.StatusBadGateway},
+		RetryFreshConn: true,
+		Stats:          func(stats *httpcontrol.Stats) { reused = append(reused, stats.ConnReused) },
+	}
+	client := &http.Client{Transport: transport}
+	for i := 0; i < 2; i++ {
+		res, err := client.Get(server.URL)
+		ensure.Nil(t, err)
+		assertResponse(res, t)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	ensure.DeepEqual(t, len(remotes), 4)
+	// The first attempt reuses the pooled connection, the retries do not.
+	ensure.DeepEqual(t, remotes[1], remotes[0])
+	ensure.True(t, remotes[2] != remotes[1] && remotes[3] != remotes[1], remotes)
+	ensure.True(t, remotes[3] != remotes[2], remotes)
+	ensure.DeepEqual(t, reused, []bool{false, true, false, false})
+}
+
+func TestRetryStatusExhausted(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(statusThenAnswerHandler(http.StatusBadGateway, 5))
+	defer server.Close()
+	transport := &httpcontrol.Transport{
+		MaxTries:      1,
+		RetryStatuses: []int{http.StatusBadGateway},
+	}
+	client := &http.Client{Transport: transport}
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	ensure.DeepEqual(t, res.StatusCode, http.StatusBadGateway)
+}
+
+func TestRetryStatusNonIdempotent(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(statusThenAnswerHandler(http.StatusBadGateway, 2))
+	defer server.Close()
+	transport := &httpcontrol.Transport{
+		MaxTries:      1,
+		RetryStatuses: []int{http.StatusBadGateway},
+	}
+	client := &http.Client{Transport: transport}
+	res, err := client.Post(server.URL, "text/plain", nil)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	ensure.DeepEqual(t, res.StatusCode, http.StatusBadGateway)
+
+	transport.RetryNonIdempotent = true
+	res, err = client.Post(server.URL, "text/plain", nil)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	ensure.DeepEqual(t, res.StatusCode, http.StatusOK)
+}
+
+func TestNoRetryHosts(t *testing.T) {
+	t.Parallel()
+	// Each host fails its first request.
+	var mu sync.Mutex
+	seen := make(map[string]bool)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			failed := seen[r.Host]
+			seen[r.Host] = true
+			mu.Unlock()
+			if !failed {
+				w.WriteHeader(http.StatusBadGateway)
+			}
+			w.Write(theAnswer)
+		}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	ensure.Nil(t, err)
+	var dialer net.Dialer
+	var tries int
+	transport := &httpcontrol.Transport{
+		MaxTries:      2,
+		RetryStatuses: []int{http.StatusBadGateway},
+		NoRetryHosts:  []string{"127.0.0.1", "*.pay.example"},
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, network, u.Host)
+		},
+		Stats: func(*httpcontrol.Stats) { tries++ },
+	}
+	client := &http.Client{Transport: transport}
+
+	for _, target := range []string{server.URL, "http://API.pay.example/"} {
+		tries = 0
+		res, err := client.Get(target)
+		ensure.Nil(t, err)
+		ensure.DeepEqual(t, res.StatusCode, http.StatusBadGateway, target)
+		res.Body.Close()
+		ensure.DeepEqual(t, tries, 1, target)
+	}
+
+	// Other hosts are still retried.
+	tries = 0
+	res, err := client.Get("http://pay.example/")
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	ensure.DeepEqual(t, tries, 2)
+}
+
+func TestContextCanceled(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(sleepHandler(5 * time.Second))
+	transport := &httpcontrol.Transport{
+		MaxTries:          3,
+		RequestTimeout:    time.Minute,
+		RetryAfterTimeout: true,
+	}
+	var count int
+	transport.Stats = func(stats *httpcontrol.Stats) {
+		count++
+		ensure.False(t, stats.Retry.Pending)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	req, err := http.NewRequestWithContext(ctx, "GET", server.URL, nil)
+	ensure.Nil(t, err)
+	res, err := transport.RoundTrip(req)
+	ensure.True(t, errors.Is(err, context.Canceled), err)
+	ensure.True(t, res == nil)
+	ensure.DeepEqual(t, count, 1)
+}
+
+func TestContextDeadlineBeforeRequestTimeout(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(sleepHandler(5 * time.Second))
+	transport := &httpcontrol.Transport{RequestTimeout: time.Minute}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", server.URL, nil)
+	ensure.Nil(t, err)
+	_, err = transport.RoundTrip(req)
+	ensure.True(t, errors.Is(err, context.DeadlineExceeded), err)
+}
+
+func TestContextCanceledDuringBackoff(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(sleepHandler(time.Millisecond))
+	server.Close()
+	transport := &httpcontrol.Transport{
+		MaxTries:     3,
+		RetryBackoff: func(int) time.Duration { return time.Hour },
+	}
+	var count int
+	transport.Stats = func(stats *httpcontrol.Stats) {
+		count++
+		ensure.False(t, stats.Retry.Pending)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	req, err := http.NewRequestWithContext(ctx, "GET", server.URL, nil)
+	ensure.Nil(t, err)
+	_, err = transport.RoundTrip(req)
+	ensure.True(t, errors.Is(err, context.Canceled), err)
+	ensure.DeepEqual(t, count, 1)
+}
+
+func TestCircuitOpen(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(sleepHandler(time.Millisecond))
+	server.Close()
+	transport := &httpcontrol.Transport{
+		MaxTries:         5,
+		CircuitThreshold: 2,
+		CircuitCooldown:  time.Hour,
+	}
+	var all []*httpcontrol.Stats
+	transport.Stats = func(stats *httpcontrol.Stats) {
+		all = append(all, stats)
+	}
+	client := &http.Client{Transport: transport}
+	_, err := client.Get(server.URL)
+	ensure.True(t, errors.Is(err, httpcontrol.ErrCircuitOpen), err)
+	ensure.DeepEqual(t, len(all), 3)
+	ensure.False(t, all[0].CircuitOpen)
+	ensure.True(t, all[1].CircuitOpen)
+	ensure.True(t, all[2].CircuitOpen)
+	ensure.DeepEqual(t, all[2].Error, httpcontrol.ErrCircuitOpen)
+
+	_, err = client.Get(server.URL)
+	ensure.True(t, errors.Is(err, httpcontrol.ErrCircuitOpen), err)
+	ensure.DeepEqual(t, len(all), 4)
+}
+
+func TestRetryReplaysGetBody(t *testing.T) {
+	t.Parallel()
+	port, err := freeport.Get()
+	ensure.Nil(t, err)
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	var bodies []string
+	server := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			b, _ := ioutil.ReadAll(r.Body)
+			bodies = append(bodies, string(b))
+			w.Write(theAnswer)
+		}))
+	transport := &httpcontrol.Transport{MaxTries: 1}
+	transport.Stats = func(stats *httpcontrol.Stats) {
+		if stats.Retry.Pending {
+			server.Listener, err = net.Listen("tcp", addr)
+			ensure.Nil(t, err)
+			server.Start()
+		}
+	}
+	req, err := http.NewRequest("PUT", fmt.Sprintf("http://%s/", addr), strings.NewReader("hello"))
+	ensure.Nil(t, err)
+	ensure.NotNil(t, req.GetBody)
+	client := &http.Client{Transport: transport}
+	res, err := client.Do(req)
+	ensure.Nil(t, err)
+	defer server.Close()
+	assertResponse(res, t)
+	ensure.DeepEqual(t, bodies, []string{"hello"})
+}
+
+type seekableBody struct {
+	*strings.Reader
+	closed bool
+}
+
+func (s *seekableBody) Close() error {
+	s.closed = true
+	return nil
+}
+
+func TestRetryReplaysSeekableBody(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(statusThenAnswerHandler(http.StatusBadGateway, 1))
+	defer server.Close()
+	transport := &httpcontrol.Transport{
+		MaxTries:      1,
+		RetryStatuses: []int{http.StatusBadGateway},
+	}
+	var sent []int64
+	transport.Stats = func(stats *httpcontrol.Stats) {
+		sent = append(sent, stats.Attempt.BytesSent)
+	}
+	body := &seekableBody{Reader: strings.NewReader("hello")}
+	req, err := http.NewRequest("PUT", server.URL, body)
+	ensure.Nil(t, err)
+	req.ContentLength = 5
+	client := &http.Client{Transport: transport}
+	res, err := client.Do(req)
+	ensure.Nil(t, err)
+	ensure.False(t, body.closed)
+	assertResponse(res, t)
+	ensure.DeepEqual(t, res.StatusCode, http.StatusOK)
+	ensure.DeepEqual(t, sent, []int64{5, 5})
+	ensure.True(t, body.closed)
+}
+
+func TestRetrySkippedForStreamingBody(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(sleepHandler(time.Millisecond))
+	server.Close()
+	transport := &httpcontrol.Transport{MaxTries: 1}
+	var all []*httpcontrol.Stats
+	transport.Stats = func(stats *httpcontrol.Stats) {
+		all = append(all, stats)
+	}
+	req, err := http.NewRequest("PUT", server.URL, ioutil.NopCloser(strings.NewReader("hello")))
+	ensure.Nil(t, err)
+	_, err = transport.RoundTrip(req)
+	ensure.NotNil(t, err)
+	ensure.DeepEqual(t, len(all), 1)
+	ensure.False(t, all[0].Retry.Pending)
+	ensure.True(t, all[0].Retry.BodyNotReplayable)
+}
+
+func TestTotalTimeout(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(sleepHandler(5 * time.Second))
+	transport := &httpcontrol.Transport{
+		MaxTries:          3,
+		RequestTimeout:    50 * time.Millisecond,
+		RetryAfterTimeout: true,
+		RetryBackoff:      func(int) time.Duration { return 10 * time.Millisecond },
+		TotalTimeout:      80 * time.Millisecond,
+	}
+	var all []*httpcontrol.Stats
+	transport.Stats = func(stats *httpcontrol.Stats) {
+		all = append(all, stats)
+	}
+	client := &http.Client{Transport: transport}
+	start := time.Now()
+	_, err := client.Get(server.URL)
+	ensure.True(t, errors.Is(err, httpcontrol.ErrTotalTimeout), err)
+	ensure.True(t, time.Since(start) < time.Second)
+	ensure.DeepEqual(t, len(all), 2)
+	ensure.True(t, all[0].Retry.Pending)
+	ensure.False(t, all[1].Retry.Pending)
+	ensure.DeepEqual(t, all[1].Error, httpcontrol.ErrTotalTimeout)
+}
+
+func TestUnlimitedTriesServerStartsLate(t *testing.T) {
+	t.Parallel()
+	port, err := freeport.Get()
+	ensure.Nil(t, err)
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	var tries int32
+	transport := &httpcontrol.Transport{
+		MaxTries:     httpcontrol.UnlimitedTries,
+		TotalTimeout: 10 * time.Second,
+		Stats:        func(*httpcontrol.Stats) { atomic.AddInt32(&tries, 1) },
+	}
+	const late = 200 * time.Millisecond
+	server := httptest.NewUnstartedServer(sleepHandler(0))
+	defer server.Close()
+	go func() {
+		time.Sleep(late)
+		l, err := net.Listen("tcp", addr)
+		ensure.Nil(t, err)
+		server.Listener.Close()
+		server.Listener = l
+		server.Start()
+	}()
+	client := &http.Client{Transport: transport}
+	start := time.Now()
+	res, err := client.Get("http://" + addr)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	elapsed := time.Since(start)
+	n := atomic.LoadInt32(&tries)
+	ensure.True(t, n > 1, n)
+	// Without a RetryBackoff attempts are still spaced out.
+	ensure.True(t, time.Duration(n-1)*httpcontrol.MinUnlimitedBackoff <= elapsed, n, elapsed)
+}
+
+func TestUnlimitedTriesTotalTimeout(t *testing.T) {
+	t.Parallel()
+	port, err := freeport.Get()
+	ensure.Nil(t, err)
+	var tries int
+	transport := &httpcontrol.Transport{
+		MaxTries:     httpcontrol.UnlimitedTries,
+		RetryBackoff: httpcontrol.ConstantBackoff(20 * time.Millisecond),
+		TotalTimeout: 100 * time.Millisecond,
+		Stats:        func(*httpcontrol.Stats) { tries++ },
+	}
+	client := &http.Client{Transport: transport}
+	start := time.Now()
+	_, err = client.Get(fmt.Sprintf("http://127.0.0.1:%d/", port))
+	ensure.NotNil(t, err)
+	ensure.True(t, time.Since(start) < time.Second)
+	ensure.True(t, tries > 1 && tries <= 6, tries)
+}
+
+func TestUnlimitedTriesWithoutDeadline(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(sleepHandler(0))
+	defer server.Close()
+	transport := &httpcontrol.Transport{MaxTries: httpcontrol.UnlimitedTries}
+	defer transport.Close()
+	client := &http.Client{Transport: transport}
+	_, err := client.Get(server.URL)
+	ensure.True(t, errors.Is(err, httpcontrol.ErrUnboundedRetries), err)
+
+	// A deadline on the request context bounds the retries.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", server.URL, nil)
+	ensure.Nil(t, err)
+	res, err := client.Do(req)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+}
+
+func TestMaxConnsPerHost(t *testing.T) {
+	t.Parallel()
+	var mu sync.Mutex
+	var active, maxActive int
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			active++
+			if active > maxActive {
+				maxActive = active
+			}
+			mu.Unlock()
+			time.Sleep(20 * time.Millisecond)
+			mu.Lock()
+			active--
+			mu.Unlock()
+			w.Write(theAnswer)
+		}))
+	defer server.Close()
+	transport := &httpcontrol.Transport{MaxConnsPerHost: 1}
+	var waits []time.Duration
+	transport.Stats = func(stats *httpcontrol.Stats) {
+		mu.Lock()
+		waits = append(waits, stats.Timing.ConnWait)
+		mu.Unlock()
+	}
+	client := &http.Client{Transport: transport}
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := client.Get(server.URL)
+			ensure.Nil(t, err)
+			assertResponse(res, t)
+		}()
+	}
+	wg.Wait()
+	ensure.DeepEqual(t, maxActive, 1)
+	var waited int
+	for _, w := range waits {
+		if w > 0 {
+			waited++
+		}
+	}
+	ensure.DeepEqual(t, waited, 2)
+}
+
+func TestMaxConnsPerHostTimeout(t *testing.T) {
+	t.Parallel()
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			<-release
+			w.Write(theAnswer)
+		}))
+	defer server.Close()
+	defer close(release)
+	transport := &httpcontrol.Transport{MaxConnsPerHost: 1}
+	client := &http.Client{Transport: transport}
+	go client.Get(server.URL)
+	time.Sleep(10 * time.Millisecond)
+
+	ctx := httpcontrol.WithRequestTimeout(context.Background(), 20*time.Millisecond)
+	req, err := http.NewRequestWithContext(ctx, "GET", server.URL, nil)
+	ensure.Nil(t, err)
+	_, err = client.Do(req)
+	ensure.StringContains(t, err.Error(), "request timeout")
+}
+
+func TestNoRetryOnUnknownHost(t *testing.T) {
+	t.Parallel()
+	var dials int
+	var pending []bool
+	transport := &httpcontrol.Transport{
+		MaxTries: 3,
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dials++
+			return nil, &net.DNSError{Err: "no such host", Name: "example.invalid", IsNotFound: true}
+		},
+		Stats: func(stats *httpcontrol.Stats) {
+			pending = append(pending, stats.Retry.Pending)
+		},
+	}
+	client := &http.Client{Transport: transport}
+	_, err := client.Get("http://example.invalid/")
+	ensure.NotNil(t, err)
+	ensure.DeepEqual(t, dials, 1)
+	ensure.DeepEqual(t, pending, []bool{false})
+}
+
+func TestFlagEnv(t *testing.T) {
+	name := flagName()
+	prefix := strings.ToUpper(strings.Replace(name, "-", "_", -1))
+	t.Setenv(prefix+"_DIAL_TIMEOUT", "7s")
+	t.Setenv(prefix+"_MAX_TRIES", "4")
+	t.Setenv(prefix+"_REQUEST_TIMEOUT", "1m")
+	c := httpcontrol.TransportFlag(name)
+	ensure.Nil(t, flag.CommandLine.Set(name+".request-timeout", "5s"))
+	ensure.DeepEqual(t, c.DialTimeout, 7*time.Second)
+	ensure.DeepEqual(t, c.MaxTries, uint(4))
+	ensure.DeepEqual(t, c.RequestTimeout, 5*time.Second)
+	ensure.DeepEqual(t, c.ResponseHeaderTimeout, 3*time.Second)
+}
+
+func TestFlagRetryBackoff(t *testing.T) {
+	name := flagName()
+	c := httpcontrol.TransportFlag(name)
+	ensure.True(t, c.RetryBackoff == nil)
+	ensure.Nil(t, flag.CommandLine.Set(name+".max-tries", "3"))
+	ensure.Nil(t, flag.CommandLine.Set(name+".retry-backoff", "10ms"))
+	ensure.DeepEqual(t, c.MaxTries, uint(3))
+	ensure.NotNil(t, c.RetryBackoff)
+	for try := 0; try < 10; try++ {
+		if d := c.RetryBackoff(try); d < 0 || d > c.RequestTimeout {
+			t.Fatalf("unexpected backoff %s for try %d", d, try)
+		}
+	}
+	ensure.DeepEqual(t, flag.Lookup(name+".retry-backoff").Value.String(), "10ms")
+	ensure.NotNil(t, flag.CommandLine.Set(name+".retry-backoff", "bogus"))
+	ensure.Nil(t, flag.CommandLine.Set(name+".retry-backoff", "0"))
+	ensure.True(t, c.RetryBackoff == nil)
+}
+
+func TestStatsRedirect(t *testing.T) {
+	t.Parallel()
+	mux := http.NewServeMux()
+	mux.Handle("/a", http.RedirectHandler("/b", http.StatusFound))
+	mux.Handle("/b", http.RedirectHandler("/c", http.StatusFound))
+	mux.Handle("/c", sleepHandler(0))
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	var mu sync.Mutex
+	var all []*httpcontrol.Stats
+	transport := &httpcontrol.Transport{
+		Stats: func(stats *httpcontrol.Stats) {
+			mu.Lock()
+			all = append(all, stats)
+			mu.Unlock()
+		},
+	}
+	client := &http.Client{Transport: transport}
+	res, err := client.Get(server.URL + "/a")
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	mu.Lock()
+	defer mu.Unlock()
+	ensure.DeepEqual(t, len(all), 3)
+	for i, stats := range all {
+		ensure.DeepEqual(t, stats.RedirectCount, i)
+		ensure.True(t, stats.OriginalRequest == all[0].Request)
+	}
+	ensure.DeepEqual(t, all[2].Request.URL.Path, "/c")
+}
+
+func TestShouldRetryCallback(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(statusThenAnswerHandler(http.StatusTeapot, 2))
+	defer server.Close()
+	var tries []int
+	transport := &httpcontrol.Transport{
+		ShouldRetry: func(req *http.Request, resp *http.Response, err error, try int) bool {
+			tries = append(tries, try)
+			return err == nil && resp.StatusCode == http.StatusTeapot && try < 5
+		},
+	}
+	client := &http.Client{Transport: transport}
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	ensure.DeepEqual(t, tries, []int{0, 1, 2})
+}
+
+func TestShouldRetryCallbackStopsErrors(t *testing.T) {
+	t.Parallel()
+	port, err := freeport.Get()
+	ensure.Nil(t, err)
+	var calls int
+	transport := &httpcontrol.Transport{
+		MaxTries: 3,
+		ShouldRetry: func(req *http.Request, resp *http.Response, err error, try int) bool {
+			calls++
+			ensure.True(t, resp == nil)
+			ensure.NotNil(t, err)
+			return false
+		},
+	}
+	client := &http.Client{Transport: transport}
+	_, err = client.Get(fmt.Sprintf("http://127.0.0.1:%d/", port))
+	ensure.NotNil(t, err)
+	ensure.DeepEqual(t, calls, 1)
+}
+
+func TestMaxResponseHeaderBytes(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Big", strings.Repeat("x", 8<<10))
+			w.Write(theAnswer)
+		}))
+	defer server.Close()
+	transport := &httpcontrol.Transport{MaxResponseHeaderBytes: 1 << 10}
+	client := &http.Client{Transport: transport}
+	_, err := client.Get(server.URL)
+	ensure.Err(t, err, regexp.MustCompile("server response headers exceeded 1024 bytes"))
+
+	transport = &httpcontrol.Transport{MaxResponseHeaderBytes: 16 << 10}
+	client = &http.Client{Transport: transport}
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+}
+
+func TestMaxResponseBodyBytes(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write(bytes.Repeat([]byte("x"), 1024))
+		}))
+	defer server.Close()
+	var received int64
+	transport := &httpcontrol.Transport{
+		MaxResponseBodyBytes: 100,
+		Stats: func(stats *httpcontrol.Stats) {
+			received = stats.BytesReceived
+		},
+	}
+	client := &http.Client{Transport: transport}
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	b, err := ioutil.ReadAll(res.Body)
+	ensure.DeepEqual(t, err, httpcontrol.ErrBodyTooLarge)
+	ensure.DeepEqual(t, len(b), 100)
+	ensure.Nil(t, res.Body.Close())
+	if received < 100 || received > 1024 {
+		t.Fatalf("unexpected bytes received %d", received)
+	}
+}
+
+func TestMaxResponseBodyBytesExact(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(sleepHandler(0))
+	defer server.Close()
+	transport := &httpcontrol.Transport{MaxResponseBodyBytes: int64(len(theAnswer))}
+	client := &http.Client{Transport: transport}
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+}
+
+func TestMaxResponseBodyBytesRetry(t *testing.T) {
+	t.Parallel()
+	var count int32
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&count, 1) == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				w.Write(bytes.Repeat([]byte("x"), 1<<20))
+				return
+			}
+			w.Write(theAnswer)
+		}))
+	defer server.Close()
+	transport := &httpcontrol.Transport{
+		MaxTries:             1,
+		RetryStatuses:        []int{http.StatusServiceUnavailable},
+		MaxResponseBodyBytes: 100,
+	}
+	client := &http.Client{Transport: transport}
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	ensure.DeepEqual(t, atomic.LoadInt32(&count), int32(2))
+}
+
+func pausingHandler(pause time.Duration) http.Handler {
+	return http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write(theAnswer)
+			w.(http.Flusher).Flush()
+			time.Sleep(pause)
+			w.Write(theAnswer)
+		})
+}
+
+func TestResponseBodyTimeout(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(pausingHandler(300 * time.Millisecond))
+	defer server.Close()
+	transport := &httpcontrol.Transport{ResponseBodyTimeout: 50 * time.Millisecond}
+	client := &http.Client{Transport: transport}
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	ensure.True(t, errors.Is(err, httpcontrol.ErrResponseBodyTimeout), err)
+	var neterr net.Error
+	ensure.True(t, errors.As(err, &neterr))
+	ensure.True(t, neterr.Timeout())
+	ensure.DeepEqual(t, b, theAnswer)
+}
+
+func TestResponseBodyTimeoutRolling(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(pausingHandler(30 * time.Millisecond))
+	defer server.Close()
+	transport := &httpcontrol.Transport{ResponseBodyTimeout: 200 * time.Millisecond}
+	client := &http.Client{Transport: transport}
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	// Waiting between reads does not count against the timeout.
+	time.Sleep(250 * time.Millisecond)
+	b, err := ioutil.ReadAll(res.Body)
+	ensure.Nil(t, err)
+	ensure.Nil(t, res.Body.Close())
+	ensure.DeepEqual(t, b, append(append([]byte{}, theAnswer...), theAnswer...))
+}
+
+func TestStrictRetryStreamingBody(t *testing.T) {
+	t.Parallel()
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			w.Write(theAnswer)
+		}))
+	defer server.Close()
+	transport := &httpcontrol.Transport{MaxTries: 1, StrictRetry: true}
+	body := &closeRecorder{Reader: strings.NewReader("hello")}
+	req, err := http.NewRequest("PUT", server.URL, body)
+	ensure.Nil(t, err)
+	req.GetBody = nil
+	_, err = transport.RoundTrip(req)
+	ensure.DeepEqual(t, err, httpcontrol.ErrBodyNotReplayable)
+	ensure.True(t, body.closed)
+	ensure.DeepEqual(t, atomic.LoadInt32(&requests), int32(0))
+
+	// Replayable bodies are fine.
+	req, err = http.NewRequest("PUT", server.URL, strings.NewReader("hello"))
+	ensure.Nil(t, err)
+	res, err := transport.RoundTrip(req)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+}
+
+func TestNonStrictRetryStreamingBody(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(sleepHandler(0))
+	defer server.Close()
+	var stats *httpcontrol.Stats
+	transport := &httpcontrol.Transport{
+		MaxTries: 1,
+		Stats:    func(s *httpcontrol.Stats) { stats = s },
+	}
+	req, err := http.NewRequest("PUT", server.URL, ioutil.NopCloser(strings.NewReader("hello")))
+	ensure.Nil(t, err)
+	res, err := transport.RoundTrip(req)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	ensure.True(t, stats.Retry.BodyNotReplayable)
+}
+
+type closeRecorder struct {
+	io.Reader
+	closed bool
+}
+
+func (c *closeRecorder) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestRetryOnlyBeforeWriteDialFailure(t *testing.T) {
+	t.Parallel()
+	port, err := freeport.Get()
+	ensure.Nil(t, err)
+	var tries int
+	transport := &httpcontrol.Transport{
+		MaxTries:             2,
+		RetryOnlyBeforeWrite: true,
+		Stats:                func(*httpcontrol.Stats) { tries++ },
+	}
+	client := &http.Client{Transport: transport}
+	_, err = client.Post(fmt.Sprintf("http://127.0.0.1:%d/", port), "text/plain",
+		strings.NewReader("hello"))
+	ensure.NotNil(t, err)
+	ensure.DeepEqual(t, tries, 3)
+}
+
+func TestRetryOnlyBeforeWriteAfterHeaders(t *testing.T) {
+	t.Parallel()
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			conn, _, err := w.(http.Hijacker).Hijack()
+			ensure.Nil(t, err)
+			conn.Close()
+		}))
+	defer server.Close()
+	transport := &httpcontrol.Transport{
+		MaxTries:             2,
+		RetryOnlyBeforeWrite: true,
+	}
+	client := &http.Client{Transport: transport}
+	_, err := client.Get(server.URL)
+	ensure.NotNil(t, err)
+	ensure.DeepEqual(t, atomic.LoadInt32(&requests), int32(1))
+
+	transport = &httpcontrol.Transport{MaxTries: 2}
+	client = &http.Client{Transport: transport}
+	_, err = client.Get(server.URL)
+	ensure.NotNil(t, err)
+	ensure.DeepEqual(t, atomic.LoadInt32(&requests), int32(4))
+}
+
+func TestAddStatsObserver(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(sleepHandler(0))
+	defer server.Close()
+	var calls []string
+	transport := &httpcontrol.Transport{
+		Stats: func(*httpcontrol.Stats) { calls = append(calls, "stats") },
+	}
+	transport.AddStatsObserver(func(*httpcontrol.Stats) { calls = append(calls, "first") })
+	transport.AddStatsObserver(func(*httpcontrol.Stats) { calls = append(calls, "second") })
+	client := &http.Client{Transport: transport}
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	ensure.DeepEqual(t, calls, []string{"stats", "first", "second"})
+}
+
+func TestAddStatsObserverConcurrent(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(sleepHandler(0))
+	defer server.Close()
+	transport := &httpcontrol.Transport{}
+	client := &http.Client{Transport: transport}
+	var observed int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			transport.AddStatsObserver(func(*httpcontrol.Stats) {
+				atomic.AddInt32(&observed, 1)
+			})
+		}()
+		go func() {
+			defer wg.Done()
+			res, err := client.Get(server.URL)
+			ensure.Nil(t, err)
+			assertResponse(res, t)
+		}()
+	}
+	wg.Wait()
+	atomic.StoreInt32(&observed, 0)
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	ensure.DeepEqual(t, atomic.LoadInt32(&observed), int32(10))
+}
+
+func TestRetrySkippedPastTotalTimeout(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(sleepHandler(time.Millisecond))
+	server.Close()
+	transport := &httpcontrol.Transport{
+		MaxTries:     3,
+		TotalTimeout: 10 * time.Second,
+		RetryBackoff: func(int) time.Duration { return time.Minute },
+	}
+	var all []*httpcontrol.Stats
+	transport.Stats = func(stats *httpcontrol.Stats) {
+		all = append(all, stats)
+	}
+	client := &http.Client{Transport: transport}
+	start := time.Now()
+	_, err := client.Get(server.URL)
+	ensure.NotNil(t, err)
+	ensure.False(t, errors.Is(err, httpcontrol.ErrTotalTimeout))
+	ensure.True(t, time.Since(start) < 5*time.Second)
+	ensure.DeepEqual(t, len(all), 1)
+	ensure.True(t, all[0].Retry.Skipped)
+	ensure.False(t, all[0].Retry.Pending)
+}
+
+func TestRetrySkippedPastContextDeadline(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(statusThenAnswerHandler(http.StatusServiceUnavailable, 1))
+	defer server.Close()
+	transport := &httpcontrol.Transport{
+		MaxTries:      1,
+		RetryStatuses: []int{http.StatusServiceUnavailable},
+		RetryBackoff:  func(int) time.Duration { return time.Minute },
+	}
+	var skipped []bool
+	transport.Stats = func(stats *httpcontrol.Stats) {
+		skipped = append(skipped, stats.Retry.Skipped)
+	}
+	client := &http.Client{Transport: transport}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", server.URL, nil)
+	ensure.Nil(t, err)
+	res, err := client.Do(req)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, res.StatusCode, http.StatusServiceUnavailable)
+	assertResponse(res, t)
+	ensure.DeepEqual(t, skipped, []bool{true})
+}
+
+func TestUnderlying(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(sleepHandler(0))
+	defer server.Close()
+	transport := &httpcontrol.Transport{MaxIdleConnsPerHost: 7}
+	underlying := transport.Underlying()
+	ensure.DeepEqual(t, underlying.MaxIdleConnsPerHost, 7)
+	underlying.WriteBufferSize = 1 << 16
+	client := &http.Client{Transport: transport}
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	ensure.True(t, transport.Underlying() == underlying)
+	ensure.DeepEqual(t, transport.Underlying().WriteBufferSize, 1<<16)
+}
+
+// dribblingServer responds to each request with headers trickled a byte at a
+// time, every interval.
+func dribblingServer(t *testing.T, interval time.Duration) (string, func()) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				if _, err := http.ReadRequest(bufio.NewReader(conn)); err != nil {
+					return
+				}
+				header := "HTTP/1.1 200 OK\r\nX-Slow: abcdefghij\r\nContent-Length: 2\r\n\r\n"
+				for i := range header {
+					if _, err := conn.Write([]byte{header[i]}); err != nil {
+						return
+					}
+					if i >= 9 {
+						time.Sleep(interval)
+					}
+				}
+				conn.Write(theAnswer)
+			}()
+		}
+	}()
+	return "http://" + ln.Addr().String(), func() { ln.Close() }
+}
+
+func TestStrictResponseHeaderTimeout(t *testing.T) {
+	t.Parallel()
+	addr, stop := dribblingServer(t, 5*time.Millisecond)
+	defer stop()
+
+	// The headers take longer than the timeout, but start in time.
+	transport := &httpcontrol.Transport{ResponseHeaderTimeout: 100 * time.Millisecond}
+	res, err := (&http.Client{Transport: transport}).Get(addr)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+
+	transport = &httpcontrol.Transport{
+		ResponseHeaderTimeout:       100 * time.Millisecond,
+		StrictResponseHeaderTimeout: true,
+	}
+	start := time.Now()
+	_, err = (&http.Client{Transport: transport}).Get(addr)
+	ensure.Err(t, err, regexp.MustCompile("timeout awaiting response headers"))
+	ensure.True(t, time.Since(start) < 250*time.Millisecond)
+}
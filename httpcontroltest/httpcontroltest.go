@@ -0,0 +1,109 @@
+// Package httpcontroltest provides utilities for testing code using
+// httpcontrol.Transport.
+//
+// A Recorder collects the Stats of the attempts made by a Transport:
+//
+//	var rec httpcontroltest.Recorder
+//	transport := &httpcontrol.Transport{MaxTries: 2, Stats: rec.Record}
+//	...
+//	if err := rec.LastError(); err != nil {
+//		t.Fatal(err)
+//	}
+package httpcontroltest
+
+import (
+	"sync"
+	"time"
+
+	"github.com/facebookgo/httpcontrol"
+)
+
+// Recorder records the Stats it is given. It is safe for concurrent use, and
+// its Record method is suitable for Transport.Stats and AddStatsObserver. The
+// zero value is ready to use.
+type Recorder struct {
+	mu      sync.Mutex
+	stats   []*httpcontrol.Stats
+	changed chan struct{} // closed when stats grows
+}
+
+// wait returns a channel closed once more Stats are recorded. It must be
+// called with the lock held.
+func (r *Recorder) wait() chan struct{} {
+	if r.changed == nil {
+		r.changed = make(chan struct{})
+	}
+	return r.changed
+}
+
+// Record records the Stats of an attempt.
+func (r *Recorder) Record(stats *httpcontrol.Stats) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stats = append(r.stats, stats)
+	close(r.wait())
+	r.changed = nil
+}
+
+// Stats returns the Stats recorded so far, in the order they were recorded.
+func (r *Recorder) Stats() []*httpcontrol.Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]*httpcontrol.Stats(nil), r.stats...)
+}
+
+// Last returns the Stats recorded last, or nil if there are none.
+func (r *Recorder) Last() *httpcontrol.Stats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.stats) == 0 {
+		return nil
+	}
+	return r.stats[len(r.stats)-1]
+}
+
+// LastError returns the Error of the Stats recorded last, or nil if there are
+// none.
+func (r *Recorder) LastError() error {
+	if last := r.Last(); last != nil {
+		return last.Error
+	}
+	return nil
+}
+
+// TryCount returns the number of attempts recorded. Attempts reporting a
+// pending retry are recorded as well, so a request that succeeded on its
+// second attempt counts two.
+func (r *Recorder) TryCount() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.stats)
+}
+
+// WaitForN waits until at least n attempts are recorded, for up to timeout.
+// It reports whether they were. This is useful as Stats may be reported after
+// the response is returned, such as once its body is closed.
+func (r *Recorder) WaitForN(n int, timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		r.mu.Lock()
+		count, changed := len(r.stats), r.wait()
+		r.mu.Unlock()
+		if count >= n {
+			return true
+		}
+		select {
+		case <-changed:
+		case <-timer.C:
+			return false
+		}
+	}
+}
+
+// Reset discards the Stats recorded so far.
+func (r *Recorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stats = nil
+}
@@ -0,0 +1,69 @@
+package httpcontroltest_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"github.com/facebookgo/httpcontrol"
+	"github.com/facebookgo/httpcontrol/httpcontroltest"
+)
+
+func TestRecorder(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&calls, 1) == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte("42"))
+		}))
+	defer server.Close()
+	var rec httpcontroltest.Recorder
+	transport := &httpcontrol.Transport{
+		MaxTries:      1,
+		RetryStatuses: []int{http.StatusServiceUnavailable},
+		Stats:         rec.Record,
+	}
+	client := &http.Client{Transport: transport}
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	ensure.Nil(t, res.Body.Close())
+
+	ensure.True(t, rec.WaitForN(2, time.Second))
+	ensure.DeepEqual(t, rec.TryCount(), 2)
+	ensure.Nil(t, rec.LastError())
+	stats := rec.Stats()
+	ensure.True(t, stats[0].Retry.Pending)
+	ensure.DeepEqual(t, stats[0].Response.StatusCode, http.StatusServiceUnavailable)
+	ensure.DeepEqual(t, rec.Last().Response.StatusCode, http.StatusOK)
+
+	rec.Reset()
+	ensure.DeepEqual(t, rec.TryCount(), 0)
+	ensure.True(t, rec.Last() == nil)
+}
+
+func TestRecorderLastError(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+	var rec httpcontroltest.Recorder
+	transport := &httpcontrol.Transport{}
+	transport.AddStatsObserver(rec.Record)
+	client := &http.Client{Transport: transport}
+	_, err := client.Get(server.URL)
+	ensure.NotNil(t, err)
+	ensure.DeepEqual(t, rec.TryCount(), 1)
+	ensure.NotNil(t, rec.LastError())
+}
+
+func TestRecorderWaitForNTimeout(t *testing.T) {
+	var rec httpcontroltest.Recorder
+	ensure.Nil(t, rec.LastError())
+	ensure.False(t, rec.WaitForN(1, 10*time.Millisecond))
+	go rec.Record(&httpcontrol.Stats{})
+	ensure.True(t, rec.WaitForN(1, time.Second))
+}
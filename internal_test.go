@@ -1,11 +1,16 @@
 package httpcontrol
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"net/url"
+	"syscall"
 	"testing"
 	"time"
 
@@ -24,7 +29,6 @@ func (t mockNetError) Timeout() bool   { return t.timeout }
 func TestShouldRetry(t *testing.T) {
 	r := Transport{RetryAfterTimeout: true}
 	cases := []error{
-		mockNetError{temporary: true},
 		mockNetError{timeout: true},
 		&url.Error{Err: mockNetError{timeout: true}},
 		errors.New("request canceled while waiting for connection"),
@@ -43,6 +47,37 @@ func TestShouldNotRetryRandomError(t *testing.T) {
 	ensure.False(t, r.shouldRetryError(errors.New("")))
 }
 
+func TestShouldNotRetryPermanentError(t *testing.T) {
+	r := Transport{RetryAfterTimeout: true}
+	cases := []error{
+		mockNetError{temporary: true},
+		&net.DNSError{Err: "no such host", Name: "example.invalid", IsNotFound: true},
+		&url.Error{Op: "Get", Err: &net.OpError{Op: "dial", Err: &net.DNSError{
+			Err: "no such host", Name: "example.invalid", IsNotFound: true,
+		}}},
+		errors.New("dial tcp: lookup example.invalid: no such host"),
+		&url.Error{Op: "Get", Err: x509.UnknownAuthorityError{}},
+		&tls.CertificateVerificationError{Err: x509.HostnameError{}},
+		fmt.Errorf("tls: %w", ErrPinMismatch),
+	}
+	for i, err := range cases {
+		ensure.False(t, r.shouldRetryError(err), fmt.Sprintf("case %d", i))
+	}
+}
+
+func TestRetryableErrorOverride(t *testing.T) {
+	custom := errors.New("custom")
+	r := Transport{
+		RetryableError: func(err error) bool {
+			return err == custom || (IsRetryableError(err) && err != io.EOF)
+		},
+	}
+	ensure.True(t, r.shouldRetryError(custom))
+	ensure.True(t, r.shouldRetryError(syscall.ECONNRESET))
+	ensure.False(t, r.shouldRetryError(io.EOF))
+	ensure.False(t, r.shouldRetryError(context.Canceled))
+}
+
 func TestCancelRequest(t *testing.T) {
 	var called bool
 	timer := time.AfterFunc(time.Hour, func() { called = true })
@@ -55,3 +90,197 @@ func TestCancelRequest(t *testing.T) {
 	ensure.False(t, called)
 	ensure.False(t, timer.Stop())
 }
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2015, 7, 8, 12, 0, 0, 0, time.UTC)
+	cases := []struct {
+		Value string
+		Wait  time.Duration
+		OK    bool
+	}{
+		{"", 0, false},
+		{"120", 2 * time.Minute, true},
+		{"0", 0, true},
+		{"-1", 0, false},
+		{"soon", 0, false},
+		{now.Add(time.Minute).Format(http.TimeFormat), time.Minute, true},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0, true},
+	}
+	for _, c := range cases {
+		wait, ok := parseRetryAfter(c.Value, now)
+		ensure.DeepEqual(t, wait, c.Wait, c.Value)
+		ensure.DeepEqual(t, ok, c.OK, c.Value)
+	}
+}
+
+func TestHappyEyeballsDialer(t *testing.T) {
+	tr := Transport{HappyEyeballs: true, HappyEyeballsDelay: time.Millisecond}
+	ensure.DeepEqual(t, tr.newDialer().FallbackDelay, time.Millisecond)
+	tr = Transport{HappyEyeballs: true}
+	ensure.DeepEqual(t, tr.newDialer().FallbackDelay, time.Duration(0))
+	tr = Transport{}
+	ensure.True(t, tr.newDialer().FallbackDelay < 0)
+}
+
+func TestTLSConfigUnchanged(t *testing.T) {
+	var tr Transport
+	ensure.True(t, tr.tlsConfig() == nil)
+	config := &tls.Config{}
+	tr.TLSClientConfig = config
+	ensure.True(t, tr.tlsConfig() == config)
+}
+
+func TestTLSConfigMerged(t *testing.T) {
+	suites := []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}
+	config := &tls.Config{ServerName: "a"}
+	tr := Transport{
+		TLSClientConfig: config,
+		MinTLSVersion:   tls.VersionTLS12,
+		CipherSuites:    suites,
+		Warn:            func(m string) { t.Fatal(m) },
+	}
+	merged := tr.tlsConfig()
+	ensure.DeepEqual(t, merged.MinVersion, uint16(tls.VersionTLS12))
+	ensure.DeepEqual(t, merged.CipherSuites, suites)
+	ensure.DeepEqual(t, merged.ServerName, "a")
+	ensure.DeepEqual(t, config.MinVersion, uint16(0))
+}
+
+func TestTLSConfigConflict(t *testing.T) {
+	var warnings []string
+	tr := Transport{
+		TLSClientConfig: &tls.Config{
+			MinVersion:   tls.VersionTLS13,
+			CipherSuites: []uint16{tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384},
+		},
+		MinTLSVersion: tls.VersionTLS12,
+		CipherSuites:  []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256},
+		Warn:          func(m string) { warnings = append(warnings, m) },
+	}
+	merged := tr.tlsConfig()
+	ensure.DeepEqual(t, merged.MinVersion, uint16(tls.VersionTLS13))
+	ensure.DeepEqual(t, merged.CipherSuites, tr.TLSClientConfig.CipherSuites)
+	ensure.DeepEqual(t, len(warnings), 2)
+}
+
+func TestIdleConnTimeoutPassthrough(t *testing.T) {
+	tr := &Transport{IdleConnTimeout: 42 * time.Second}
+	tr.startOnce.Do(tr.start)
+	ensure.DeepEqual(t, tr.transport.IdleConnTimeout, 42*time.Second)
+}
+
+func TestRetryBudgetDeposit(t *testing.T) {
+	tr := &Transport{RetryBudgetRatio: 0.5}
+	for i := 0; i < 10; i++ {
+		ensure.True(t, tr.retryBudgetWithdraw())
+	}
+	ensure.False(t, tr.retryBudgetWithdraw())
+	tr.retryBudgetDeposit()
+	ensure.False(t, tr.retryBudgetWithdraw())
+	tr.retryBudgetDeposit()
+	ensure.True(t, tr.retryBudgetWithdraw())
+	ensure.False(t, tr.retryBudgetWithdraw())
+}
+
+func TestDialKeepAliveConfig(t *testing.T) {
+	config := net.KeepAliveConfig{
+		Enable:   true,
+		Idle:     30 * time.Second,
+		Interval: 5 * time.Second,
+		Count:    3,
+	}
+	tr := &Transport{DialKeepAlive: time.Minute, DialKeepAliveConfig: config}
+	tr.startOnce.Do(tr.start)
+	ensure.DeepEqual(t, tr.dialer.KeepAlive, time.Minute)
+	ensure.DeepEqual(t, tr.dialer.KeepAliveConfig, config)
+}
+
+func TestFakeClockTimers(t *testing.T) {
+	c := NewFakeClock()
+	start := c.Now()
+	var fired []string
+	first := c.AfterFunc(time.Second, func() { fired = append(fired, "first") })
+	c.AfterFunc(2*time.Second, func() { fired = append(fired, "second") })
+	c.Advance(500 * time.Millisecond)
+	ensure.DeepEqual(t, len(fired), 0)
+	ensure.True(t, first.Reset(time.Second))
+	<-c.After(time.Second)
+	ensure.DeepEqual(t, fired, []string{"first"})
+	c.Sleep(time.Second)
+	ensure.DeepEqual(t, fired, []string{"first", "second"})
+	ensure.False(t, first.Stop())
+	ensure.DeepEqual(t, c.Now().Sub(start), 3*time.Second-500*time.Millisecond)
+}
+
+func TestDialTimeoutJitter(t *testing.T) {
+	const (
+		timeout   = time.Second
+		maxJitter = time.Second
+	)
+	tr := &Transport{DialTimeout: timeout, DialTimeoutJitter: maxJitter}
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < 100; i++ {
+		d := tr.dialTimeout()
+		ensure.True(t, d >= timeout && d <= timeout+maxJitter, d)
+		seen[d] = true
+	}
+	ensure.True(t, len(seen) > 1)
+
+	tr = &Transport{DialTimeoutJitter: maxJitter}
+	ensure.DeepEqual(t, tr.dialTimeout(), time.Duration(0))
+}
+
+func TestTLSSessionCacheClearedOnClose(t *testing.T) {
+	tr := &Transport{TLSSessionCache: true}
+	tr.startOnce.Do(tr.start)
+	cache := tr.transport.TLSClientConfig.ClientSessionCache
+	cache.Put("example.com:443", &tls.ClientSessionState{})
+	_, ok := cache.Get("example.com:443")
+	ensure.True(t, ok)
+	tr.Close()
+	_, ok = cache.Get("example.com:443")
+	ensure.False(t, ok)
+}
+
+func TestNoRetryHost(t *testing.T) {
+	tr := &Transport{NoRetryHosts: []string{
+		"pay.example.com",
+		"*.bank.example",
+		"api.example.org:8443",
+	}}
+	cases := []struct {
+		url   string
+		match bool
+	}{
+		{"https://pay.example.com/", true},
+		{"https://PAY.Example.COM:9000/", true},
+		{"https://example.com/", false},
+		{"https://x.pay.example.com/", false},
+		{"http://a.bank.example/", true},
+		{"http://a.b.BANK.example:8080/", true},
+		{"http://bank.example/", false},
+		{"http://notbank.example/", false},
+		{"https://api.example.org:8443/", true},
+		{"https://api.example.org/", false},
+	}
+	for _, c := range cases {
+		u, err := url.Parse(c.url)
+		ensure.Nil(t, err)
+		ensure.DeepEqual(t, tr.noRetryHost(u), c.match, c.url)
+	}
+
+	tr = &Transport{NoRetryHosts: []string{"api.example.org:443", "*.example.net:80"}}
+	for _, c := range []struct {
+		url   string
+		match bool
+	}{
+		{"https://api.example.org/", true},
+		{"http://api.example.org/", false},
+		{"http://www.example.net/", true},
+		{"https://www.example.net/", false},
+	} {
+		u, err := url.Parse(c.url)
+		ensure.Nil(t, err)
+		ensure.DeepEqual(t, tr.noRetryHost(u), c.match, c.url)
+	}
+}
@@ -0,0 +1,47 @@
+package httpcontrol
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+)
+
+// Logger receives the Stats of each attempt for audit logging.
+type Logger interface {
+	Log(*Stats)
+}
+
+type textLogger struct {
+	logger *log.Logger
+}
+
+// NewTextLogger returns a Logger that writes a line per attempt to l, with the
+// method, URL, status or error, try number and duration. If l is nil the
+// standard logger is used.
+func NewTextLogger(l *log.Logger) Logger {
+	return textLogger{logger: l}
+}
+
+func (l textLogger) Log(s *Stats) {
+	line := formatStats(s)
+	if l.logger == nil {
+		log.Print(line)
+		return
+	}
+	l.logger.Print(line)
+}
+
+func formatStats(s *Stats) string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s %s", s.Request.Method, s.Request.URL)
+	if s.Error != nil {
+		fmt.Fprintf(&buf, " error=%q", s.Error.Error())
+	} else if s.Response != nil {
+		fmt.Fprintf(&buf, " status=%d", s.Response.StatusCode)
+	}
+	fmt.Fprintf(&buf, " try=%d duration=%s", s.Retry.Count, s.Duration.Header+s.Duration.Body)
+	if s.Retry.Pending {
+		fmt.Fprintf(&buf, " retry-in=%s", s.Retry.Delay)
+	}
+	return buf.String()
+}
@@ -0,0 +1,71 @@
+package httpcontrol_test
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"github.com/facebookgo/httpcontrol"
+)
+
+type statsLogger []*httpcontrol.Stats
+
+func (l *statsLogger) Log(s *httpcontrol.Stats) {
+	*l = append(*l, s)
+}
+
+func TestLoggerIndependentOfStats(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(sleepHandler(time.Millisecond))
+	defer server.Close()
+	var logged statsLogger
+	transport := &httpcontrol.Transport{Logger: &logged}
+	client := &http.Client{Transport: transport}
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	ensure.DeepEqual(t, len(logged), 1)
+	ensure.DeepEqual(t, logged[0].Response.StatusCode, 200)
+}
+
+func TestTextLogger(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(statusThenAnswerHandler(http.StatusBadGateway, 1))
+	defer server.Close()
+	var buf bytes.Buffer
+	transport := &httpcontrol.Transport{
+		MaxTries:      1,
+		RetryStatuses: []int{http.StatusBadGateway},
+		Logger:        httpcontrol.NewTextLogger(log.New(&buf, "", 0)),
+	}
+	client := &http.Client{Transport: transport}
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	ensure.DeepEqual(t, len(lines), 2)
+	url := regexp.QuoteMeta(server.URL)
+	ensure.True(t, regexp.MustCompile(`^GET `+url+` status=502 try=0 duration=\S+ retry-in=0s$`).MatchString(lines[0]), lines[0])
+	ensure.True(t, regexp.MustCompile(`^GET `+url+` status=200 try=1 duration=\S+$`).MatchString(lines[1]), lines[1])
+}
+
+func TestTextLoggerError(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(sleepHandler(time.Millisecond))
+	server.Close()
+	var buf bytes.Buffer
+	transport := &httpcontrol.Transport{
+		Logger: httpcontrol.NewTextLogger(log.New(&buf, "", 0)),
+	}
+	client := &http.Client{Transport: transport}
+	_, err := client.Get(server.URL)
+	ensure.NotNil(t, err)
+	ensure.StringContains(t, buf.String(), " error=")
+	ensure.StringContains(t, buf.String(), "connection refused")
+}
@@ -0,0 +1,60 @@
+//go:build unix
+
+package httpcontrol_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"syscall"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+	"github.com/facebookgo/httpcontrol"
+)
+
+// noDelay returns the TCP_NODELAY option of conn.
+func noDelay(t *testing.T, conn net.Conn) bool {
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	ensure.Nil(t, err)
+	var v int
+	var serr error
+	ensure.Nil(t, raw.Control(func(fd uintptr) {
+		v, serr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, syscall.TCP_NODELAY)
+	}))
+	ensure.Nil(t, serr)
+	return v != 0
+}
+
+func TestTCPNoDelay(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(sleepHandler(0))
+	defer server.Close()
+	on, off := true, false
+	for _, c := range []struct {
+		setting *bool
+		want    bool
+	}{
+		{nil, true},
+		{&on, true},
+		{&off, false},
+	} {
+		var conn net.Conn
+		transport := &httpcontrol.Transport{
+			TCPNoDelay: c.setting,
+			DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				var d net.Dialer
+				var err error
+				conn, err = d.DialContext(ctx, network, address)
+				return conn, err
+			},
+		}
+		client := &http.Client{Transport: transport}
+		res, err := client.Get(server.URL)
+		ensure.Nil(t, err)
+		assertResponse(res, t)
+		ensure.DeepEqual(t, noDelay(t, conn), c.want)
+		transport.CloseIdleConnections()
+	}
+}
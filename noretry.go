@@ -0,0 +1,53 @@
+package httpcontrol
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// singleAttempt reports whether req must be made in a single attempt, because
+// of WithNoRetry or the NoRetryHosts.
+func (t *Transport) singleAttempt(req *http.Request) bool {
+	return noRetry(req.Context()) || t.noRetryHost(req.URL)
+}
+
+// noRetryHost reports whether the host of u matches one of the NoRetryHosts.
+func (t *Transport) noRetryHost(u *url.URL) bool {
+	if len(t.NoRetryHosts) == 0 {
+		return false
+	}
+	host, port := u.Hostname(), u.Port()
+	if port == "" {
+		switch u.Scheme {
+		case "http":
+			port = "80"
+		case "https":
+			port = "443"
+		}
+	}
+	for _, pattern := range t.NoRetryHosts {
+		if matchHost(pattern, host, port) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchHost reports whether pattern matches the host and port. The pattern is
+// a host name, optionally with a port, where a leading "*." matches any
+// subdomain. Without a port in the pattern any port matches.
+func matchHost(pattern, host, port string) bool {
+	if h, p, err := net.SplitHostPort(pattern); err == nil {
+		if p != port {
+			return false
+		}
+		pattern = h
+	}
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return len(host) > len(suffix)+1 &&
+			strings.EqualFold(host[len(host)-len(suffix)-1:], "."+suffix)
+	}
+	return strings.EqualFold(host, pattern)
+}
@@ -0,0 +1,44 @@
+package otel_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/facebookgo/httpcontrol"
+	"github.com/facebookgo/httpcontrol/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func Example() {
+	transport := &httpcontrol.Transport{
+		MaxTries:       2,
+		RequestTimeout: 10 * time.Second,
+		// Other Stats observers keep working alongside the spans.
+		Stats: func(s *httpcontrol.Stats) {},
+	}
+
+	// Mark the dials on the span of the caller, found in the context the
+	// Transport dials with.
+	dialer := &net.Dialer{Timeout: time.Second}
+	transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+		span := trace.SpanFromContext(ctx)
+		span.AddEvent("dial", trace.WithAttributes(attribute.String("server.address", address)))
+		return dialer.DialContext(ctx, network, address)
+	}
+
+	// Using the global TracerProvider.
+	otel.New(nil).Instrument(transport)
+	client := &http.Client{Transport: transport}
+
+	// The spans nest under the one in the context of the request.
+	req, err := http.NewRequestWithContext(context.Background(), "GET", "http://example.com/", nil)
+	if err != nil {
+		return
+	}
+	if res, err := client.Do(req); err == nil {
+		res.Body.Close()
+	}
+}
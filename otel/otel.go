@@ -0,0 +1,194 @@
+// Package otel creates OpenTelemetry spans for the requests made by an
+// httpcontrol.Transport: one for each RoundTrip, with a child for each of its
+// attempts carrying the status, error and retry number.
+//
+// It lives in a package of its own so that the core package does not import
+// the OpenTelemetry modules.
+//
+// The spans are built from the Stats and Summary the Transport reports, so
+// they start under the span found in the context of the request, and are
+// recorded with the times the attempts actually took.
+package otel
+
+import (
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/facebookgo/httpcontrol"
+	global "go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// instrumentation is the name of the Tracer creating the spans.
+const instrumentation = "github.com/facebookgo/httpcontrol/otel"
+
+// Tracer creates the spans of a Transport. Its Stats method must see every
+// attempt, and its Done method every RoundTrip, see Instrument.
+type Tracer struct {
+	tracer trace.Tracer
+
+	mu       sync.Mutex
+	requests map[*http.Request]*request
+}
+
+// request tracks the span of a RoundTrip. It is kept past the Summary until
+// every copy of a hedged request has reported its last attempt, so that the
+// attempts of a losing copy still nest under it.
+type request struct {
+	span   trace.Span
+	copies int  // the copies seen, 1 unless hedged
+	ended  int  // the copies which reported their last attempt
+	done   bool // the Summary was seen
+}
+
+// New returns a Tracer creating spans with the provider, or the global one if
+// it is nil.
+func New(provider trace.TracerProvider) *Tracer {
+	if provider == nil {
+		provider = global.GetTracerProvider()
+	}
+	return &Tracer{
+		tracer:   provider.Tracer(instrumentation),
+		requests: make(map[*http.Request]*request),
+	}
+}
+
+// Instrument adds the Tracer to the transport, as a stats observer and in
+// front of its Done function. Like other settings, it must be called before
+// the transport is first used.
+func (t *Tracer) Instrument(transport *httpcontrol.Transport) {
+	transport.AddStatsObserver(t.Stats)
+	done := transport.Done
+	transport.Done = func(s *httpcontrol.Summary) {
+		t.Done(s)
+		if done != nil {
+			done(s)
+		}
+	}
+}
+
+// Stats records the span of an attempt, and starts that of its RoundTrip
+// with the first one. It is suitable for Transport.Stats.
+func (t *Tracer) Stats(s *httpcontrol.Stats) {
+	end := time.Now()
+	if s.Retry.Pending {
+		// Reported once the backoff before the retry is over.
+		end = end.Add(-s.Retry.Delay)
+	}
+	start := end.Add(-(s.Duration.Header + s.Duration.Body))
+	parent := t.attempt(s, start)
+	ctx := trace.ContextWithSpan(s.Request.Context(), parent)
+	_, span := t.tracer.Start(ctx, "HTTP "+s.Request.Method+" attempt",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithTimestamp(start),
+		trace.WithAttributes(attemptAttributes(s)...),
+	)
+	if s.Error != nil {
+		span.RecordError(s.Error, trace.WithTimestamp(end))
+		span.SetStatus(codes.Error, s.Error.Error())
+	} else if s.Response != nil && s.Response.StatusCode >= 500 {
+		span.SetStatus(codes.Error, s.Response.Status)
+	}
+	span.End(trace.WithTimestamp(end))
+}
+
+// attempt accounts the attempt to its RoundTrip, and returns the span of the
+// RoundTrip, starting it at start with the first attempt.
+func (t *Tracer) attempt(s *httpcontrol.Stats, start time.Time) trace.Span {
+	req := s.Request
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	r, ok := t.requests[req]
+	if !ok {
+		r = &request{copies: 1, span: t.start(req, start)}
+		t.requests[req] = r
+	}
+	if s.Hedge.Copies > r.copies {
+		r.copies = s.Hedge.Copies
+	}
+	if !s.Retry.Pending {
+		r.ended++
+		if r.done && r.ended >= r.copies {
+			delete(t.requests, req)
+		}
+	}
+	return r.span
+}
+
+// start starts the span of the RoundTrip of req.
+func (t *Tracer) start(req *http.Request, start time.Time) trace.Span {
+	_, span := t.tracer.Start(req.Context(), "HTTP "+req.Method,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithTimestamp(start),
+		trace.WithAttributes(
+			attribute.String("http.request.method", req.Method),
+			attribute.String("url.full", req.URL.Redacted()),
+			attribute.String("server.address", req.URL.Hostname()),
+		),
+	)
+	return span
+}
+
+// Done ends the span of a RoundTrip, recording how it went. It is suitable
+// for Transport.Done.
+func (t *Tracer) Done(s *httpcontrol.Summary) {
+	t.mu.Lock()
+	r, ok := t.requests[s.Request]
+	if ok {
+		r.done = true
+		if r.ended >= r.copies {
+			delete(t.requests, s.Request)
+		}
+	}
+	t.mu.Unlock()
+	if !ok {
+		// No attempt was made.
+		return
+	}
+	span := r.span
+	span.SetAttributes(
+		attribute.Int("httpcontrol.tries", s.Tries),
+		attribute.Float64("httpcontrol.retry_delay", s.RetryDelay.Seconds()),
+	)
+	if s.Response != nil {
+		span.SetAttributes(attribute.Int("http.response.status_code", s.Response.StatusCode))
+	}
+	if s.Error != nil {
+		span.RecordError(s.Error)
+		span.SetStatus(codes.Error, s.Error.Error())
+	} else if s.Response != nil && s.Response.StatusCode >= 500 {
+		span.SetStatus(codes.Error, s.Response.Status)
+	}
+	span.End()
+}
+
+// attemptAttributes returns the attributes describing an attempt.
+func attemptAttributes(s *httpcontrol.Stats) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{
+		attribute.String("http.request.method", s.Request.Method),
+		attribute.String("url.full", s.Request.URL.Redacted()),
+		attribute.Int("http.request.resend_count", int(s.Retry.Count)),
+		attribute.Bool("httpcontrol.retry.pending", s.Retry.Pending),
+		attribute.Bool("httpcontrol.conn_reused", s.ConnReused),
+		attribute.Float64("httpcontrol.timing.dns", s.Timing.DNSResolve.Seconds()),
+		attribute.Float64("httpcontrol.timing.connect", s.Timing.Connect.Seconds()),
+		attribute.Float64("httpcontrol.timing.tls", s.Timing.TLSHandshake.Seconds()),
+		attribute.Float64("httpcontrol.timing.ttfb", s.TimeToFirstByte.Seconds()),
+	}
+	if s.RemoteAddr != "" {
+		attrs = append(attrs, attribute.String("network.peer.address", s.RemoteAddr))
+	}
+	if s.Protocol != "" {
+		attrs = append(attrs, attribute.String("httpcontrol.protocol", s.Protocol))
+	}
+	if s.Response != nil {
+		attrs = append(attrs, attribute.Int("http.response.status_code", s.Response.StatusCode))
+	}
+	if s.Hedge.Hedged {
+		attrs = append(attrs, attribute.Bool("httpcontrol.hedge", true))
+	}
+	return attrs
+}
@@ -0,0 +1,159 @@
+package otel_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"github.com/facebookgo/httpcontrol"
+	"github.com/facebookgo/httpcontrol/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func newTracer() (*otel.Tracer, *tracetest.SpanRecorder, *sdktrace.TracerProvider) {
+	recorder := tracetest.NewSpanRecorder()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+	return otel.New(provider), recorder, provider
+}
+
+func attr(span sdktrace.ReadOnlySpan, key attribute.Key) attribute.Value {
+	for _, kv := range span.Attributes() {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestSpans(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&calls, 1) == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte("42"))
+		}))
+	defer server.Close()
+
+	tracer, recorder, provider := newTracer()
+	transport := &httpcontrol.Transport{
+		MaxTries:      1,
+		RetryStatuses: []int{http.StatusServiceUnavailable},
+	}
+	var summaries int32
+	transport.Done = func(*httpcontrol.Summary) { atomic.AddInt32(&summaries, 1) }
+	tracer.Instrument(transport)
+	defer transport.Close()
+
+	ctx, caller := provider.Tracer("test").Start(context.Background(), "caller")
+	req, err := http.NewRequestWithContext(ctx, "GET", server.URL, nil)
+	ensure.Nil(t, err)
+	res, err := (&http.Client{Transport: transport}).Do(req)
+	ensure.Nil(t, err)
+	res.Body.Close()
+	caller.End()
+
+	ensure.DeepEqual(t, atomic.LoadInt32(&summaries), int32(1))
+	spans := recorder.Ended()
+	ensure.DeepEqual(t, len(spans), 4)
+	first, second, parent := spans[0], spans[1], spans[2]
+	ensure.DeepEqual(t, parent.Name(), "HTTP GET")
+	ensure.DeepEqual(t, parent.Parent().SpanID(), caller.SpanContext().SpanID())
+	ensure.DeepEqual(t, parent.SpanContext().TraceID(), caller.SpanContext().TraceID())
+	ensure.DeepEqual(t, attr(parent, "httpcontrol.tries").AsInt64(), int64(2))
+	ensure.DeepEqual(t, attr(parent, "http.response.status_code").AsInt64(), int64(200))
+	ensure.DeepEqual(t, parent.Status().Code, codes.Unset)
+
+	for i, span := range []sdktrace.ReadOnlySpan{first, second} {
+		ensure.DeepEqual(t, span.Name(), "HTTP GET attempt")
+		ensure.DeepEqual(t, span.Parent().SpanID(), parent.SpanContext().SpanID())
+		ensure.DeepEqual(t, attr(span, "http.request.resend_count").AsInt64(), int64(i))
+		ensure.False(t, span.StartTime().Before(parent.StartTime()))
+		ensure.False(t, span.EndTime().After(parent.EndTime()))
+	}
+	ensure.True(t, attr(first, "httpcontrol.retry.pending").AsBool())
+	ensure.DeepEqual(t, attr(first, "http.response.status_code").AsInt64(), int64(503))
+	ensure.DeepEqual(t, first.Status().Code, codes.Error)
+	ensure.False(t, attr(second, "httpcontrol.retry.pending").AsBool())
+	ensure.DeepEqual(t, attr(second, "http.response.status_code").AsInt64(), int64(200))
+	ensure.DeepEqual(t, second.Status().Code, codes.Unset)
+}
+
+func TestSpansError(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	server.Close()
+
+	tracer, recorder, _ := newTracer()
+	transport := &httpcontrol.Transport{}
+	tracer.Instrument(transport)
+	defer transport.Close()
+	_, err := (&http.Client{Transport: transport}).Get(server.URL)
+	ensure.NotNil(t, err)
+
+	spans := recorder.Ended()
+	ensure.DeepEqual(t, len(spans), 2)
+	attempt, parent := spans[0], spans[1]
+	ensure.False(t, parent.Parent().IsValid())
+	ensure.DeepEqual(t, attempt.Parent().SpanID(), parent.SpanContext().SpanID())
+	ensure.DeepEqual(t, attr(parent, "httpcontrol.tries").AsInt64(), int64(1))
+	for _, span := range spans {
+		ensure.DeepEqual(t, span.Status().Code, codes.Error)
+		ensure.DeepEqual(t, len(span.Events()), 1)
+		ensure.DeepEqual(t, span.Events()[0].Name, "exception")
+	}
+}
+
+func TestSpansHedgeLoser(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if atomic.AddInt32(&calls, 1) == 1 {
+				select {
+				case <-r.Context().Done():
+				case <-release:
+				}
+				return
+			}
+			w.Write([]byte("42"))
+		}))
+	defer server.Close()
+	defer close(release)
+
+	tracer, recorder, _ := newTracer()
+	transport := &httpcontrol.Transport{HedgeDelay: 1}
+	tracer.Instrument(transport)
+	defer transport.Close()
+	res, err := (&http.Client{Transport: transport}).Get(server.URL)
+	ensure.Nil(t, err)
+	res.Body.Close()
+
+	// The losing copy reports once cancelled, possibly after the Summary.
+	deadline := time.Now().Add(5 * time.Second)
+	for len(recorder.Ended()) < 3 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	spans := recorder.Ended()
+	ensure.DeepEqual(t, len(spans), 3)
+	var parent sdktrace.ReadOnlySpan
+	for _, span := range spans {
+		if span.Name() == "HTTP GET" {
+			parent = span
+		}
+	}
+	ensure.NotNil(t, parent)
+	for _, span := range spans {
+		if span != parent {
+			ensure.DeepEqual(t, span.Parent().SpanID(), parent.SpanContext().SpanID())
+		}
+	}
+}
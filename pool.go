@@ -0,0 +1,213 @@
+package httpcontrol
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+)
+
+// PoolStat is a point-in-time snapshot of the connection pool, as returned by
+// PoolStats. Connections are keyed by the address dialed, which is the proxy
+// when one is used.
+type PoolStat struct {
+	// The number of idle connections per address.
+	Idle map[string]int
+
+	// The number of connections currently serving a request. HTTP/2
+	// connections count as in use for as long as they are open.
+	InUse int
+
+	// Total connections dialed.
+	Dials uint64
+
+	// Total requests sent on a reused connection. A low ratio of Reused to
+	// Dials means connections are churning, for example because
+	// MaxIdleConnsPerHost is too low.
+	Reused uint64
+}
+
+// poolConn wraps the connections the Transport dials to follow them in and
+// out of the pool.
+type poolConn struct {
+	net.Conn
+	t       *Transport
+	addr    string
+	inUse   bool
+	once    sync.Once
+	written int64 // atomic bytes written, for staleConn
+
+	// For the OnConnClose, guarded by the poolMu.
+	shared  bool   // HTTP/2, so not closed along with a request
+	reason  string // why an attempt using it is about to close it
+	readErr bool   // a read failed, on the side of the server
+}
+
+func (c *poolConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if err != nil && c.t.OnConnClose != nil {
+		c.t.poolMu.Lock()
+		c.readErr = true
+		c.t.poolMu.Unlock()
+	}
+	return n, err
+}
+
+func (c *poolConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	atomic.AddInt64(&c.written, int64(n))
+	return n, err
+}
+
+// bytesWritten returns the bytes written to the connection so far. It is safe
+// to call on a nil connection.
+func (c *poolConn) bytesWritten() int64 {
+	if c == nil {
+		return 0
+	}
+	return atomic.LoadInt64(&c.written)
+}
+
+// asPoolConn returns the poolConn underlying c, which may be wrapped for TLS,
+// or nil if there is none.
+func asPoolConn(c net.Conn) *poolConn {
+	if nc, ok := c.(interface{ NetConn() net.Conn }); ok {
+		c = nc.NetConn()
+	}
+	pc, _ := c.(*poolConn)
+	return pc
+}
+
+func (c *poolConn) Close() error {
+	var reason string
+	c.once.Do(func() {
+		c.t.poolMu.Lock()
+		delete(c.t.pool, c)
+		reason = c.closeReason()
+		c.t.poolMu.Unlock()
+	})
+	err := c.Conn.Close()
+	if reason != "" && c.t.OnConnClose != nil {
+		c.t.callback(func() { c.t.OnConnClose(c.addr, reason) })
+	}
+	return err
+}
+
+// closeReason returns the reason the connection is being closed for the
+// OnConnClose. The poolMu must be held.
+func (c *poolConn) closeReason() string {
+	switch {
+	case c.reason != "":
+		return c.reason
+	case c.readErr:
+		return "server-close"
+	case !c.inUse:
+		return "idle"
+	}
+	return "closed"
+}
+
+// closeReasonCancel wraps the cancel function of the attempt so that the
+// timeouts cancelling it are given as the reason for closing its connection.
+func (t *Transport) closeReasonCancel(a *attempt, cancel context.CancelCauseFunc) context.CancelCauseFunc {
+	if t.OnConnClose == nil {
+		return cancel
+	}
+	return func(cause error) {
+		var reason string
+		switch cause {
+		case ErrRequestTimeout:
+			reason = "request-timeout"
+		case errResponseHeaderTimeout:
+			reason = "response-header-timeout"
+		case ErrResponseBodyTimeout:
+			reason = "response-body-timeout"
+		}
+		if reason != "" {
+			t.poolMu.Lock()
+			if c := a.conn; c != nil && c.inUse && !c.shared && c.reason == "" {
+				c.reason = reason
+			}
+			t.poolMu.Unlock()
+		}
+		cancel(cause)
+	}
+}
+
+// poolDialer wraps dial to register the connections it returns. New
+// connections count as idle until handed to a request.
+func (t *Transport) poolDialer(
+	dial func(ctx context.Context, network, address string) (net.Conn, error),
+) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		conn, err := dial(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		c := &poolConn{Conn: conn, t: t, addr: address}
+		t.poolMu.Lock()
+		if t.pool == nil {
+			t.pool = make(map[*poolConn]struct{})
+		}
+		t.pool[c] = struct{}{}
+		t.poolDials++
+		t.poolMu.Unlock()
+		return c, nil
+	}
+}
+
+// withPoolTrace returns a context that tracks the connection used by a
+// request, in addition to any ClientTrace already present in ctx. The
+// connection is also recorded in the attempt a, if non-nil.
+func (t *Transport) withPoolTrace(ctx context.Context, a *attempt) context.Context {
+	var conn *poolConn
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			var shared bool
+			if tc, ok := info.Conn.(*tls.Conn); ok {
+				shared = tc.ConnectionState().NegotiatedProtocol == "h2"
+			}
+			t.poolMu.Lock()
+			conn = asPoolConn(info.Conn)
+			if conn != nil {
+				conn.inUse = true
+				conn.shared = shared
+			}
+			if a != nil {
+				a.conn = conn
+			}
+			if info.Reused {
+				t.poolReused++
+			}
+			t.poolMu.Unlock()
+		},
+		PutIdleConn: func(err error) {
+			t.poolMu.Lock()
+			if conn != nil && err == nil {
+				conn.inUse = false
+			}
+			t.poolMu.Unlock()
+		},
+	})
+}
+
+// PoolStats returns a snapshot of the connection pool.
+func (t *Transport) PoolStats() PoolStat {
+	t.poolMu.Lock()
+	defer t.poolMu.Unlock()
+	stat := PoolStat{
+		Idle:   make(map[string]int),
+		Dials:  t.poolDials,
+		Reused: t.poolReused,
+	}
+	for c := range t.pool {
+		if c.inUse {
+			stat.InUse++
+		} else {
+			stat.Idle[c.addr]++
+		}
+	}
+	return stat
+}
@@ -0,0 +1,159 @@
+package httpcontrol_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"github.com/facebookgo/httpcontrol"
+)
+
+// waitIdle waits for the connections to addr to be returned to the pool,
+// which happens asynchronously after the response bodies are closed.
+func waitIdle(t *testing.T, transport *httpcontrol.Transport, addr string, idle int) httpcontrol.PoolStat {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		stat := transport.PoolStats()
+		if stat.Idle[addr] == idle || time.Now().After(deadline) {
+			return stat
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPoolStats(t *testing.T) {
+	t.Parallel()
+	const concurrent = 4
+	var arrived sync.WaitGroup
+	arrived.Add(concurrent)
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/block" {
+				arrived.Done()
+				<-release
+			}
+			w.Write(theAnswer)
+		}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	ensure.Nil(t, err)
+	transport := &httpcontrol.Transport{MaxIdleConnsPerHost: concurrent}
+	client := &http.Client{Transport: transport}
+
+	var wg sync.WaitGroup
+	for i := 0; i < concurrent; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := client.Get(server.URL + "/block")
+			ensure.Nil(t, err)
+			io.Copy(io.Discard, res.Body)
+			res.Body.Close()
+		}()
+	}
+	arrived.Wait()
+	stat := transport.PoolStats()
+	ensure.DeepEqual(t, stat.InUse, concurrent)
+	ensure.DeepEqual(t, stat.Idle[u.Host], 0)
+	close(release)
+	wg.Wait()
+
+	stat = waitIdle(t, transport, u.Host, concurrent)
+	ensure.DeepEqual(t, stat.InUse, 0)
+	ensure.DeepEqual(t, stat.Idle[u.Host], concurrent)
+	ensure.DeepEqual(t, stat.Dials, uint64(concurrent))
+	ensure.DeepEqual(t, stat.Reused, uint64(0))
+
+	for i := 0; i < concurrent; i++ {
+		res, err := client.Get(server.URL)
+		ensure.Nil(t, err)
+		assertResponse(res, t)
+	}
+	stat = waitIdle(t, transport, u.Host, concurrent)
+	ensure.DeepEqual(t, stat.Dials, uint64(concurrent))
+	ensure.DeepEqual(t, stat.Reused, uint64(concurrent))
+
+	transport.CloseIdleConnections()
+	stat = transport.PoolStats()
+	ensure.DeepEqual(t, stat.Idle[u.Host], 0)
+	ensure.DeepEqual(t, stat.InUse, 0)
+}
+
+// connCloses returns an OnConnClose function sending the reasons to the
+// channel.
+func connCloses() (func(addr, reason string), chan string) {
+	reasons := make(chan string, 10)
+	return func(addr, reason string) { reasons <- reason }, reasons
+}
+
+func waitReason(t *testing.T, reasons chan string) string {
+	select {
+	case reason := <-reasons:
+		return reason
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not closed")
+		return ""
+	}
+}
+
+func TestOnConnCloseTimeouts(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+		}))
+	defer server.Close()
+	for _, c := range []struct {
+		transport *httpcontrol.Transport
+		reason    string
+	}{
+		{&httpcontrol.Transport{RequestTimeout: 50 * time.Millisecond}, "request-timeout"},
+		{&httpcontrol.Transport{ResponseHeaderTimeout: 50 * time.Millisecond}, "response-header-timeout"},
+	} {
+		onClose, reasons := connCloses()
+		c.transport.OnConnClose = onClose
+		_, err := (&http.Client{Transport: c.transport}).Get(server.URL)
+		ensure.NotNil(t, err)
+		ensure.DeepEqual(t, waitReason(t, reasons), c.reason)
+		c.transport.Close()
+	}
+}
+
+func TestOnConnCloseIdleAndServer(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(sleepHandler(0))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	ensure.Nil(t, err)
+	onClose, reasons := connCloses()
+	var addrs []string
+	transport := &httpcontrol.Transport{
+		OnConnClose: func(addr, reason string) {
+			addrs = append(addrs, addr)
+			onClose(addr, reason)
+		},
+	}
+	defer transport.Close()
+	client := &http.Client{Transport: transport}
+
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	waitIdle(t, transport, u.Host, 1)
+	transport.CloseIdleConnections()
+	ensure.DeepEqual(t, waitReason(t, reasons), "idle")
+	ensure.DeepEqual(t, addrs, []string{u.Host})
+
+	res, err = client.Get(server.URL)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	waitIdle(t, transport, u.Host, 1)
+	server.CloseClientConnections()
+	ensure.DeepEqual(t, waitReason(t, reasons), "server-close")
+}
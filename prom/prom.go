@@ -0,0 +1,76 @@
+// Package prom provides a Prometheus exporter for httpcontrol.Stats.
+//
+// It lives in a package of its own so that only the programs exporting to
+// Prometheus import its client library.
+//
+// The metrics are labeled by the host of the request, i.e. Request.URL.Host.
+// Every distinct label value creates new time series, so this should only be
+// used with Transports that talk to a bounded set of hosts. Transports making
+// requests to arbitrary, user controlled hosts will produce unbounded
+// cardinality.
+package prom
+
+import (
+	"strconv"
+
+	"github.com/facebookgo/httpcontrol"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Stats registers the metrics with the registerer and returns a function
+// suitable for Transport.Stats that records into them. The following metrics
+// are recorded for each attempt:
+//
+//	httpcontrol_requests_total{host, code}
+//	httpcontrol_errors_total{host}
+//	httpcontrol_retries_total{host}
+//	httpcontrol_request_duration_seconds{host, code}
+//
+// The code label is empty for attempts that resulted in an error.
+func Stats(registerer prometheus.Registerer) (func(*httpcontrol.Stats), error) {
+	requests := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "httpcontrol",
+		Name:      "requests_total",
+		Help:      "Number of request attempts.",
+	}, []string{"host", "code"})
+	errors := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "httpcontrol",
+		Name:      "errors_total",
+		Help:      "Number of request attempts that resulted in an error.",
+	}, []string{"host"})
+	retries := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "httpcontrol",
+		Name:      "retries_total",
+		Help:      "Number of request attempts that were retried.",
+	}, []string{"host"})
+	duration := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "httpcontrol",
+		Name:      "request_duration_seconds",
+		Help:      "Duration of request attempts, including reading the body.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"host", "code"})
+	for _, c := range []prometheus.Collector{requests, errors, retries, duration} {
+		if err := registerer.Register(c); err != nil {
+			return nil, err
+		}
+	}
+
+	return func(s *httpcontrol.Stats) {
+		var host, code string
+		if s.Request != nil && s.Request.URL != nil {
+			host = s.Request.URL.Host
+		}
+		if s.Error == nil && s.Response != nil {
+			code = strconv.Itoa(s.Response.StatusCode)
+		}
+		requests.WithLabelValues(host, code).Inc()
+		if s.Error != nil {
+			errors.WithLabelValues(host).Inc()
+		}
+		if s.Retry.Pending {
+			retries.WithLabelValues(host).Inc()
+		}
+		d := s.Duration.Header + s.Duration.Body
+		duration.WithLabelValues(host, code).Observe(d.Seconds())
+	}, nil
+}
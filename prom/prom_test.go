@@ -0,0 +1,61 @@
+package prom_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+	"github.com/facebookgo/httpcontrol"
+	"github.com/facebookgo/httpcontrol/prom"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestStats(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("42"))
+		}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	ensure.Nil(t, err)
+
+	registry := prometheus.NewRegistry()
+	stats, err := prom.Stats(registry)
+	ensure.Nil(t, err)
+	client := &http.Client{Transport: &httpcontrol.Transport{Stats: stats}}
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	res.Body.Close()
+
+	ensure.DeepEqual(t, testutil.CollectAndCount(registry, "httpcontrol_requests_total"), 1)
+	ensure.DeepEqual(t, testutil.CollectAndCount(registry, "httpcontrol_request_duration_seconds"), 1)
+	ensure.DeepEqual(t, testutil.CollectAndCount(registry, "httpcontrol_errors_total"), 0)
+
+	server.Close()
+	_, err = client.Get(server.URL)
+	ensure.NotNil(t, err)
+	mfs, err := registry.Gather()
+	ensure.Nil(t, err)
+	var found bool
+	for _, mf := range mfs {
+		if mf.GetName() != "httpcontrol_errors_total" {
+			continue
+		}
+		found = true
+		m := mf.GetMetric()[0]
+		ensure.DeepEqual(t, m.GetLabel()[0].GetValue(), u.Host)
+		ensure.DeepEqual(t, m.GetCounter().GetValue(), float64(1))
+	}
+	ensure.True(t, found)
+}
+
+func TestStatsDuplicateRegistration(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	_, err := prom.Stats(registry)
+	ensure.Nil(t, err)
+	_, err = prom.Stats(registry)
+	ensure.NotNil(t, err)
+}
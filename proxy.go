@@ -0,0 +1,230 @@
+package httpcontrol
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	"golang.org/x/net/http/httpproxy"
+	"golang.org/x/net/proxy"
+)
+
+// ProxyConnectError is returned when a tunnel through an HTTP proxy could not
+// be established, either because the proxy could not be reached or because it
+// refused the CONNECT request. This tells proxy problems apart from failures
+// to reach the origin.
+type ProxyConnectError struct {
+	// The proxy address.
+	Proxy string
+
+	// The address the tunnel was requested to.
+	Addr string
+
+	// The status of the proxy response, zero if there was none.
+	StatusCode int
+	Status     string
+
+	// The error reaching the proxy or reading its response, nil if it
+	// responded with a non-200 status.
+	Err error
+}
+
+func (e *ProxyConnectError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("httpcontrol: proxy CONNECT to %s via %s: %s",
+			e.Addr, e.Proxy, e.Err)
+	}
+	return fmt.Sprintf("httpcontrol: proxy CONNECT to %s via %s: %s",
+		e.Addr, e.Proxy, e.Status)
+}
+
+func (e *ProxyConnectError) Unwrap() error {
+	return e.Err
+}
+
+// tunnel carries the proxy chosen for an attempt before it is made, to the
+// proxy function of the underlying transport and to the dialer.
+type tunnel struct {
+	url     *url.URL // the proxy the Transport connects through itself
+	forward *url.URL // the proxy left to the underlying transport
+}
+
+// isSOCKS reports whether u is a SOCKS5 proxy URL.
+func isSOCKS(u *url.URL) bool {
+	return u != nil && (u.Scheme == "socks5" || u.Scheme == "socks5h")
+}
+
+// withTunnel returns a copy of ctx that can record a proxy for dialing.
+func withTunnel(ctx context.Context) context.Context {
+	return context.WithValue(ctx, tunnelKey, &tunnel{})
+}
+
+// proxy is the proxy function of the underlying transport. It returns the
+// proxy chosen by chooseTunnel, which leaves only the plain HTTP requests
+// forwarded by a proxy to the underlying transport. Requests made directly
+// with the underlying transport get their proxy as they would from Proxy.
+func (t *Transport) proxy(req *http.Request) (*url.URL, error) {
+	if tn, ok := req.Context().Value(tunnelKey).(*tunnel); ok {
+		return tn.forward, nil
+	}
+	return t.proxyFor(req)
+}
+
+// chooseTunnel chooses the proxy for out ahead of the attempt, if its context
+// was made by withTunnel. The Transport handles SOCKS5 proxies and CONNECT
+// tunnels through HTTP proxies itself rather than leaving them to the
+// underlying transport, whose pool could then not tell the connections
+// through one proxy from those through another. The attempt is thus made with
+// a transport of its own for the proxy, see roundTripper.
+func (t *Transport) chooseTunnel(out *http.Request) error {
+	tn, ok := out.Context().Value(tunnelKey).(*tunnel)
+	if !ok {
+		return nil
+	}
+	u, err := t.proxyFor(out)
+	if err != nil || u == nil {
+		return err
+	}
+	connect := u.Scheme == "http" && (out.URL.Scheme == "https" || t.ProxyConnect)
+	if isSOCKS(u) || connect {
+		tn.url = u
+	} else {
+		tn.forward = u
+	}
+	return nil
+}
+
+// proxyFor returns the proxy for req from SetProxyURL, Proxy, or the
+// environment with DynamicProxyEnv, in that order.
+func (t *Transport) proxyFor(req *http.Request) (*url.URL, error) {
+	var u *url.URL
+	var err error
+	t.proxyMu.Lock()
+	set, setURL := t.proxySet, t.proxyURL
+	t.proxyMu.Unlock()
+	switch {
+	case set:
+		u = setURL
+	case t.Proxy != nil:
+		u, err = t.Proxy(req)
+	case t.DynamicProxyEnv:
+		u, err = httpproxy.FromEnvironment().ProxyFunc()(req.URL)
+	}
+	return u, err
+}
+
+// SetProxyURL sets the proxy used for subsequent requests, overriding Proxy
+// and DynamicProxyEnv, or makes them connect directly if u is nil. It is safe
+// to call at any time. Attempts already in flight keep the proxy they
+// started with, while idle connections are closed so later ones dial through
+// the new proxy rather than reusing a tunnel through the old one.
+func (t *Transport) SetProxyURL(u *url.URL) {
+	if u != nil {
+		u2 := *u
+		u = &u2
+	}
+	t.proxyMu.Lock()
+	t.proxySet, t.proxyURL = true, u
+	t.proxyMu.Unlock()
+	t.CloseIdleConnections()
+}
+
+// tunnelDialer wraps dial so connections for requests using a SOCKS5 proxy
+// or a CONNECT tunnel are made through it. The proxy itself is reached using
+// dial, and DialTimeout bounds the whole connection including the handshake
+// with the proxy.
+func (t *Transport) tunnelDialer(dial func(ctx context.Context, network, address string) (net.Conn, error)) func(ctx context.Context, network, address string) (net.Conn, error) {
+	return func(ctx context.Context, network, address string) (net.Conn, error) {
+		tn, ok := ctx.Value(tunnelKey).(*tunnel)
+		if !ok || tn.url == nil {
+			return dial(ctx, network, address)
+		}
+		if timeout := t.dialTimeout(); timeout != 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		if !isSOCKS(tn.url) {
+			return connect(ctx, dial, tn.url, network, address)
+		}
+		d, err := proxy.FromURL(tn.url, contextDialer(dial))
+		if err != nil {
+			return nil, err
+		}
+		return d.(proxy.ContextDialer).DialContext(ctx, network, address)
+	}
+}
+
+// connect dials the HTTP proxy u and asks it for a tunnel to address, with
+// authentication taken from the URL userinfo.
+func connect(
+	ctx context.Context,
+	dial func(ctx context.Context, network, address string) (net.Conn, error),
+	u *url.URL,
+	network, address string,
+) (net.Conn, error) {
+	proxyAddr := u.Host
+	if u.Port() == "" {
+		proxyAddr = net.JoinHostPort(u.Hostname(), "80")
+	}
+	fail := func(err error) error {
+		return &ProxyConnectError{Proxy: proxyAddr, Addr: address, Err: err}
+	}
+	conn, err := dial(ctx, network, proxyAddr)
+	if err != nil {
+		return nil, fail(err)
+	}
+	// Closing the connection aborts the handshake when ctx is done.
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: make(http.Header),
+	}
+	if u.User != nil {
+		pass, _ := u.User.Password()
+		auth := u.User.Username() + ":" + pass
+		req.Header.Set("Proxy-Authorization",
+			"Basic "+base64.StdEncoding.EncodeToString([]byte(auth)))
+	}
+	var res *http.Response
+	err = req.Write(conn)
+	if err == nil {
+		res, err = http.ReadResponse(bufio.NewReader(conn), req)
+	}
+	if !stop() {
+		conn.Close()
+		return nil, fail(context.Cause(ctx))
+	}
+	if err != nil {
+		conn.Close()
+		return nil, fail(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, &ProxyConnectError{
+			Proxy:      proxyAddr,
+			Addr:       address,
+			StatusCode: res.StatusCode,
+			Status:     res.Status,
+		}
+	}
+	return conn, nil
+}
+
+// contextDialer adapts a dial function to a proxy.ContextDialer.
+type contextDialer func(ctx context.Context, network, address string) (net.Conn, error)
+
+func (d contextDialer) Dial(network, address string) (net.Conn, error) {
+	return d(context.Background(), network, address)
+}
+
+func (d contextDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return d(ctx, network, address)
+}
@@ -0,0 +1,481 @@
+package httpcontrol_test
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"github.com/facebookgo/httpcontrol"
+)
+
+// socks5Server is a minimal SOCKS5 server supporting username/password
+// authentication and the CONNECT command.
+type socks5Server struct {
+	listener net.Listener
+	user     string
+	pass     string
+	conns    int32
+}
+
+func newSOCKS5Server(t *testing.T, user, pass string) *socks5Server {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	s := &socks5Server{listener: l, user: user, pass: pass}
+	go s.serve()
+	return s
+}
+
+func (s *socks5Server) URL() *url.URL {
+	return &url.URL{
+		Scheme: "socks5",
+		User:   url.UserPassword(s.user, s.pass),
+		Host:   s.listener.Addr().String(),
+	}
+}
+
+func (s *socks5Server) Close() { s.listener.Close() }
+
+func (s *socks5Server) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			upstream, err := s.handshake(conn)
+			if err != nil {
+				return
+			}
+			defer upstream.Close()
+			atomic.AddInt32(&s.conns, 1)
+			go io.Copy(upstream, conn)
+			io.Copy(conn, upstream)
+		}()
+	}
+}
+
+func (s *socks5Server) handshake(conn net.Conn) (net.Conn, error) {
+	buf := make([]byte, 256)
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(conn, buf[:buf[1]]); err != nil {
+		return nil, err
+	}
+	conn.Write([]byte{5, 2})
+
+	// Username/password authentication, RFC 1929.
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return nil, err
+	}
+	user := make([]byte, buf[1])
+	if _, err := io.ReadFull(conn, user); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+		return nil, err
+	}
+	pass := make([]byte, buf[0])
+	if _, err := io.ReadFull(conn, pass); err != nil {
+		return nil, err
+	}
+	if string(user) != s.user || string(pass) != s.pass {
+		conn.Write([]byte{1, 1})
+		return nil, errors.New("bad credentials")
+	}
+	conn.Write([]byte{1, 0})
+
+	if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+		return nil, err
+	}
+	var host string
+	switch buf[3] {
+	case 1:
+		if _, err := io.ReadFull(conn, buf[:4]); err != nil {
+			return nil, err
+		}
+		host = net.IP(buf[:4]).String()
+	case 3:
+		if _, err := io.ReadFull(conn, buf[:1]); err != nil {
+			return nil, err
+		}
+		n := int(buf[0])
+		if _, err := io.ReadFull(conn, buf[:n]); err != nil {
+			return nil, err
+		}
+		host = string(buf[:n])
+	case 4:
+		if _, err := io.ReadFull(conn, buf[:16]); err != nil {
+			return nil, err
+		}
+		host = net.IP(buf[:16]).String()
+	}
+	if _, err := io.ReadFull(conn, buf[:2]); err != nil {
+		return nil, err
+	}
+	port := binary.BigEndian.Uint16(buf[:2])
+	upstream, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(int(port))))
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return nil, err
+	}
+	conn.Write([]byte{5, 0, 0, 1, 0, 0, 0, 0, 0, 0})
+	return upstream, nil
+}
+
+func TestSOCKS5Proxy(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(sleepHandler(0))
+	defer server.Close()
+	socks := newSOCKS5Server(t, "user", "secret")
+	defer socks.Close()
+	transport := &httpcontrol.Transport{
+		Proxy:       http.ProxyURL(socks.URL()),
+		DialTimeout: time.Second,
+	}
+	client := &http.Client{Transport: transport}
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	ensure.DeepEqual(t, atomic.LoadInt32(&socks.conns), int32(1))
+}
+
+func TestSOCKS5ProxyBadCredentials(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(sleepHandler(0))
+	defer server.Close()
+	socks := newSOCKS5Server(t, "user", "secret")
+	defer socks.Close()
+	u := socks.URL()
+	u.User = url.UserPassword("user", "wrong")
+	transport := &httpcontrol.Transport{
+		Proxy:       http.ProxyURL(u),
+		DialTimeout: time.Second,
+	}
+	client := &http.Client{Transport: transport}
+	_, err := client.Get(server.URL)
+	ensure.NotNil(t, err)
+	ensure.DeepEqual(t, atomic.LoadInt32(&socks.conns), int32(0))
+}
+
+// connectProxy is a minimal HTTP proxy only supporting CONNECT, with basic
+// authentication.
+type connectProxy struct {
+	listener net.Listener
+	auth     string
+	tunnels  int32
+}
+
+func newConnectProxy(t *testing.T, user, pass string) *connectProxy {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	auth := base64.StdEncoding.EncodeToString([]byte(user + ":" + pass))
+	p := &connectProxy{listener: l, auth: "Basic " + auth}
+	go p.serve()
+	return p
+}
+
+func (p *connectProxy) URL(user, pass string) *url.URL {
+	return &url.URL{
+		Scheme: "http",
+		User:   url.UserPassword(user, pass),
+		Host:   p.listener.Addr().String(),
+	}
+}
+
+func (p *connectProxy) Close() { p.listener.Close() }
+
+func (p *connectProxy) serve() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			req, err := http.ReadRequest(bufio.NewReader(conn))
+			if err != nil {
+				return
+			}
+			if req.Method != http.MethodConnect {
+				io.WriteString(conn, "HTTP/1.1 405 Method Not Allowed\r\n\r\n")
+				return
+			}
+			if req.Header.Get("Proxy-Authorization") != p.auth {
+				io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+				return
+			}
+			upstream, err := net.Dial("tcp", req.Host)
+			if err != nil {
+				io.WriteString(conn, "HTTP/1.1 502 Bad Gateway\r\n\r\n")
+				return
+			}
+			defer upstream.Close()
+			atomic.AddInt32(&p.tunnels, 1)
+			io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+			go io.Copy(upstream, conn)
+			io.Copy(conn, upstream)
+		}()
+	}
+}
+
+func TestConnectProxyHTTPS(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewTLSServer(sleepHandler(0))
+	defer server.Close()
+	p := newConnectProxy(t, "user", "secret")
+	defer p.Close()
+	transport := &httpcontrol.Transport{
+		TLSClientConfig: server.Client().Transport.(*http.Transport).TLSClientConfig,
+		Proxy:           http.ProxyURL(p.URL("user", "secret")),
+		DialTimeout:     time.Second,
+	}
+	client := &http.Client{Transport: transport}
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	ensure.DeepEqual(t, atomic.LoadInt32(&p.tunnels), int32(1))
+}
+
+func TestProxyConnect(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(sleepHandler(0))
+	defer server.Close()
+	p := newConnectProxy(t, "user", "secret")
+	defer p.Close()
+	transport := &httpcontrol.Transport{
+		Proxy:        http.ProxyURL(p.URL("user", "secret")),
+		ProxyConnect: true,
+		DialTimeout:  time.Second,
+	}
+	client := &http.Client{Transport: transport}
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	ensure.DeepEqual(t, atomic.LoadInt32(&p.tunnels), int32(1))
+}
+
+func TestProxyConnectBadCredentials(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(sleepHandler(0))
+	defer server.Close()
+	p := newConnectProxy(t, "user", "secret")
+	defer p.Close()
+	var stats *httpcontrol.Stats
+	transport := &httpcontrol.Transport{
+		Proxy:        http.ProxyURL(p.URL("user", "wrong")),
+		ProxyConnect: true,
+		Stats:        func(s *httpcontrol.Stats) { stats = s },
+	}
+	client := &http.Client{Transport: transport}
+	_, err := client.Get(server.URL)
+	ensure.NotNil(t, err)
+	var pce *httpcontrol.ProxyConnectError
+	ensure.True(t, errors.As(err, &pce))
+	ensure.DeepEqual(t, pce.StatusCode, http.StatusProxyAuthRequired)
+	ensure.True(t, stats.ProxyError)
+	ensure.DeepEqual(t, atomic.LoadInt32(&p.tunnels), int32(0))
+}
+
+func TestProxyConnectOriginFailure(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(sleepHandler(0))
+	server.Close()
+	var stats *httpcontrol.Stats
+	transport := &httpcontrol.Transport{
+		Stats: func(s *httpcontrol.Stats) { stats = s },
+	}
+	client := &http.Client{Transport: transport}
+	_, err := client.Get(server.URL)
+	ensure.NotNil(t, err)
+	ensure.False(t, stats.ProxyError)
+}
+
+func TestProxyConnectUnreachableProxy(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(sleepHandler(0))
+	defer server.Close()
+	p := newConnectProxy(t, "user", "secret")
+	u := p.URL("user", "secret")
+	p.Close()
+	var stats *httpcontrol.Stats
+	transport := &httpcontrol.Transport{
+		Proxy:        http.ProxyURL(u),
+		ProxyConnect: true,
+		Stats:        func(s *httpcontrol.Stats) { stats = s },
+	}
+	client := &http.Client{Transport: transport}
+	_, err := client.Get(server.URL)
+	ensure.NotNil(t, err)
+	var pce *httpcontrol.ProxyConnectError
+	ensure.True(t, errors.As(err, &pce))
+	ensure.DeepEqual(t, pce.StatusCode, 0)
+	ensure.True(t, stats.ProxyError)
+}
+
+// proxyServer is an HTTP proxy answering requests itself, counting them.
+func proxyServer(count *int32) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(count, 1)
+			w.Write(theAnswer)
+		}))
+}
+
+func TestDynamicProxyEnv(t *testing.T) {
+	var first, second int32
+	proxy1 := proxyServer(&first)
+	defer proxy1.Close()
+	proxy2 := proxyServer(&second)
+	defer proxy2.Close()
+	t.Setenv("HTTP_PROXY", proxy1.URL)
+	t.Setenv("NO_PROXY", "")
+	transport := &httpcontrol.Transport{DynamicProxyEnv: true}
+	client := &http.Client{Transport: transport}
+
+	res, err := client.Get("http://example.invalid/")
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	ensure.DeepEqual(t, atomic.LoadInt32(&first), int32(1))
+
+	t.Setenv("HTTP_PROXY", proxy2.URL)
+	res, err = client.Get("http://example.invalid/")
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	ensure.DeepEqual(t, atomic.LoadInt32(&first), int32(1))
+	ensure.DeepEqual(t, atomic.LoadInt32(&second), int32(1))
+}
+
+func TestDynamicProxyEnvStaticProxyWins(t *testing.T) {
+	var env, static int32
+	envProxy := proxyServer(&env)
+	defer envProxy.Close()
+	staticProxy := proxyServer(&static)
+	defer staticProxy.Close()
+	t.Setenv("HTTP_PROXY", envProxy.URL)
+	u, err := url.Parse(staticProxy.URL)
+	ensure.Nil(t, err)
+	transport := &httpcontrol.Transport{
+		Proxy:           http.ProxyURL(u),
+		DynamicProxyEnv: true,
+	}
+	client := &http.Client{Transport: transport}
+	res, err := client.Get("http://example.invalid/")
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	ensure.DeepEqual(t, atomic.LoadInt32(&env), int32(0))
+	ensure.DeepEqual(t, atomic.LoadInt32(&static), int32(1))
+}
+
+func TestSetProxyURL(t *testing.T) {
+	t.Parallel()
+	var first, second int32
+	proxy1 := proxyServer(&first)
+	defer proxy1.Close()
+	proxy2 := proxyServer(&second)
+	defer proxy2.Close()
+	server := httptest.NewServer(sleepHandler(0))
+	defer server.Close()
+	u1, err := url.Parse(proxy1.URL)
+	ensure.Nil(t, err)
+	u2, err := url.Parse(proxy2.URL)
+	ensure.Nil(t, err)
+	transport := &httpcontrol.Transport{Proxy: http.ProxyURL(u1)}
+	client := &http.Client{Transport: transport}
+
+	res, err := client.Get("http://example.invalid/")
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	ensure.DeepEqual(t, atomic.LoadInt32(&first), int32(1))
+
+	transport.SetProxyURL(u2)
+	res, err = client.Get("http://example.invalid/")
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	ensure.DeepEqual(t, atomic.LoadInt32(&first), int32(1))
+	ensure.DeepEqual(t, atomic.LoadInt32(&second), int32(1))
+
+	transport.SetProxyURL(nil)
+	res, err = client.Get(server.URL)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	ensure.DeepEqual(t, atomic.LoadInt32(&first), int32(1))
+	ensure.DeepEqual(t, atomic.LoadInt32(&second), int32(1))
+}
+
+func TestSetProxyURLClosesTunnels(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(sleepHandler(0))
+	defer server.Close()
+	p1 := newConnectProxy(t, "user", "secret")
+	defer p1.Close()
+	p2 := newConnectProxy(t, "user", "secret")
+	defer p2.Close()
+	transport := &httpcontrol.Transport{
+		Proxy:        http.ProxyURL(p1.URL("user", "secret")),
+		ProxyConnect: true,
+		DialTimeout:  time.Second,
+	}
+	client := &http.Client{Transport: transport}
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	ensure.DeepEqual(t, atomic.LoadInt32(&p1.tunnels), int32(1))
+
+	// The idle tunnel through the first proxy is not reused.
+	transport.SetProxyURL(p2.URL("user", "secret"))
+	res, err = client.Get(server.URL)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	ensure.DeepEqual(t, atomic.LoadInt32(&p1.tunnels), int32(1))
+	ensure.DeepEqual(t, atomic.LoadInt32(&p2.tunnels), int32(1))
+}
+
+func TestProxyTunnelsPooledByProxy(t *testing.T) {
+	t.Parallel()
+	plain := httptest.NewServer(sleepHandler(0))
+	defer plain.Close()
+	secure := httptest.NewTLSServer(sleepHandler(0))
+	defer secure.Close()
+	for _, server := range []*httptest.Server{plain, secure} {
+		p1 := newConnectProxy(t, "user", "secret")
+		defer p1.Close()
+		p2 := newConnectProxy(t, "user", "secret")
+		defer p2.Close()
+		var n int32
+		transport := &httpcontrol.Transport{
+			TLSClientConfig: secure.Client().Transport.(*http.Transport).TLSClientConfig,
+			Proxy: func(*http.Request) (*url.URL, error) {
+				if atomic.AddInt32(&n, 1)%2 == 1 {
+					return p1.URL("user", "secret"), nil
+				}
+				return p2.URL("user", "secret"), nil
+			},
+			ProxyConnect: true,
+			DialTimeout:  time.Second,
+		}
+		client := &http.Client{Transport: transport}
+
+		// Each proxy gets a tunnel of its own, which is then reused.
+		for i := 0; i < 4; i++ {
+			res, err := client.Get(server.URL)
+			ensure.Nil(t, err)
+			assertResponse(res, t)
+		}
+		ensure.DeepEqual(t, atomic.LoadInt32(&p1.tunnels), int32(1))
+		ensure.DeepEqual(t, atomic.LoadInt32(&p2.tunnels), int32(1))
+		transport.Close()
+	}
+}
@@ -0,0 +1,58 @@
+package httpcontrol
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// ErrRateLimited is returned when the rate limiter would delay a request past
+// its deadline.
+var ErrRateLimited = errors.New("httpcontrol: rate limited")
+
+// rateLimiter returns the limiter to use, if any.
+func (t *Transport) rateLimiter() *rate.Limiter {
+	if t.Limiter != nil {
+		return t.Limiter
+	}
+	if t.RateLimit <= 0 {
+		return nil
+	}
+	burst := t.RateBurst
+	if burst <= 0 {
+		burst = 1
+	}
+	return rate.NewLimiter(t.RateLimit, burst)
+}
+
+// waitRate waits for a token from the rate limiter. It fails fast with
+// ErrRateLimited if the wait would extend past the deadline, when non-zero.
+func (t *Transport) waitRate(ctx context.Context, deadline time.Time) error {
+	if t.limiter == nil {
+		return nil
+	}
+	now := time.Now()
+	r := t.limiter.ReserveN(now, 1)
+	if !r.OK() {
+		return ErrRateLimited
+	}
+	delay := r.DelayFrom(now)
+	if delay == 0 {
+		return nil
+	}
+	if !deadline.IsZero() && now.Add(delay).After(deadline) {
+		r.CancelAt(now)
+		return ErrRateLimited
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		r.Cancel()
+		return context.Cause(ctx)
+	}
+}
@@ -0,0 +1,107 @@
+package httpcontrol_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"github.com/facebookgo/httpcontrol"
+	"golang.org/x/time/rate"
+)
+
+func TestRateLimitWaits(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(sleepHandler(0))
+	defer server.Close()
+	transport := &httpcontrol.Transport{RateLimit: 20}
+	client := &http.Client{Transport: transport}
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		res, err := client.Get(server.URL)
+		ensure.Nil(t, err)
+		assertResponse(res, t)
+	}
+	if elapsed := time.Since(start); elapsed < 90*time.Millisecond {
+		t.Fatalf("expected rate limited requests, took %s", elapsed)
+	}
+}
+
+func TestRateLimitExceedsDeadline(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(sleepHandler(0))
+	defer server.Close()
+	transport := &httpcontrol.Transport{
+		RateLimit:      1,
+		RequestTimeout: 100 * time.Millisecond,
+	}
+	client := &http.Client{Transport: transport}
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	start := time.Now()
+	_, err = client.Get(server.URL)
+	ensure.Err(t, err, regexp.MustCompile("rate limited"))
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Fatalf("expected fast failure, took %s", elapsed)
+	}
+}
+
+func TestSharedLimiter(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(sleepHandler(0))
+	defer server.Close()
+	limiter := rate.NewLimiter(rate.Every(time.Hour), 1)
+	for i, expectErr := range []bool{false, true} {
+		transport := &httpcontrol.Transport{
+			Limiter:        limiter,
+			RequestTimeout: time.Second,
+		}
+		client := &http.Client{Transport: transport}
+		res, err := client.Get(server.URL)
+		if expectErr {
+			ensure.True(t, errors.Is(err, httpcontrol.ErrRateLimited), i)
+			continue
+		}
+		ensure.Nil(t, err)
+		assertResponse(res, t)
+	}
+}
+
+func TestRateLimitDoesNotOpenCircuit(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(sleepHandler(0))
+	defer server.Close()
+	limiter := rate.NewLimiter(rate.Every(time.Hour), 1)
+	transport := &httpcontrol.Transport{
+		Limiter:          limiter,
+		RequestTimeout:   100 * time.Millisecond,
+		CircuitThreshold: 2,
+		CircuitCooldown:  time.Hour,
+	}
+	defer transport.Close()
+	client := &http.Client{Transport: transport}
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+
+	// The burst is throttled locally, without the host being contacted.
+	for i := 0; i < 5; i++ {
+		_, err = client.Get(server.URL)
+		ensure.True(t, errors.Is(err, httpcontrol.ErrRateLimited), err)
+	}
+	u, err := url.Parse(server.URL)
+	ensure.Nil(t, err)
+	stat := transport.HostStats()[u.Host]
+	ensure.DeepEqual(t, stat.Errors, uint64(0))
+	ensure.DeepEqual(t, stat.Circuit, "closed")
+
+	limiter.SetLimit(rate.Inf)
+	res, err = client.Get(server.URL)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+}
@@ -0,0 +1,157 @@
+package httpcontrol_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+	"github.com/facebookgo/httpcontrol"
+)
+
+// redirectServer redirects /a to /b with a 307, and fails the first request
+// to /b with a 503. It echoes the request body otherwise, and records the
+// bodies it received.
+func redirectServer() (*httptest.Server, func() []string) {
+	var mu sync.Mutex
+	var bodies []string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/a", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, "a:"+string(body))
+		mu.Unlock()
+		http.Redirect(w, r, "/b", http.StatusTemporaryRedirect)
+	})
+	mux.HandleFunc("/b", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		bodies = append(bodies, "b:"+string(body))
+		first := len(bodies) == 2
+		mu.Unlock()
+		if first {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write(body)
+	})
+	server := httptest.NewServer(mux)
+	return server, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), bodies...)
+	}
+}
+
+func TestRedirectThenRetry(t *testing.T) {
+	t.Parallel()
+	server, bodies := redirectServer()
+	defer server.Close()
+	transport := &httpcontrol.Transport{
+		MaxTries:      1,
+		RetryStatuses: []int{http.StatusServiceUnavailable},
+	}
+	defer transport.Close()
+	var redirects []int
+	transport.Stats = func(s *httpcontrol.Stats) {
+		redirects = append(redirects, s.RedirectCount)
+	}
+	req, err := http.NewRequest("PUT", server.URL+"/a", strings.NewReader("hello"))
+	ensure.Nil(t, err)
+	res, err := (&http.Client{Transport: transport}).Do(req)
+	ensure.Nil(t, err)
+	body, err := ioutil.ReadAll(res.Body)
+	ensure.Nil(t, err)
+	ensure.Nil(t, res.Body.Close())
+	ensure.DeepEqual(t, res.StatusCode, http.StatusOK)
+	ensure.DeepEqual(t, string(body), "hello")
+	ensure.DeepEqual(t, bodies(), []string{"a:hello", "b:hello", "b:hello"})
+	ensure.DeepEqual(t, redirects, []int{0, 1, 1})
+}
+
+func TestManualRedirectThenRetry(t *testing.T) {
+	t.Parallel()
+	server, bodies := redirectServer()
+	defer server.Close()
+	transport := &httpcontrol.Transport{
+		MaxTries:      1,
+		RetryStatuses: []int{http.StatusServiceUnavailable},
+	}
+	defer transport.Close()
+	client := &http.Client{
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	req, err := http.NewRequest("PUT", server.URL+"/a", strings.NewReader("hello"))
+	ensure.Nil(t, err)
+	res, err := client.Do(req)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, res.StatusCode, http.StatusTemporaryRedirect)
+	ensure.Nil(t, res.Body.Close())
+
+	// The Request of the response still gives a fresh copy of the body.
+	location, err := res.Location()
+	ensure.Nil(t, err)
+	body, err := res.Request.GetBody()
+	ensure.Nil(t, err)
+	next, err := http.NewRequest("PUT", location.String(), body)
+	ensure.Nil(t, err)
+	next.GetBody = res.Request.GetBody
+	next.ContentLength = res.Request.ContentLength
+	res, err = client.Do(next)
+	ensure.Nil(t, err)
+	echo, err := ioutil.ReadAll(res.Body)
+	ensure.Nil(t, err)
+	ensure.Nil(t, res.Body.Close())
+	ensure.DeepEqual(t, res.StatusCode, http.StatusOK)
+	ensure.DeepEqual(t, string(echo), "hello")
+	ensure.DeepEqual(t, bodies(), []string{"a:hello", "b:hello", "b:hello"})
+	attempts, ok := httpcontrol.AttemptsFromResponse(res)
+	ensure.True(t, ok)
+	ensure.DeepEqual(t, attempts.Tries, 2)
+}
+
+func TestManualRedirectForceContentLength(t *testing.T) {
+	t.Parallel()
+	server, bodies := redirectServer()
+	defer server.Close()
+	transport := &httpcontrol.Transport{
+		MaxTries:           1,
+		RetryStatuses:      []int{http.StatusServiceUnavailable},
+		ForceContentLength: true,
+	}
+	defer transport.Close()
+	client := &http.Client{
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	req, err := http.NewRequest("PUT", server.URL+"/a", streamingBody("hello"))
+	ensure.Nil(t, err)
+	res, err := client.Do(req)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, res.StatusCode, http.StatusTemporaryRedirect)
+	ensure.Nil(t, res.Body.Close())
+	ensure.True(t, req.GetBody == nil)
+
+	// The body buffered from the stream can be sent again.
+	location, err := res.Location()
+	ensure.Nil(t, err)
+	body, err := res.Request.GetBody()
+	ensure.Nil(t, err)
+	next, err := http.NewRequest("PUT", location.String(), body)
+	ensure.Nil(t, err)
+	res, err = client.Do(next)
+	ensure.Nil(t, err)
+	echo, err := ioutil.ReadAll(res.Body)
+	ensure.Nil(t, err)
+	ensure.Nil(t, res.Body.Close())
+	ensure.DeepEqual(t, string(echo), "hello")
+	ensure.DeepEqual(t, bodies(), []string{"a:hello", "b:hello", "b:hello"})
+}
@@ -0,0 +1,43 @@
+package httpcontrol
+
+import (
+	"net/http"
+	"net/url"
+)
+
+// lookupHost returns the value for the host of u in m, which may be keyed by
+// the host with or without the port.
+func lookupHost(m map[string]string, u *url.URL) (string, bool) {
+	if v, ok := m[u.Host]; ok {
+		return v, true
+	}
+	v, ok := m[u.Hostname()]
+	return v, ok
+}
+
+// serverName returns the TLS server name to use for req from WithServerName
+// or the ServerNameOverride, if any.
+func (t *Transport) serverName(req *http.Request) (string, bool) {
+	if name, ok := req.Context().Value(serverNameKey).(string); ok {
+		return name, true
+	}
+	return lookupHost(t.ServerNameOverride, req.URL)
+}
+
+// tlsServerName returns the TLS server name overriding the one of the URL of
+// req, or an empty string, as only HTTPS requests have one.
+func (t *Transport) tlsServerName(req *http.Request) string {
+	if req.URL.Scheme != "https" {
+		return ""
+	}
+	name, _ := t.serverName(req)
+	return name
+}
+
+// overrideServerName applies the TLS server name for HTTPS requests. The
+// standard transport takes the server name from the URL unless its
+// TLSClientConfig sets one, so the attempts are made with a transport of their
+// own for the name, whose connections are only pooled with each other.
+func (t *Transport) overrideServerName(rt *roundTrip) {
+	rt.serverName = t.tlsServerName(rt.req)
+}
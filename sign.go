@@ -0,0 +1,13 @@
+package httpcontrol
+
+import "net/http"
+
+// sign lets the SignRequest sign an attempt. The attempt gets headers of its
+// own so the signature of one attempt is not sent with the next.
+func (t *Transport) sign(out *http.Request) error {
+	out.Header = out.Header.Clone()
+	if out.Header == nil {
+		out.Header = make(http.Header)
+	}
+	return t.callbackErr(func() error { return t.SignRequest(out) })
+}
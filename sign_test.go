@@ -0,0 +1,87 @@
+package httpcontrol_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"github.com/facebookgo/httpcontrol"
+)
+
+func TestSignRequestEachAttempt(t *testing.T) {
+	t.Parallel()
+	var mu sync.Mutex
+	var stamps []string
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			stamps = append(stamps, r.Header.Get("X-Signed-At"))
+			n := len(stamps)
+			mu.Unlock()
+			if n == 1 {
+				// The signature is rejected as expired.
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Write(theAnswer)
+		}))
+	defer server.Close()
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	transport := &httpcontrol.Transport{
+		MaxTries:      1,
+		RetryStatuses: []int{http.StatusServiceUnavailable},
+		Header:        http.Header{"User-Agent": {"httpcontrol-test"}},
+		SignRequest: func(req *http.Request) error {
+			ensure.DeepEqual(t, req.Header.Get("User-Agent"), "httpcontrol-test")
+			ensure.DeepEqual(t, req.Header.Get("X-Signed-At"), "")
+			now = now.Add(time.Minute)
+			req.Header.Set("X-Signed-At", now.Format(time.RFC3339))
+			return nil
+		},
+	}
+	client := &http.Client{Transport: transport}
+	req, err := http.NewRequest("PUT", server.URL, strings.NewReader("body"))
+	ensure.Nil(t, err)
+	res, err := client.Do(req)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	ensure.DeepEqual(t, stamps, []string{"2020-01-01T00:01:00Z", "2020-01-01T00:02:00Z"})
+	// The request of the caller is left untouched.
+	ensure.DeepEqual(t, req.Header.Get("X-Signed-At"), "")
+}
+
+func TestSignRequestError(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(sleepHandler(0))
+	defer server.Close()
+	errSign := errors.New("no credentials")
+	var signs int
+	transport := &httpcontrol.Transport{
+		MaxTries: 1,
+		RetryableError: func(err error) bool {
+			return errors.Is(err, errSign)
+		},
+		SignRequest: func(req *http.Request) error {
+			if signs++; signs == 1 {
+				return errSign
+			}
+			return nil
+		},
+	}
+	client := &http.Client{Transport: transport}
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	ensure.DeepEqual(t, signs, 2)
+
+	signs = 0
+	transport.RetryableError = nil
+	transport.MaxTries = 0
+	_, err = client.Get(server.URL)
+	ensure.True(t, errors.Is(err, errSign), err)
+}
@@ -0,0 +1,52 @@
+package httpcontrol
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net/http"
+	"syscall"
+)
+
+// staleConn reports whether the attempt failed with err because its pooled
+// connection had been closed by the server while idle, such as by a load
+// balancer dropping it. Since nothing was written the request was never
+// processed, so it is retried once right away on a fresh connection, whatever
+// its method and without counting against MaxTries. Requests made in a single
+// attempt or whose body cannot be replayed are not retried.
+func (t *Transport) staleConn(rt *roundTrip, a *attempt, err error) bool {
+	if rt.staleRetried || !a.trace.staleConn() || !isConnClosed(err) {
+		return false
+	}
+	return !t.singleAttempt(rt.req) && rt.replayable()
+}
+
+// isConnClosed reports whether err comes from the connection being closed by
+// the peer.
+func isConnClosed(err error) bool {
+	return errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, syscall.ECONNABORTED)
+}
+
+// freshTransport returns a copy of the underlying transport that dials a new
+// connection for every request, for attempts that must not reuse a pooled
+// one. It only speaks HTTP/1.1, as HTTP/2 connections are always shared.
+func (t *Transport) freshTransport() *http.Transport {
+	t.freshOnce.Do(func() {
+		t.fresh = freshCopy(t.transport)
+	})
+	return t.fresh
+}
+
+// freshCopy returns a copy of tr that dials a new connection for every
+// request, over HTTP/1.1.
+func freshCopy(tr *http.Transport) *http.Transport {
+	fresh := tr.Clone()
+	fresh.DisableKeepAlives = true
+	fresh.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	if fresh.TLSClientConfig != nil {
+		fresh.TLSClientConfig.NextProtos = nil
+	}
+	return fresh
+}
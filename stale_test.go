@@ -0,0 +1,117 @@
+package httpcontrol_test
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+	"github.com/facebookgo/httpcontrol"
+)
+
+// droppedConn simulates a keep-alive connection silently dropped by a load
+// balancer: once dropped, writes fail without writing anything.
+type droppedConn struct {
+	net.Conn
+	dropped *int32
+}
+
+func (c *droppedConn) Write(p []byte) (int, error) {
+	if atomic.LoadInt32(c.dropped) != 0 {
+		return 0, &net.OpError{Op: "write", Net: "tcp", Err: syscall.ECONNRESET}
+	}
+	return c.Conn.Write(p)
+}
+
+// droppingTransport returns a Transport whose first connection can be dropped
+// by setting the returned flag, and a count of the connections dialed.
+func droppingTransport(addr string) (*httpcontrol.Transport, *int32, *int32) {
+	var dropped, dials int32
+	var dialer net.Dialer
+	transport := &httpcontrol.Transport{
+		DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			conn, err := dialer.DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			if atomic.AddInt32(&dials, 1) == 1 {
+				return &droppedConn{Conn: conn, dropped: &dropped}, nil
+			}
+			return conn, nil
+		},
+	}
+	return transport, &dropped, &dials
+}
+
+func TestStaleConnRetried(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(io.Discard, r.Body)
+			w.Write(theAnswer)
+		}))
+	defer server.Close()
+	transport, dropped, dials := droppingTransport(server.Listener.Addr().String())
+	var mu sync.Mutex
+	var stats []*httpcontrol.Stats
+	transport.Stats = func(s *httpcontrol.Stats) {
+		mu.Lock()
+		stats = append(stats, s)
+		mu.Unlock()
+	}
+	client := &http.Client{Transport: transport}
+
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	atomic.StoreInt32(dropped, 1)
+
+	// Not idempotent and MaxTries is zero, yet it is safe to retry.
+	body := &seekableBody{Reader: strings.NewReader("hello")}
+	req, err := http.NewRequest("POST", server.URL, body)
+	ensure.Nil(t, err)
+	res, err = client.Do(req)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	ensure.DeepEqual(t, atomic.LoadInt32(dials), int32(2))
+
+	mu.Lock()
+	defer mu.Unlock()
+	ensure.DeepEqual(t, len(stats), 3)
+	ensure.NotNil(t, stats[1].Error)
+	ensure.True(t, stats[1].ConnReused)
+	ensure.True(t, stats[1].Retry.StaleConn)
+	ensure.True(t, stats[1].Retry.Pending)
+	ensure.Nil(t, stats[2].Error)
+	ensure.False(t, stats[2].ConnReused)
+	ensure.DeepEqual(t, stats[2].Retry.Count, uint(1))
+	ensure.DeepEqual(t, stats[2].Attempt.BytesSent, int64(5))
+}
+
+func TestStaleConnNotReplayable(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(sleepHandler(0))
+	defer server.Close()
+	transport, dropped, _ := droppingTransport(server.Listener.Addr().String())
+	var stale bool
+	transport.Stats = func(s *httpcontrol.Stats) { stale = stale || s.Retry.StaleConn }
+	client := &http.Client{Transport: transport}
+
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	atomic.StoreInt32(dropped, 1)
+
+	req, err := http.NewRequest("POST", server.URL, io.NopCloser(strings.NewReader("hello")))
+	ensure.Nil(t, err)
+	_, err = client.Do(req)
+	ensure.NotNil(t, err)
+	ensure.False(t, stale)
+}
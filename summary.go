@@ -0,0 +1,58 @@
+package httpcontrol
+
+import (
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// Summary describes a RoundTrip as a whole, across all of its attempts. It is
+// delivered to the Done function once the RoundTrip is complete.
+type Summary struct {
+	// The RoundTrip request.
+	Request *http.Request
+
+	// The final response, nil if the RoundTrip failed.
+	Response *http.Response
+
+	// The terminal error, nil if the RoundTrip succeeded. This is a
+	// *RetryError if the request was retried. When there is a Response it is
+	// the error that ended reading its body, if any, as in Stats.
+	Error error
+
+	// The number of attempts made, including those of hedges.
+	Tries int
+
+	// The total time spent backing off between the attempts.
+	RetryDelay time.Duration
+
+	// The time from the start of the RoundTrip until it failed, or until the
+	// response body was closed.
+	Duration time.Duration
+}
+
+// root returns the RoundTrip shared by the copies of a hedged request.
+func (rt *roundTrip) root() *roundTrip {
+	if rt.parent != nil {
+		return rt.parent
+	}
+	return rt
+}
+
+// summarize delivers the Summary of the RoundTrip to the Done function, once.
+func (t *Transport) summarize(rt *roundTrip, res *http.Response, err error) {
+	rt = rt.root()
+	if t.Done == nil || !atomic.CompareAndSwapInt32(&rt.summarized, 0, 1) {
+		return
+	}
+	attempts := rt.attempts()
+	summary := &Summary{
+		Request:    rt.req,
+		Response:   res,
+		Error:      err,
+		Tries:      attempts.Tries,
+		RetryDelay: attempts.RetryDelay,
+		Duration:   t.clock().Now().Sub(rt.start),
+	}
+	t.callback(func() { t.Done(summary) })
+}
@@ -0,0 +1,61 @@
+package httpcontrol_test
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"github.com/facebookgo/freeport"
+	"github.com/facebookgo/httpcontrol"
+)
+
+func TestDoneSummarySuccess(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(statusThenAnswerHandler(http.StatusServiceUnavailable, 1))
+	defer server.Close()
+	var summaries []*httpcontrol.Summary
+	var attempts int
+	transport := &httpcontrol.Transport{
+		MaxTries:      2,
+		RetryStatuses: []int{http.StatusServiceUnavailable},
+		Stats:         func(*httpcontrol.Stats) { attempts++ },
+		Done:          func(s *httpcontrol.Summary) { summaries = append(summaries, s) },
+	}
+	client := &http.Client{Transport: transport}
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, len(summaries), 0)
+	assertResponse(res, t)
+	ensure.DeepEqual(t, attempts, 2)
+	ensure.DeepEqual(t, len(summaries), 1)
+	s := summaries[0]
+	ensure.DeepEqual(t, s.Tries, 2)
+	ensure.Nil(t, s.Error)
+	ensure.DeepEqual(t, s.Response.StatusCode, http.StatusOK)
+	ensure.True(t, s.Duration > 0)
+}
+
+func TestDoneSummaryFailure(t *testing.T) {
+	t.Parallel()
+	port, err := freeport.Get()
+	ensure.Nil(t, err)
+	var summary *httpcontrol.Summary
+	transport := &httpcontrol.Transport{
+		MaxTries:     2,
+		RetryBackoff: func(int) time.Duration { return time.Millisecond },
+		Done:         func(s *httpcontrol.Summary) { summary = s },
+	}
+	client := &http.Client{Transport: transport}
+	_, err = client.Get(fmt.Sprintf("http://127.0.0.1:%d/", port))
+	ensure.NotNil(t, err)
+	ensure.NotNil(t, summary)
+	ensure.DeepEqual(t, summary.Tries, 3)
+	ensure.True(t, summary.Response == nil)
+	var retryErr *httpcontrol.RetryError
+	ensure.True(t, errors.As(summary.Error, &retryErr))
+	ensure.True(t, summary.Duration >= 2*time.Millisecond)
+}
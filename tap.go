@@ -0,0 +1,75 @@
+package httpcontrol
+
+import (
+	"io"
+	"net/http"
+	"sync"
+)
+
+// defaultTapMaxBytes is the default TapMaxBytes.
+const defaultTapMaxBytes = 64 << 10
+
+// tapBody captures the first bytes read through it. The request body is read
+// on a different goroutine than the one calling Tap, hence the mutex.
+type tapBody struct {
+	io.ReadCloser
+	mu  sync.Mutex
+	buf []byte
+	max int64
+}
+
+func (b *tapBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.mu.Lock()
+	if room := b.max - int64(len(b.buf)); room > 0 {
+		if int64(n) < room {
+			room = int64(n)
+		}
+		b.buf = append(b.buf, p[:room]...)
+	}
+	b.mu.Unlock()
+	return n, err
+}
+
+// bytes returns a copy of the bytes captured so far. It is safe to call on a
+// nil body.
+func (b *tapBody) bytes() []byte {
+	if b == nil {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]byte(nil), b.buf...)
+}
+
+// tapMaxBytes returns the number of bytes to capture of each body, never more
+// than the MaxResponseBodyBytes.
+func (t *Transport) tapMaxBytes() int64 {
+	n := t.TapMaxBytes
+	if n <= 0 {
+		n = defaultTapMaxBytes
+	}
+	if t.MaxResponseBodyBytes > 0 && n > t.MaxResponseBodyBytes {
+		n = t.MaxResponseBodyBytes
+	}
+	return n
+}
+
+// tapping reports whether bodies should be captured for the Tap.
+func (t *Transport) tapping() bool {
+	return t.Tap != nil && t.TapBodies
+}
+
+// newTapBody returns body wrapped to capture what is read from it.
+func (t *Transport) newTapBody(body io.ReadCloser) *tapBody {
+	return &tapBody{ReadCloser: body, max: t.tapMaxBytes()}
+}
+
+// tap delivers the attempt to the Tap, with the bodies it captured.
+func (t *Transport) tap(req *http.Request, a *attempt) {
+	if t.Tap == nil {
+		return
+	}
+	reqBody, resBody := a.tapReq.bytes(), a.tapRes.bytes()
+	t.callback(func() { t.Tap(req, reqBody, resBody) })
+}
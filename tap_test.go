@@ -0,0 +1,109 @@
+package httpcontrol_test
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+	"github.com/facebookgo/httpcontrol"
+)
+
+// tapped records the calls to a Tap.
+type tapped struct {
+	reqBodies  []string
+	respBodies []string
+}
+
+func (c *tapped) tap(req *http.Request, reqBody, respBody []byte) {
+	c.reqBodies = append(c.reqBodies, string(reqBody))
+	c.respBodies = append(c.respBodies, string(respBody))
+}
+
+func echoServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(w, r.Body)
+		}))
+}
+
+func TestTapBodies(t *testing.T) {
+	t.Parallel()
+	server := echoServer()
+	defer server.Close()
+	var c tapped
+	transport := &httpcontrol.Transport{
+		Tap:       c.tap,
+		TapBodies: true,
+	}
+	client := &http.Client{Transport: transport}
+	res, err := client.Post(server.URL, "text/plain", strings.NewReader("hello"))
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, len(c.reqBodies), 0)
+	body, err := ioutil.ReadAll(res.Body)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, string(body), "hello")
+	ensure.Nil(t, res.Body.Close())
+	ensure.DeepEqual(t, c.reqBodies, []string{"hello"})
+	ensure.DeepEqual(t, c.respBodies, []string{"hello"})
+}
+
+func TestTapMaxBytes(t *testing.T) {
+	t.Parallel()
+	server := echoServer()
+	defer server.Close()
+	var c tapped
+	transport := &httpcontrol.Transport{
+		Tap:         c.tap,
+		TapBodies:   true,
+		TapMaxBytes: 3,
+	}
+	client := &http.Client{Transport: transport}
+	res, err := client.Post(server.URL, "text/plain", strings.NewReader("hello"))
+	ensure.Nil(t, err)
+	body, err := ioutil.ReadAll(res.Body)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, string(body), "hello")
+	ensure.Nil(t, res.Body.Close())
+	ensure.DeepEqual(t, c.reqBodies, []string{"hel"})
+	ensure.DeepEqual(t, c.respBodies, []string{"hel"})
+}
+
+func TestTapWithoutBodies(t *testing.T) {
+	t.Parallel()
+	server := echoServer()
+	defer server.Close()
+	var c tapped
+	transport := &httpcontrol.Transport{Tap: c.tap}
+	client := &http.Client{Transport: transport}
+	res, err := client.Post(server.URL, "text/plain", strings.NewReader("hello"))
+	ensure.Nil(t, err)
+	body, err := ioutil.ReadAll(res.Body)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, string(body), "hello")
+	ensure.Nil(t, res.Body.Close())
+	ensure.DeepEqual(t, c.reqBodies, []string{""})
+	ensure.DeepEqual(t, c.respBodies, []string{""})
+}
+
+func TestTapRetriedResponse(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(statusThenAnswerHandler(http.StatusServiceUnavailable, 1))
+	defer server.Close()
+	var c tapped
+	transport := &httpcontrol.Transport{
+		MaxTries:      1,
+		RetryStatuses: []int{http.StatusServiceUnavailable},
+		Tap:           c.tap,
+		TapBodies:     true,
+	}
+	client := &http.Client{Transport: transport}
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	ensure.DeepEqual(t, len(c.respBodies), 2)
+	ensure.DeepEqual(t, c.respBodies[1], string(theAnswer))
+}
@@ -0,0 +1,200 @@
+package httpcontrol
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrPinMismatch is returned when none of the certificates presented by a
+// host match its PinnedKeys.
+var ErrPinMismatch = errors.New("httpcontrol: certificate pin mismatch")
+
+// ErrTLSHandshakeTimeout is returned when the TLS handshake does not complete
+// within the TLSHandshakeTimeout. It is a net.Error reporting a timeout.
+var ErrTLSHandshakeTimeout net.Error = &timeoutError{"httpcontrol: TLS handshake timeout"}
+
+// isTLSHandshakeTimeout reports whether err is the handshake timeout of the
+// underlying transport, which is not exported.
+func isTLSHandshakeTimeout(err error) bool {
+	var neterr net.Error
+	return errors.As(err, &neterr) && neterr.Timeout() &&
+		strings.HasSuffix(err.Error(), "TLS handshake timeout")
+}
+
+// tlsHandshakeTimeout returns the TLSHandshakeTimeout, defaulting to the
+// DialTimeout.
+func (t *Transport) tlsHandshakeTimeout() time.Duration {
+	if t.TLSHandshakeTimeout != 0 {
+		return t.TLSHandshakeTimeout
+	}
+	return t.DialTimeout
+}
+
+// tlsConfig returns the TLS configuration for the underlying transport, with
+// the convenience fields merged into TLSClientConfig.
+func (t *Transport) tlsConfig() *tls.Config {
+	return t.mergeTLSConfig(t.TLSClientConfig)
+}
+
+// mergeTLSConfig returns base with the convenience fields merged into it. The
+// sessions of the TLSSessionCache must have been created.
+func (t *Transport) mergeTLSConfig(base *tls.Config) *tls.Config {
+	// EnableHTTP2 also requires a copy, since configuring HTTP/2 adds to the
+	// NextProtos of the config.
+	if len(t.PinnedKeys) == 0 && t.MinTLSVersion == 0 && len(t.CipherSuites) == 0 &&
+		!t.EnableHTTP2 && !t.TLSSessionCache {
+		return base
+	}
+	var config *tls.Config
+	if base != nil {
+		config = base.Clone()
+	} else {
+		config = &tls.Config{}
+	}
+
+	if t.MinTLSVersion != 0 {
+		if config.MinVersion == 0 {
+			config.MinVersion = t.MinTLSVersion
+		} else if config.MinVersion != t.MinTLSVersion {
+			t.warn("MinTLSVersion conflicts with TLSClientConfig.MinVersion, using the latter")
+		}
+	}
+	if len(t.CipherSuites) != 0 {
+		if len(config.CipherSuites) == 0 {
+			config.CipherSuites = t.CipherSuites
+		} else if !equalUint16s(config.CipherSuites, t.CipherSuites) {
+			t.warn("CipherSuites conflicts with TLSClientConfig.CipherSuites, using the latter")
+		}
+	}
+
+	if t.TLSSessionCache {
+		if config.ClientSessionCache == nil {
+			config.ClientSessionCache = t.sessions
+		} else {
+			t.warn("TLSSessionCache conflicts with TLSClientConfig.ClientSessionCache, using the latter")
+		}
+	}
+
+	if len(t.PinnedKeys) != 0 {
+		// VerifyConnection is used rather than VerifyPeerCertificate since it
+		// provides the server name, and runs after the regular verification.
+		verify := config.VerifyConnection
+		config.VerifyConnection = func(cs tls.ConnectionState) error {
+			if verify != nil {
+				if err := verify(cs); err != nil {
+					return err
+				}
+			}
+			return t.verifyPins(cs)
+		}
+	}
+	return config
+}
+
+// sessionCache is the TLS session cache of a Transport. Unlike the caches
+// from the tls package it can be cleared.
+type sessionCache struct {
+	mu    sync.Mutex
+	cache tls.ClientSessionCache
+}
+
+func newSessionCache() *sessionCache {
+	return &sessionCache{cache: tls.NewLRUClientSessionCache(0)}
+}
+
+func (c *sessionCache) Get(key string) (*tls.ClientSessionState, bool) {
+	c.mu.Lock()
+	cache := c.cache
+	c.mu.Unlock()
+	return cache.Get(key)
+}
+
+func (c *sessionCache) Put(key string, cs *tls.ClientSessionState) {
+	c.mu.Lock()
+	cache := c.cache
+	c.mu.Unlock()
+	cache.Put(key, cs)
+}
+
+// clear forgets all sessions.
+func (c *sessionCache) clear() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	c.cache = tls.NewLRUClientSessionCache(0)
+	c.mu.Unlock()
+}
+
+func equalUint16s(a, b []uint16) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// verifyPins checks the certificate chain against the PinnedKeys for the
+// server name, if any. IP addresses are not sent as the server name, in which
+// case the pins of the pinned hosts the leaf certificate is valid for apply.
+func (t *Transport) verifyPins(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return ErrPinMismatch
+	}
+	certs := pinnableCerts(cs)
+	if cs.ServerName != "" {
+		pins, ok := t.PinnedKeys[cs.ServerName]
+		if !ok {
+			return nil
+		}
+		return matchPins(certs, pins)
+	}
+	for host, pins := range t.PinnedKeys {
+		if cs.PeerCertificates[0].VerifyHostname(host) != nil {
+			continue
+		}
+		if err := matchPins(certs, pins); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pinnableCerts returns the certificates a pin may match: those of the
+// verified chains, as a server may send any certificate along with its own,
+// or only the leaf certificate with InsecureSkipVerify.
+func pinnableCerts(cs tls.ConnectionState) []*x509.Certificate {
+	if len(cs.VerifiedChains) == 0 {
+		return cs.PeerCertificates[:1]
+	}
+	var certs []*x509.Certificate
+	for _, chain := range cs.VerifiedChains {
+		certs = append(certs, chain...)
+	}
+	return certs
+}
+
+// matchPins checks that one of the certificates matches one of the pins.
+func matchPins(certs []*x509.Certificate, pins []string) error {
+	for _, cert := range certs {
+		sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		hash := base64.StdEncoding.EncodeToString(sum[:])
+		for _, pin := range pins {
+			if pin == hash {
+				return nil
+			}
+		}
+	}
+	return ErrPinMismatch
+}
@@ -0,0 +1,331 @@
+package httpcontrol_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"github.com/facebookgo/httpcontrol"
+)
+
+func spkiHash(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func serverHost(t *testing.T, server *httptest.Server) string {
+	u, err := url.Parse(server.URL)
+	ensure.Nil(t, err)
+	return u.Hostname()
+}
+
+func TestPinnedKeysAccept(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewTLSServer(sleepHandler(time.Millisecond))
+	defer server.Close()
+	transport := &httpcontrol.Transport{
+		TLSClientConfig: server.Client().Transport.(*http.Transport).TLSClientConfig,
+		PinnedKeys: map[string][]string{
+			serverHost(t, server): {"bogus", spkiHash(server.Certificate())},
+		},
+	}
+	client := &http.Client{Transport: transport}
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+}
+
+func TestPinnedKeysReject(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewTLSServer(sleepHandler(time.Millisecond))
+	defer server.Close()
+	transport := &httpcontrol.Transport{
+		TLSClientConfig: server.Client().Transport.(*http.Transport).TLSClientConfig,
+		PinnedKeys: map[string][]string{
+			serverHost(t, server): {"bogus"},
+		},
+	}
+	client := &http.Client{Transport: transport}
+	_, err := client.Get(server.URL)
+	ensure.True(t, errors.Is(err, httpcontrol.ErrPinMismatch), err)
+}
+
+func TestPinnedKeysIgnoreUnverifiedCerts(t *testing.T) {
+	t.Parallel()
+	pinned := clientCert(t, "pinned")
+	server := httptest.NewTLSServer(sleepHandler(time.Millisecond))
+	defer server.Close()
+
+	// The server sends the pinned certificate along with its own chain,
+	// which is still valid without it.
+	cert := &server.TLS.Certificates[0]
+	cert.Certificate = append(cert.Certificate, pinned.Certificate[0])
+	transport := &httpcontrol.Transport{
+		TLSClientConfig: server.Client().Transport.(*http.Transport).TLSClientConfig,
+		PinnedKeys: map[string][]string{
+			serverHost(t, server): {spkiHash(pinned.Leaf)},
+		},
+	}
+	defer transport.Close()
+	_, err := (&http.Client{Transport: transport}).Get(server.URL)
+	ensure.True(t, errors.Is(err, httpcontrol.ErrPinMismatch), err)
+
+	// Without verification only the leaf certificate counts.
+	transport = &httpcontrol.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		PinnedKeys:      transport.PinnedKeys,
+	}
+	defer transport.Close()
+	_, err = (&http.Client{Transport: transport}).Get(server.URL)
+	ensure.True(t, errors.Is(err, httpcontrol.ErrPinMismatch), err)
+}
+
+func TestPinnedKeysWithInsecureSkipVerify(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewTLSServer(sleepHandler(time.Millisecond))
+	defer server.Close()
+	transport := &httpcontrol.Transport{
+		TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		PinnedKeys: map[string][]string{
+			serverHost(t, server): {spkiHash(server.Certificate())},
+		},
+	}
+	client := &http.Client{Transport: transport}
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+}
+
+func TestPinnedKeysStillVerifies(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewTLSServer(sleepHandler(time.Millisecond))
+	defer server.Close()
+	transport := &httpcontrol.Transport{
+		PinnedKeys: map[string][]string{
+			serverHost(t, server): {spkiHash(server.Certificate())},
+		},
+	}
+	client := &http.Client{Transport: transport}
+	_, err := client.Get(server.URL)
+	ensure.NotNil(t, err)
+	ensure.False(t, errors.Is(err, httpcontrol.ErrPinMismatch))
+}
+
+// stalledTLSListener accepts connections but never completes a handshake.
+func stalledTLSListener(t *testing.T) (string, func()) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	ensure.Nil(t, err)
+	var mu sync.Mutex
+	var conns []net.Conn
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+		}
+	}()
+	return l.Addr().String(), func() {
+		l.Close()
+		mu.Lock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+		mu.Unlock()
+	}
+}
+
+func TestTLSHandshakeTimeout(t *testing.T) {
+	t.Parallel()
+	addr, stop := stalledTLSListener(t)
+	defer stop()
+	for _, transport := range []*httpcontrol.Transport{
+		{TLSHandshakeTimeout: 50 * time.Millisecond},
+		{DialTimeout: 50 * time.Millisecond},
+	} {
+		client := &http.Client{Transport: transport}
+		start := time.Now()
+		_, err := client.Get("https://" + addr + "/")
+		ensure.True(t, errors.Is(err, httpcontrol.ErrTLSHandshakeTimeout), err)
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatalf("handshake timeout took %s", elapsed)
+		}
+	}
+}
+
+func TestTLSSessionCache(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewTLSServer(sleepHandler(0))
+	defer server.Close()
+	for _, enabled := range []bool{true, false} {
+		transport := &httpcontrol.Transport{
+			TLSClientConfig:   server.Client().Transport.(*http.Transport).TLSClientConfig,
+			TLSSessionCache:   enabled,
+			DisableKeepAlives: true,
+		}
+		var resumed []bool
+		transport.Stats = func(stats *httpcontrol.Stats) {
+			resumed = append(resumed, stats.TLS.DidResume)
+		}
+		client := &http.Client{Transport: transport}
+		for i := 0; i < 2; i++ {
+			res, err := client.Get(server.URL)
+			ensure.Nil(t, err)
+			assertResponse(res, t)
+		}
+		ensure.DeepEqual(t, resumed, []bool{false, enabled})
+	}
+}
+
+func TestServerNameOverride(t *testing.T) {
+	t.Parallel()
+	var serverName, host string
+	server := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			serverName, host = r.TLS.ServerName, r.Host
+			w.Write(theAnswer)
+		}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	ensure.Nil(t, err)
+	var stats *httpcontrol.Stats
+	transport := &httpcontrol.Transport{
+		TLSClientConfig:    server.Client().Transport.(*http.Transport).TLSClientConfig,
+		ServerNameOverride: map[string]string{"127.0.0.1": "example.com"},
+		Stats:              func(s *httpcontrol.Stats) { stats = s },
+	}
+	client := &http.Client{Transport: transport}
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	ensure.DeepEqual(t, serverName, "example.com")
+	ensure.DeepEqual(t, host, u.Host)
+	ensure.DeepEqual(t, stats.TLS.ServerName, "example.com")
+	ensure.DeepEqual(t, res.Request.URL.Host, u.Host)
+}
+
+func TestServerNameOverrideHedged(t *testing.T) {
+	t.Parallel()
+	var mu sync.Mutex
+	var serverNames []string
+	var calls int
+	server := httptest.NewTLSServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			serverNames = append(serverNames, r.TLS.ServerName)
+			calls++
+			slow := calls == 1
+			mu.Unlock()
+			if slow {
+				// Only the hedge copy gets to respond in time.
+				select {
+				case <-r.Context().Done():
+				case <-time.After(time.Second):
+				}
+			}
+			w.Write(theAnswer)
+		}))
+	defer server.Close()
+	transport := &httpcontrol.Transport{
+		TLSClientConfig:    server.Client().Transport.(*http.Transport).TLSClientConfig,
+		ServerNameOverride: map[string]string{"127.0.0.1": "example.com"},
+		HedgeDelay:         20 * time.Millisecond,
+	}
+	defer transport.Close()
+	res, err := (&http.Client{Transport: transport}).Get(server.URL)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	mu.Lock()
+	defer mu.Unlock()
+	ensure.DeepEqual(t, serverNames, []string{"example.com", "example.com"})
+}
+
+func TestServerNameOverrideSeparatesAddresses(t *testing.T) {
+	t.Parallel()
+	for _, http2 := range []bool{false, true} {
+		// Two servers on the same port of two addresses, reached by the same
+		// server name.
+		l1, err := net.Listen("tcp", "127.0.0.1:0")
+		ensure.Nil(t, err)
+		port := l1.Addr().(*net.TCPAddr).Port
+		l2, err := net.Listen("tcp", fmt.Sprintf("127.0.0.2:%d", port))
+		if err != nil {
+			l1.Close()
+			t.Skip("cannot listen on 127.0.0.2:", err)
+		}
+		var servers []*httptest.Server
+		for i, l := range []net.Listener{l1, l2} {
+			name := fmt.Sprint(i + 1)
+			server := httptest.NewUnstartedServer(http.HandlerFunc(
+				func(w http.ResponseWriter, r *http.Request) {
+					w.Write([]byte(name + " " + r.TLS.ServerName))
+				}))
+			server.Listener.Close()
+			server.Listener = l
+			server.EnableHTTP2 = http2
+			server.StartTLS()
+			defer server.Close()
+			servers = append(servers, server)
+		}
+		var names []string
+		transport := &httpcontrol.Transport{
+			EnableHTTP2:     http2,
+			TLSClientConfig: servers[0].Client().Transport.(*http.Transport).TLSClientConfig,
+			ServerNameOverride: map[string]string{
+				"127.0.0.1": "example.com",
+				"127.0.0.2": "example.com",
+			},
+			Stats: func(s *httpcontrol.Stats) { names = append(names, s.TLS.ServerName) },
+		}
+		client := &http.Client{Transport: transport}
+		for i := 0; i < 2; i++ {
+			for j, server := range servers {
+				res, err := client.Get(server.URL)
+				ensure.Nil(t, err)
+				body, err := ioutil.ReadAll(res.Body)
+				ensure.Nil(t, err)
+				ensure.Nil(t, res.Body.Close())
+				ensure.DeepEqual(t, string(body), fmt.Sprint(j+1, " example.com"))
+				ensure.DeepEqual(t, res.Request.URL.Host, server.Listener.Addr().String())
+			}
+		}
+		ensure.DeepEqual(t, names, []string{"example.com", "example.com", "example.com", "example.com"})
+		ensure.DeepEqual(t, transport.PoolStats().Dials, uint64(2))
+		transport.Close()
+	}
+}
+
+func TestWithServerName(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewTLSServer(sleepHandler(0))
+	defer server.Close()
+	transport := &httpcontrol.Transport{
+		TLSClientConfig:    server.Client().Transport.(*http.Transport).TLSClientConfig,
+		ServerNameOverride: map[string]string{"127.0.0.1": "example.com"},
+	}
+	client := &http.Client{Transport: transport}
+
+	// The certificate of the test server is not valid for this name.
+	ctx := httpcontrol.WithServerName(context.Background(), "other.example.net")
+	req, err := http.NewRequestWithContext(ctx, "GET", server.URL, nil)
+	ensure.Nil(t, err)
+	_, err = client.Do(req)
+	var hostnameErr x509.HostnameError
+	ensure.True(t, errors.As(err, &hostnameErr), err)
+}
@@ -0,0 +1,87 @@
+package httpcontrol
+
+import (
+	"crypto/tls"
+	"net/http"
+	"sync"
+
+	"golang.org/x/net/http2"
+)
+
+// hostTransport is the underlying transport for the hosts given the same
+// configuration by the TLSConfigForHost, the same TLS server name and the same
+// tunnel proxy, so that their connections are only pooled with each other.
+type hostTransport struct {
+	transport *http.Transport
+	freshOnce sync.Once
+	fresh     *http.Transport
+}
+
+// freshTransport returns the copy of the transport for attempts that must
+// not reuse a pooled connection.
+func (ht *hostTransport) freshTransport() *http.Transport {
+	ht.freshOnce.Do(func() {
+		ht.fresh = freshCopy(ht.transport)
+	})
+	return ht.fresh
+}
+
+// hostKey identifies a hostTransport.
+type hostKey struct {
+	config     *tls.Config // from the TLSConfigForHost, or nil
+	serverName string      // from the ServerNameOverride, or empty
+	proxy      string      // the proxy the Transport tunnels through, or empty
+}
+
+// hostTransport returns the transport for out with the key, to which it adds
+// the TLS configuration given to its host by the TLSConfigForHost, or nil to
+// use the underlying transport as it is.
+func (t *Transport) hostTransport(out *http.Request, key hostKey) *hostTransport {
+	if t.TLSConfigForHost != nil && out.URL.Scheme == "https" {
+		t.callback(func() { key.config = t.TLSConfigForHost(out.URL.Hostname()) })
+	}
+	if key == (hostKey{}) {
+		return nil
+	}
+	t.hostMu.Lock()
+	defer t.hostMu.Unlock()
+	if ht, ok := t.hostTLS[key]; ok {
+		return ht
+	}
+	tr := t.transport.Clone()
+	if key.config != nil {
+		tr.TLSClientConfig = t.mergeTLSConfig(key.config)
+	}
+	if key.serverName != "" {
+		if tr.TLSClientConfig != nil {
+			tr.TLSClientConfig = tr.TLSClientConfig.Clone()
+		} else {
+			tr.TLSClientConfig = &tls.Config{}
+		}
+		tr.TLSClientConfig.ServerName = key.serverName
+	}
+	if t.EnableHTTP2 {
+		// The clone shares the HTTP/2 connections of the original, so it
+		// gets its own instead.
+		tr.TLSNextProto = nil
+		if err := http2.ConfigureTransport(tr); err != nil {
+			t.warn("failed to enable HTTP/2: " + err.Error())
+		}
+	}
+	ht := &hostTransport{transport: tr}
+	if t.hostTLS == nil {
+		t.hostTLS = make(map[hostKey]*hostTransport)
+	}
+	t.hostTLS[key] = ht
+	return ht
+}
+
+// closeHostIdleConnections closes the idle connections of the transports for
+// the TLSConfigForHost.
+func (t *Transport) closeHostIdleConnections() {
+	t.hostMu.Lock()
+	defer t.hostMu.Unlock()
+	for _, ht := range t.hostTLS {
+		ht.transport.CloseIdleConnections()
+	}
+}
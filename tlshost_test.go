@@ -0,0 +1,126 @@
+package httpcontrol_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"github.com/facebookgo/httpcontrol"
+)
+
+// clientCert returns a self-signed client certificate with the common name.
+func clientCert(t *testing.T, name string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ensure.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		IsCA:         true,
+
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	ensure.Nil(t, err)
+	leaf, err := x509.ParseCertificate(der)
+	ensure.Nil(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+// clientCertServer starts a TLS server which requires the client certificate,
+// and responds with its common name.
+func clientCertServer(t *testing.T, cert tls.Certificate, http2 bool) *httptest.Server {
+	server := httptest.NewUnstartedServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+		}))
+	pool := x509.NewCertPool()
+	pool.AddCert(cert.Leaf)
+	server.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: pool}
+	server.EnableHTTP2 = http2
+	server.StartTLS()
+	return server
+}
+
+func TestTLSConfigForHost(t *testing.T) {
+	t.Parallel()
+	for _, http2 := range []bool{false, true} {
+		certA, certB := clientCert(t, "a"), clientCert(t, "b")
+		serverA := clientCertServer(t, certA, http2)
+		defer serverA.Close()
+		serverB := clientCertServer(t, certB, http2)
+		defer serverB.Close()
+		addrs := map[string]string{
+			"a.test:443": serverA.Listener.Addr().String(),
+			"b.test:443": serverB.Listener.Addr().String(),
+			"c.test:443": serverB.Listener.Addr().String(),
+		}
+
+		// The servers have the certificate of example.com.
+		base := serverA.Client().Transport.(*http.Transport).TLSClientConfig.Clone()
+		base.ServerName = "example.com"
+		configA, configB := base.Clone(), base.Clone()
+		configA.Certificates = []tls.Certificate{certA}
+		configB.Certificates = []tls.Certificate{certB}
+		var dialer net.Dialer
+		transport := &httpcontrol.Transport{
+			EnableHTTP2:     http2,
+			TLSClientConfig: base,
+			TLSConfigForHost: func(host string) *tls.Config {
+				switch host {
+				case "a.test":
+					return configA
+				case "b.test":
+					return configB
+				}
+				return nil
+			},
+			DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+				return dialer.DialContext(ctx, network, addrs[address])
+			},
+		}
+		client := &http.Client{Transport: transport}
+		get := func(host string) (string, error) {
+			res, err := client.Get("https://" + host + "/")
+			if err != nil {
+				return "", err
+			}
+			defer res.Body.Close()
+			if http2 {
+				ensure.DeepEqual(t, res.ProtoMajor, 2)
+			}
+			var buf [8]byte
+			n, _ := res.Body.Read(buf[:])
+			return string(buf[:n]), nil
+		}
+		for i := 0; i < 2; i++ {
+			name, err := get("a.test")
+			ensure.Nil(t, err)
+			ensure.DeepEqual(t, name, "a")
+			name, err = get("b.test")
+			ensure.Nil(t, err)
+			ensure.DeepEqual(t, name, "b")
+		}
+		ensure.DeepEqual(t, transport.PoolStats().Dials, uint64(2))
+
+		// Hosts without a configuration of their own use the TLSClientConfig,
+		// without a certificate.
+		_, err := get("c.test")
+		ensure.NotNil(t, err)
+		transport.Close()
+	}
+}
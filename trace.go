@@ -0,0 +1,203 @@
+package httpcontrol
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/textproto"
+	"sync"
+	"time"
+)
+
+// attemptTrace collects connection level timings for a single attempt using
+// an httptrace.ClientTrace. Hooks may fire on other goroutines, so access is
+// guarded by a mutex.
+type attemptTrace struct {
+	mu           sync.Mutex
+	start        time.Time
+	dnsStart     time.Time
+	dnsDone      time.Time
+	connectStart time.Time
+	connectDone  time.Time
+	dialWait     time.Duration
+	tlsStart     time.Time
+	tlsDone      time.Time
+	wroteRequest time.Time
+	firstByte    time.Time
+	got1xx       bool // informational responses arrived before the final one
+	wroteHeaders bool
+	reused       bool
+	conn         *poolConn
+	connWritten  int64 // bytes written to conn before the attempt
+	wasIdle      bool
+	idleTime     time.Duration
+	family       string
+	remoteAddr   string
+	localAddr    string
+	tls          *tls.ConnectionState
+
+	on1xx func(code int, header http.Header) // the Trace1xx
+}
+
+// withTrace returns a context that records into the trace, in addition to any
+// ClientTrace already present in ctx.
+func (a *attemptTrace) withTrace(ctx context.Context) context.Context {
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		DNSStart: func(httptrace.DNSStartInfo) {
+			a.set(&a.dnsStart)
+		},
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			a.set(&a.dnsDone)
+		},
+		ConnectStart: func(string, string) {
+			a.mu.Lock()
+			if a.connectStart.IsZero() {
+				a.connectStart = time.Now()
+			}
+			a.mu.Unlock()
+		},
+		ConnectDone: func(string, string, error) {
+			a.set(&a.connectDone)
+		},
+		TLSHandshakeStart: func() {
+			a.set(&a.tlsStart)
+		},
+		TLSHandshakeDone: func(cs tls.ConnectionState, err error) {
+			a.mu.Lock()
+			a.tlsDone = time.Now()
+			if err == nil {
+				a.tls = &cs
+			}
+			a.mu.Unlock()
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			a.mu.Lock()
+			a.reused = info.Reused
+			a.conn = asPoolConn(info.Conn)
+			a.connWritten = a.conn.bytesWritten()
+			a.wasIdle = info.WasIdle
+			a.idleTime = info.IdleTime
+			a.remoteAddr = addrString(info.Conn.RemoteAddr())
+			a.localAddr = addrString(info.Conn.LocalAddr())
+			if !info.Reused {
+				a.family = addressFamily(info.Conn.RemoteAddr())
+			}
+			a.mu.Unlock()
+		},
+		WroteHeaders: func() {
+			a.mu.Lock()
+			a.wroteHeaders = true
+			a.mu.Unlock()
+		},
+		WroteRequest: func(httptrace.WroteRequestInfo) {
+			a.set(&a.wroteRequest)
+		},
+		GotFirstResponseByte: func() {
+			a.set(&a.firstByte)
+		},
+		Got1xxResponse: func(code int, header textproto.MIMEHeader) error {
+			a.mu.Lock()
+			a.got1xx = true
+			a.mu.Unlock()
+			if a.on1xx != nil {
+				a.on1xx(code, http.Header(header))
+			}
+			return nil
+		},
+	})
+}
+
+// gotResponse records the arrival of the final response headers. The first
+// byte was that of an informational response if there were any, so the first
+// byte of the final response is taken to be when its headers were read.
+func (a *attemptTrace) gotResponse() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.got1xx {
+		a.firstByte = time.Now()
+	}
+}
+
+func (a *attemptTrace) set(t *time.Time) {
+	a.mu.Lock()
+	*t = time.Now()
+	a.mu.Unlock()
+}
+
+// wrote reports whether the request headers were written to the connection.
+func (a *attemptTrace) wrote() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.wroteHeaders
+}
+
+// staleConn reports whether the attempt got a reused connection and failed
+// before writing anything to it nor receiving a response, meaning the server
+// cannot have seen the request.
+func (a *attemptTrace) staleConn() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.reused && a.conn != nil && a.firstByte.IsZero() &&
+		a.conn.bytesWritten() == a.connWritten
+}
+
+// fill populates the timing related fields of stats.
+func (a *attemptTrace) fill(stats *Stats) {
+	if a == nil {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	stats.TimeToFirstByte = since(a.start, a.firstByte)
+	stats.ConnReused = a.reused
+	stats.WasIdle = a.wasIdle
+	stats.IdleTime = a.idleTime
+	stats.RemoteAddr = a.remoteAddr
+	stats.LocalAddr = a.localAddr
+	if a.reused {
+		// Reused connections may still report the hooks of a dial that was
+		// started in the background, which is unrelated to this attempt.
+		stats.Timing.WaitResponse = since(a.wroteRequest, a.firstByte)
+		return
+	}
+	stats.AddressFamily = a.family
+	stats.TLS = a.tls
+	stats.Timing.DialWait = a.dialWait
+	stats.Timing.DNSResolve = since(a.dnsStart, a.dnsDone)
+	stats.Timing.Connect = since(a.connectStart, a.connectDone)
+	stats.Timing.TLSHandshake = since(a.tlsStart, a.tlsDone)
+	stats.Timing.WaitResponse = since(a.wroteRequest, a.firstByte)
+}
+
+// since returns the duration between start and end, or zero if either is
+// unknown.
+func since(start, end time.Time) time.Duration {
+	if start.IsZero() || end.IsZero() {
+		return 0
+	}
+	return end.Sub(start)
+}
+
+// addrString returns the string form of addr, or an empty string if it is
+// nil.
+func addrString(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	return addr.String()
+}
+
+// addressFamily returns "tcp4" or "tcp6" for TCP addresses, and an empty string
+// otherwise.
+func addressFamily(addr net.Addr) string {
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return ""
+	}
+	if tcp.IP.To4() != nil {
+		return "tcp4"
+	}
+	return "tcp6"
+}
@@ -0,0 +1,201 @@
+package httpcontrol_test
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"github.com/facebookgo/httpcontrol"
+)
+
+func TestStatsTiming(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewTLSServer(sleepHandler(10 * time.Millisecond))
+	defer server.Close()
+	transport := &httpcontrol.Transport{
+		TLSClientConfig: server.Client().Transport.(*http.Transport).TLSClientConfig,
+	}
+	var all []*httpcontrol.Stats
+	transport.Stats = func(stats *httpcontrol.Stats) {
+		all = append(all, stats)
+	}
+	client := &http.Client{Transport: transport}
+	for i := 0; i < 2; i++ {
+		res, err := client.Get(server.URL)
+		ensure.Nil(t, err)
+		assertResponse(res, t)
+		// Let the connection sit in the pool.
+		time.Sleep(5 * time.Millisecond)
+	}
+	ensure.DeepEqual(t, len(all), 2)
+
+	first := all[0]
+	ensure.False(t, first.ConnReused)
+	ensure.False(t, first.WasIdle)
+	ensure.DeepEqual(t, first.IdleTime, time.Duration(0))
+	ensure.True(t, first.Timing.Connect > 0, first.Timing)
+	ensure.True(t, first.Timing.TLSHandshake > 0, first.Timing)
+	ensure.True(t, first.Timing.WaitResponse >= 10*time.Millisecond, first.Timing)
+
+	second := all[1]
+	ensure.True(t, second.ConnReused)
+	ensure.True(t, second.WasIdle)
+	ensure.True(t, second.IdleTime >= 5*time.Millisecond, second.IdleTime)
+	ensure.DeepEqual(t, second.Timing.DNSResolve, time.Duration(0))
+	ensure.DeepEqual(t, second.Timing.Connect, time.Duration(0))
+	ensure.DeepEqual(t, second.Timing.TLSHandshake, time.Duration(0))
+	ensure.True(t, second.Timing.WaitResponse >= 10*time.Millisecond, second.Timing)
+}
+
+func TestStatsBytes(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			io.Copy(ioutil.Discard, r.Body)
+			w.Write(theAnswer)
+		}))
+	defer server.Close()
+	transport := &httpcontrol.Transport{}
+	var all []*httpcontrol.Stats
+	transport.Stats = func(stats *httpcontrol.Stats) {
+		all = append(all, stats)
+	}
+	client := &http.Client{Transport: transport}
+	res, err := client.Post(server.URL, "text/plain", strings.NewReader("hello"))
+	ensure.Nil(t, err)
+
+	// Stats are only delivered once the body is closed.
+	ensure.DeepEqual(t, len(all), 0)
+	assertResponse(res, t)
+	ensure.DeepEqual(t, len(all), 1)
+	ensure.DeepEqual(t, all[0].BytesSent, int64(5))
+	ensure.DeepEqual(t, all[0].BytesReceived, int64(len(theAnswer)))
+}
+
+func TestStatsBytesAcrossRetries(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(statusThenAnswerHandler(http.StatusBadGateway, 1))
+	defer server.Close()
+	transport := &httpcontrol.Transport{
+		MaxTries:      1,
+		RetryStatuses: []int{http.StatusBadGateway},
+	}
+	var all []*httpcontrol.Stats
+	transport.Stats = func(stats *httpcontrol.Stats) {
+		all = append(all, stats)
+	}
+	client := &http.Client{Transport: transport}
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	ensure.DeepEqual(t, len(all), 2)
+	n := int64(len(theAnswer))
+	ensure.DeepEqual(t, all[0].Attempt.BytesReceived, n)
+	ensure.DeepEqual(t, all[0].BytesReceived, n)
+	ensure.DeepEqual(t, all[1].Attempt.BytesReceived, n)
+	ensure.DeepEqual(t, all[1].BytesReceived, 2*n)
+	ensure.DeepEqual(t, all[1].Retry.Count, uint(1))
+}
+
+func TestStatsTLS(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewTLSServer(sleepHandler(time.Millisecond))
+	defer server.Close()
+	transport := &httpcontrol.Transport{
+		TLSClientConfig: server.Client().Transport.(*http.Transport).TLSClientConfig,
+	}
+	var all []*httpcontrol.Stats
+	transport.Stats = func(stats *httpcontrol.Stats) {
+		all = append(all, stats)
+	}
+	client := &http.Client{Transport: transport}
+	for i := 0; i < 2; i++ {
+		res, err := client.Get(server.URL)
+		ensure.Nil(t, err)
+		assertResponse(res, t)
+	}
+	ensure.DeepEqual(t, len(all), 2)
+	for _, stats := range all {
+		ensure.NotNil(t, stats.TLS)
+		ensure.True(t, stats.TLS.HandshakeComplete)
+		ensure.True(t, stats.TLS.Version != 0)
+	}
+}
+
+func TestStatsNoTLS(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(sleepHandler(time.Millisecond))
+	defer server.Close()
+	transport := &httpcontrol.Transport{}
+	var stats *httpcontrol.Stats
+	transport.Stats = func(s *httpcontrol.Stats) { stats = s }
+	client := &http.Client{Transport: transport}
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	ensure.True(t, stats.TLS == nil)
+}
+
+func TestStatsTimeToFirstByte(t *testing.T) {
+	t.Parallel()
+	const think, transfer = 50 * time.Millisecond, 50 * time.Millisecond
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(think)
+			w.Write(theAnswer[:1])
+			w.(http.Flusher).Flush()
+			time.Sleep(transfer)
+			w.Write(theAnswer[1:])
+		}))
+	defer server.Close()
+	var stats *httpcontrol.Stats
+	transport := &httpcontrol.Transport{
+		Stats: func(s *httpcontrol.Stats) { stats = s },
+	}
+	client := &http.Client{Transport: transport}
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	ensure.True(t, stats.TimeToFirstByte >= think, stats.TimeToFirstByte)
+	ensure.True(t, stats.TimeToFirstByte <= stats.Duration.Header, stats.TimeToFirstByte, stats.Duration.Header)
+	ensure.True(t, stats.Duration.Body >= transfer, stats.Duration.Body)
+}
+
+func TestTrace1xx(t *testing.T) {
+	t.Parallel()
+	const think = 50 * time.Millisecond
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Link", "</style.css>; rel=preload; as=style")
+			w.WriteHeader(http.StatusEarlyHints)
+			time.Sleep(think)
+			w.Header().Del("Link")
+			w.Write(theAnswer)
+		}))
+	defer server.Close()
+	var codes []int
+	var links []string
+	var stats *httpcontrol.Stats
+	transport := &httpcontrol.Transport{
+		Trace1xx: func(code int, header http.Header) {
+			codes = append(codes, code)
+			links = append(links, header.Get("Link"))
+		},
+		Stats: func(s *httpcontrol.Stats) { stats = s },
+	}
+	client := &http.Client{Transport: transport}
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	ensure.DeepEqual(t, res.StatusCode, http.StatusOK)
+	assertResponse(res, t)
+	ensure.DeepEqual(t, codes, []int{http.StatusEarlyHints})
+	ensure.DeepEqual(t, links, []string{"</style.css>; rel=preload; as=style"})
+	// Measured to the final response rather than the early hints.
+	ensure.True(t, stats.TimeToFirstByte >= think, stats.TimeToFirstByte)
+	ensure.True(t, stats.Timing.WaitResponse >= think, stats.Timing.WaitResponse)
+}
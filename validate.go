@@ -0,0 +1,38 @@
+package httpcontrol
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+)
+
+// prefixBody is a body whose first bytes were already read, for the
+// ValidateResponse or to measure a request body, and are read again from the
+// buffer.
+type prefixBody struct {
+	io.Reader
+	io.Closer
+}
+
+// validate runs the ValidateResponse on res. With ValidateBodyBytes, that much
+// of the body is buffered and given to the ValidateResponse, then put back in
+// front of the rest of the body. An error reading the prefix fails the
+// response too.
+func (t *Transport) validate(res *http.Response) error {
+	if t.ValidateBodyBytes <= 0 {
+		return t.callbackErr(func() error { return t.ValidateResponse(res) })
+	}
+	body := res.Body
+	prefix, err := ioutil.ReadAll(io.LimitReader(body, t.ValidateBodyBytes))
+	if err != nil {
+		return err
+	}
+	res.Body = ioutil.NopCloser(bytes.NewReader(prefix))
+	err = t.callbackErr(func() error { return t.ValidateResponse(res) })
+	res.Body = &prefixBody{
+		Reader: io.MultiReader(bytes.NewReader(prefix), body),
+		Closer: body,
+	}
+	return err
+}
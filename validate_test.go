@@ -0,0 +1,95 @@
+package httpcontrol_test
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/facebookgo/ensure"
+	"github.com/facebookgo/httpcontrol"
+)
+
+var errTryAgain = errors.New("try again later")
+
+// envelopeHandler answers with a 200 error envelope for the first failures
+// requests, then with a long successful body.
+func envelopeHandler(failures int32) http.Handler {
+	var count int32
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&count, 1) <= failures {
+			io.WriteString(w, `{"error":"try again"}`)
+			return
+		}
+		io.WriteString(w, `{"ok":`+strings.Repeat(" ", 1000)+`true}`)
+	})
+}
+
+func validateEnvelope(res *http.Response) error {
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(string(b), `{"error"`) {
+		return errTryAgain
+	}
+	return nil
+}
+
+func TestValidateResponseRetry(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(envelopeHandler(1))
+	defer server.Close()
+	var errs []error
+	transport := &httpcontrol.Transport{
+		MaxTries:          1,
+		ValidateResponse:  validateEnvelope,
+		ValidateBodyBytes: 16,
+		Stats:             func(stats *httpcontrol.Stats) { errs = append(errs, stats.Error) },
+	}
+	client := &http.Client{Transport: transport}
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	b, err := ioutil.ReadAll(res.Body)
+	ensure.Nil(t, err)
+	ensure.Nil(t, res.Body.Close())
+	ensure.DeepEqual(t, string(b), `{"ok":`+strings.Repeat(" ", 1000)+`true}`)
+	ensure.DeepEqual(t, errs, []error{errTryAgain, nil})
+}
+
+func TestValidateResponseExhausted(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(envelopeHandler(2))
+	defer server.Close()
+	var tries int
+	transport := &httpcontrol.Transport{
+		MaxTries:          1,
+		ValidateResponse:  validateEnvelope,
+		ValidateBodyBytes: 16,
+		Stats:             func(*httpcontrol.Stats) { tries++ },
+	}
+	client := &http.Client{Transport: transport}
+	_, err := client.Get(server.URL)
+	ensure.True(t, errors.Is(err, errTryAgain), err)
+	ensure.DeepEqual(t, tries, 2)
+}
+
+func TestValidateResponseHeaders(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(sleepHandler(0))
+	defer server.Close()
+	transport := &httpcontrol.Transport{
+		ValidateResponse: func(res *http.Response) error {
+			ensure.DeepEqual(t, res.StatusCode, http.StatusOK)
+			return nil
+		},
+	}
+	client := &http.Client{Transport: transport}
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+}
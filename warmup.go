@@ -0,0 +1,119 @@
+package httpcontrol
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"sync"
+)
+
+// Warmup opens n connections to the host of rawURL and returns them to the
+// pool as idle connections, so the first requests to the host do not have to
+// dial. Each connection is opened by a HEAD request for rawURL, held until
+// all n connections are open so that none is reused for another. The requests
+// are made without retries, stats or the other request level features.
+//
+// The dials are bounded by the DialTimeout as for any request, and the whole
+// warmup by ctx. n is capped at MaxConnsPerHost, whose slots the requests
+// hold, and at MaxIdleConnsPerHost, beyond which the pool would close the
+// connections again. With HTTP/2 a single connection is shared by all the
+// requests. Warmup returns the first error, once all the requests are over.
+func (t *Transport) Warmup(ctx context.Context, rawURL string, n int) error {
+	t.startOnce.Do(t.start)
+	if t.startErr != nil {
+		return t.startErr
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if t.DisableKeepAlives {
+		return nil
+	}
+	if t.MaxConnsPerHost > 0 && n > t.MaxConnsPerHost {
+		n = t.MaxConnsPerHost
+	}
+	if t.base == nil {
+		idle := t.MaxIdleConnsPerHost
+		if idle == 0 {
+			idle = http.DefaultMaxIdleConnsPerHost
+		}
+		if n > idle {
+			n = idle
+		}
+	}
+	if n <= 0 {
+		return nil
+	}
+
+	// Every request arrives once it has its connection, or has failed to
+	// get one, and holds on to the connection until all have arrived.
+	var arrived, over sync.WaitGroup
+	arrived.Add(n)
+	over.Add(n)
+	all := make(chan struct{})
+	go func() {
+		arrived.Wait()
+		close(all)
+	}()
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		go func() {
+			defer over.Done()
+			var once sync.Once
+			arrive := func() { once.Do(arrived.Done) }
+			defer arrive()
+			errs <- t.warmup(ctx, u, func() {
+				arrive()
+				select {
+				case <-all:
+				case <-ctx.Done():
+				}
+			})
+		}()
+	}
+	over.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// warmup sends a single HEAD request for the Warmup, calling gotConn once it
+// has its connection.
+func (t *Transport) warmup(ctx context.Context, u *url.URL, gotConn func()) error {
+	_, release, err := t.acquireConn(ctx, u.Host)
+	if err != nil {
+		return err
+	}
+	if release != nil {
+		defer release()
+	}
+	if t.base == nil {
+		ctx = t.withPoolTrace(ctx, nil)
+		if t.transport.Proxy != nil {
+			ctx = withTunnel(ctx)
+		}
+	}
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(httptrace.GotConnInfo) { gotConn() },
+	})
+	req, err := http.NewRequestWithContext(ctx, "HEAD", u.String(), nil)
+	if err != nil {
+		return err
+	}
+	if err := t.chooseTunnel(req); err != nil {
+		return err
+	}
+	res, err := t.roundTripper(req, t.tlsServerName(req), false).RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, res.Body)
+	return res.Body.Close()
+}
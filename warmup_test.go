@@ -0,0 +1,102 @@
+package httpcontrol_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"github.com/facebookgo/httpcontrol"
+)
+
+func TestWarmup(t *testing.T) {
+	t.Parallel()
+	const concurrent = 3
+	var arrived sync.WaitGroup
+	arrived.Add(concurrent)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == "GET" {
+				// Hold the requests until all are in flight, so each
+				// needs its own connection.
+				arrived.Done()
+				arrived.Wait()
+			}
+			w.Write([]byte(theAnswer))
+		}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	ensure.Nil(t, err)
+
+	var mu sync.Mutex
+	var stats []*httpcontrol.Stats
+	transport := &httpcontrol.Transport{
+		MaxIdleConnsPerHost: concurrent,
+		Stats: func(s *httpcontrol.Stats) {
+			mu.Lock()
+			stats = append(stats, s)
+			mu.Unlock()
+		},
+	}
+	defer transport.Close()
+	ensure.Nil(t, transport.Warmup(context.Background(), server.URL, concurrent))
+	stat := transport.PoolStats()
+	ensure.DeepEqual(t, stat.Dials, uint64(concurrent))
+	ensure.DeepEqual(t, stat.Idle[u.Host], concurrent)
+
+	client := &http.Client{Transport: transport}
+	var wg sync.WaitGroup
+	for i := 0; i < concurrent; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			res, err := client.Get(server.URL)
+			ensure.Nil(t, err)
+			assertResponse(res, t)
+		}()
+	}
+	wg.Wait()
+
+	ensure.DeepEqual(t, transport.PoolStats().Dials, uint64(concurrent))
+	mu.Lock()
+	defer mu.Unlock()
+	ensure.DeepEqual(t, len(stats), concurrent)
+	for _, s := range stats {
+		ensure.True(t, s.ConnReused)
+	}
+}
+
+func TestWarmupCapped(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(sleepHandler(0))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	ensure.Nil(t, err)
+
+	transport := &httpcontrol.Transport{MaxIdleConnsPerHost: 4, MaxConnsPerHost: 2}
+	defer transport.Close()
+	ensure.Nil(t, transport.Warmup(context.Background(), server.URL, 5))
+	stat := transport.PoolStats()
+	ensure.DeepEqual(t, stat.Dials, uint64(2))
+	ensure.DeepEqual(t, stat.Idle[u.Host], 2)
+
+	transport = &httpcontrol.Transport{}
+	defer transport.Close()
+	ensure.Nil(t, transport.Warmup(context.Background(), server.URL, 5))
+	ensure.DeepEqual(t, transport.PoolStats().Dials, uint64(http.DefaultMaxIdleConnsPerHost))
+}
+
+func TestWarmupError(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(sleepHandler(0))
+	server.Close()
+
+	transport := &httpcontrol.Transport{DialTimeout: time.Second}
+	defer transport.Close()
+	ensure.NotNil(t, transport.Warmup(context.Background(), server.URL, 2))
+	ensure.DeepEqual(t, len(transport.PoolStats().Idle), 0)
+}
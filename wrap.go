@@ -0,0 +1,56 @@
+package httpcontrol
+
+import "net/http"
+
+// Wrap returns a Transport that makes its attempts with rt, such as an
+// http.Transport configured by some SDK, instead of building its own. The
+// Transport adds its retries, timeouts, stats and the other request level
+// features on top, and may be configured further before its first use.
+//
+// Connections are then the responsibility of rt, so the settings about them
+// are ignored: Proxy, DynamicProxyEnv, ProxyConnect, SetProxyURL, the TLS
+// settings from TLSClientConfig to PinnedKeys and TLSHandshakeTimeout,
+// ServerNameOverride, DisableKeepAlives, DisableCompression, EnableHTTP2,
+// MaxIdleConnsPerHost, IdleConnTimeout, MaxConcurrentDials,
+// MaxResponseHeaderBytes and the dial settings from Dial to DNSCacheTTL.
+// PoolStats stays empty, Underlying returns nil, RetryFreshConn has no effect
+// and retries after a dropped keep-alive connection are left to rt.
+// MaxConnsPerHost, the ResponseHeaderTimeout and everything else still apply.
+func Wrap(rt http.RoundTripper) *Transport {
+	return &Transport{base: rt}
+}
+
+// roundTripper returns the RoundTripper making the attempt with out, for the
+// TLS serverName if any. A fresh one does not reuse pooled connections.
+func (t *Transport) roundTripper(out *http.Request, serverName string, fresh bool) http.RoundTripper {
+	if t.base != nil {
+		return t.base
+	}
+	key := hostKey{serverName: serverName}
+	if tn, ok := out.Context().Value(tunnelKey).(*tunnel); ok && tn.url != nil {
+		key.proxy = tn.url.String()
+	}
+	if ht := t.hostTransport(out, key); ht != nil {
+		if fresh {
+			return ht.freshTransport()
+		}
+		return ht.transport
+	}
+	if fresh {
+		return t.freshTransport()
+	}
+	return t.transport
+}
+
+// closeIdleConnections closes the idle connections of the RoundTripper making
+// the attempts, if it supports it.
+func (t *Transport) closeIdleConnections() {
+	if t.base == nil {
+		t.transport.CloseIdleConnections()
+		t.closeHostIdleConnections()
+		return
+	}
+	if c, ok := t.base.(interface{ CloseIdleConnections() }); ok {
+		c.CloseIdleConnections()
+	}
+}
@@ -0,0 +1,56 @@
+package httpcontrol_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/facebookgo/ensure"
+	"github.com/facebookgo/httpcontrol"
+)
+
+func TestWrap(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(statusThenAnswerHandler(http.StatusServiceUnavailable, 1))
+	defer server.Close()
+	var dials int32
+	var dialer net.Dialer
+	base := &http.Transport{
+		DialContext: func(ctx context.Context, network, address string) (net.Conn, error) {
+			atomic.AddInt32(&dials, 1)
+			return dialer.DialContext(ctx, network, address)
+		},
+	}
+	transport := httpcontrol.Wrap(base)
+	transport.MaxTries = 1
+	transport.RetryStatuses = []int{http.StatusServiceUnavailable}
+	var stats []*httpcontrol.Stats
+	transport.Stats = func(s *httpcontrol.Stats) { stats = append(stats, s) }
+	client := &http.Client{Transport: transport}
+	res, err := client.Get(server.URL)
+	ensure.Nil(t, err)
+	assertResponse(res, t)
+	ensure.DeepEqual(t, len(stats), 2)
+	ensure.True(t, stats[0].Retry.Pending)
+	ensure.True(t, stats[1].ConnReused)
+	ensure.DeepEqual(t, atomic.LoadInt32(&dials), int32(1))
+	ensure.True(t, transport.Underlying() == nil)
+	ensure.DeepEqual(t, transport.PoolStats().Dials, uint64(0))
+	transport.Close()
+}
+
+func TestWrapRequestTimeout(t *testing.T) {
+	t.Parallel()
+	server := httptest.NewServer(sleepHandler(time.Second))
+	defer server.Close()
+	transport := httpcontrol.Wrap(&http.Transport{})
+	transport.RequestTimeout = 10 * time.Millisecond
+	client := &http.Client{Transport: transport}
+	_, err := client.Get(server.URL)
+	ensure.True(t, errors.Is(err, httpcontrol.ErrRequestTimeout), err)
+}